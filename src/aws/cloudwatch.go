@@ -2,13 +2,19 @@ package aws
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
 )
 
-type cloudwatchLogsClientAPI interface {
+// CloudWatchLogsClientAPI is an internal interface for cloudwatchlogs
+type CloudWatchLogsClientAPI interface {
 	GetLogEvents(ctx context.Context, params *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error)
 }
 
@@ -17,15 +23,132 @@ type LogDetails struct {
 	logStreamName string
 }
 
-func RetrieveLogs(ctx context.Context, cloudwatchLogsClientAPI cloudwatchLogsClientAPI, loggingDetails LogDetails) ([]types.OutputLogEvent, error) {
-	response, err := cloudwatchLogsClientAPI.GetLogEvents(ctx, &cloudwatchlogs.GetLogEventsInput{
-		LogStreamName: &loggingDetails.logStreamName,
-		LogGroupName:  &loggingDetails.logGroupName,
-		StartFromHead: aws.Bool(true),
-	})
+// ConsoleURL links to the log stream in the CloudWatch console for the region. The console expects the group and
+// stream names to be URL encoded twice, with the second encoding of "%" written as "$25".
+func (d LogDetails) ConsoleURL(region string) string {
+	encode := func(name string) string {
+		return strings.ReplaceAll(url.QueryEscape(url.QueryEscape(name)), "%", "$")
+	}
+
+	return fmt.Sprintf("https://%s.console.aws.amazon.com/cloudwatch/home?region=%s#logsV2:log-groups/log-group/%s/log-events/%s", region, region, encode(d.logGroupName), encode(d.logStreamName))
+}
+
+// truncatedLogMessage replaces the output beyond the configured maximum number of lines
+const truncatedLogMessage = "[output truncated: reached the maximum of %d lines]"
+
+// RetrieveLogs retrieves every event in the log stream
+func RetrieveLogs(ctx context.Context, cloudwatchLogsClientAPI CloudWatchLogsClientAPI, loggingDetails LogDetails) ([]types.OutputLogEvent, error) {
+	return RetrieveLogsWithLimit(ctx, cloudwatchLogsClientAPI, loggingDetails, 0)
+}
+
+// RetrieveLogsWithLimit retrieves the events in the log stream, following pages until the end of the stream or until
+// maxLines events have been read. When the limit is hit, a final marker event notes that the output was truncated.
+// A maxLines of zero or less retrieves the whole stream.
+func RetrieveLogsWithLimit(ctx context.Context, cloudwatchLogsClientAPI CloudWatchLogsClientAPI, loggingDetails LogDetails, maxLines int) ([]types.OutputLogEvent, error) {
+	events := []types.OutputLogEvent{}
+	limiter := &logLimiter{
+		maxLines: maxLines,
+		onEvent: func(event types.OutputLogEvent) {
+			events = append(events, event)
+		},
+	}
+
+	_, _, err := readAvailableLogs(ctx, cloudwatchLogsClientAPI, loggingDetails, nil, limiter)
 	if err != nil {
 		return []types.OutputLogEvent{}, err
 	}
 
-	return response.Events, nil
+	return events, nil
+}
+
+// TailLogs follows a log stream, passing each event to onEvent as it becomes available. The stream is polled every
+// pollInterval until stopped is closed, after which the remaining events are drained before returning. Once maxLines
+// events have been passed on (if maxLines is greater than zero), a truncation marker is sent and tailing ends.
+func TailLogs(ctx context.Context, cloudwatchLogsClientAPI CloudWatchLogsClientAPI, loggingDetails LogDetails, pollInterval time.Duration, maxLines int, stopped <-chan struct{}, onEvent func(types.OutputLogEvent)) error {
+	var nextToken *string
+
+	limiter := &logLimiter{
+		maxLines: maxLines,
+		onEvent:  onEvent,
+	}
+
+	for {
+		var (
+			truncated bool
+			err       error
+		)
+
+		nextToken, truncated, err = readAvailableLogs(ctx, cloudwatchLogsClientAPI, loggingDetails, nextToken, limiter)
+		if err != nil || truncated {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stopped:
+			_, _, err = readAvailableLogs(ctx, cloudwatchLogsClientAPI, loggingDetails, nextToken, limiter)
+			return err
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// readAvailableLogs reads every page of events currently in the stream after nextToken, and returns the token to
+// resume reading from once more events have been ingested. Reading stops early if the limiter truncates the output.
+func readAvailableLogs(ctx context.Context, cloudwatchLogsClientAPI CloudWatchLogsClientAPI, loggingDetails LogDetails, nextToken *string, limiter *logLimiter) (*string, bool, error) {
+	for {
+		response, err := cloudwatchLogsClientAPI.GetLogEvents(ctx, &cloudwatchlogs.GetLogEventsInput{
+			LogStreamName: &loggingDetails.logStreamName,
+			LogGroupName:  &loggingDetails.logGroupName,
+			StartFromHead: aws.Bool(true),
+			NextToken:     nextToken,
+		})
+		if err != nil {
+			// The stream is only created once the container starts, until then there is nothing to read
+			var notFound *types.ResourceNotFoundException
+			if errors.As(err, &notFound) {
+				return nextToken, false, nil
+			}
+
+			return nextToken, false, err
+		}
+
+		for _, event := range response.Events {
+			if !limiter.forward(event) {
+				return nextToken, true, nil
+			}
+		}
+
+		// CloudWatch signals the end of the stream by handing back the token that was passed in
+		if response.NextForwardToken == nil || (nextToken != nil && *response.NextForwardToken == *nextToken) {
+			return nextToken, false, nil
+		}
+
+		nextToken = response.NextForwardToken
+	}
+}
+
+// logLimiter passes events on until maxLines have been seen, then replaces the rest with a single truncation marker
+type logLimiter struct {
+	maxLines int
+	seen     int
+	onEvent  func(types.OutputLogEvent)
+}
+
+// forward passes the event on, returning false once the output has been truncated
+func (l *logLimiter) forward(event types.OutputLogEvent) bool {
+	if l.maxLines > 0 && l.seen >= l.maxLines {
+		l.onEvent(types.OutputLogEvent{
+			Message:   aws.String(fmt.Sprintf(truncatedLogMessage, l.maxLines)),
+			Timestamp: event.Timestamp,
+		})
+
+		return false
+	}
+
+	l.seen++
+	l.onEvent(event)
+
+	return true
 }
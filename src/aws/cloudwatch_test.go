@@ -3,7 +3,10 @@ package aws
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
@@ -98,3 +101,160 @@ func TestRetrieveLogs(t *testing.T) {
 		})
 	}
 }
+
+func TestRetrieveLogsWithLimit(t *testing.T) {
+	input := LogDetails{
+		logGroupName:  "test-group",
+		logStreamName: "test-stream/test-container/07cc583696bd44e0be450bff7314ddaf",
+	}
+
+	// a stream of five single-event pages, terminated by the token being repeated
+	client := mockCloudwatchLogsClient{
+		mockGetLogEvents: func(ctx context.Context, params *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+			page := 0
+			if params.NextToken != nil {
+				page, _ = strconv.Atoi(*params.NextToken)
+			}
+
+			if page == 5 {
+				return &cloudwatchlogs.GetLogEventsOutput{NextForwardToken: params.NextToken}, nil
+			}
+
+			return &cloudwatchlogs.GetLogEventsOutput{
+				Events: []types.OutputLogEvent{
+					{Message: aws.String(fmt.Sprintf("line %d", page)), Timestamp: aws.Int64(int64(page))},
+				},
+				NextForwardToken: aws.String(strconv.Itoa(page + 1)),
+			}, nil
+		},
+	}
+
+	tests := []struct {
+		name     string
+		maxLines int
+		expected []string
+	}{
+		{
+			name:     "given no limit, it should follow every page until the token repeats",
+			maxLines: 0,
+			expected: []string{"line 0", "line 1", "line 2", "line 3", "line 4"},
+		},
+		{
+			name:     "given a limit larger than the stream, it should return every event without a marker",
+			maxLines: 10,
+			expected: []string{"line 0", "line 1", "line 2", "line 3", "line 4"},
+		},
+		{
+			name:     "given a limit smaller than the stream, it should truncate the output and add a marker",
+			maxLines: 3,
+			expected: []string{"line 0", "line 1", "line 2", "[output truncated: reached the maximum of 3 lines]"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			events, err := RetrieveLogsWithLimit(context.TODO(), client, input, tc.maxLines)
+			require.NoError(t, err)
+
+			result := make([]string, 0, len(events))
+			for _, event := range events {
+				result = append(result, *event.Message)
+			}
+
+			t.Logf("result: %v", result)
+			t.Logf("expected: %v", tc.expected)
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+}
+
+func TestTailLogs(t *testing.T) {
+	input := LogDetails{
+		logGroupName:  "test-group",
+		logStreamName: "test-stream/test-container/07cc583696bd44e0be450bff7314ddaf",
+	}
+
+	// pages of the log stream, keyed by the token used to request them
+	pages := map[string]*cloudwatchlogs.GetLogEventsOutput{
+		"": {
+			Events: []types.OutputLogEvent{
+				{Message: aws.String("migrating beans"), Timestamp: aws.Int64(0)},
+				{Message: aws.String("migrating more beans"), Timestamp: aws.Int64(1)},
+			},
+			NextForwardToken: aws.String("f/1"),
+		},
+		"f/1": {
+			Events: []types.OutputLogEvent{
+				{Message: aws.String("beans migrated"), Timestamp: aws.Int64(2)},
+			},
+			NextForwardToken: aws.String("f/2"),
+		},
+		"f/2": {
+			Events:           []types.OutputLogEvent{},
+			NextForwardToken: aws.String("f/2"),
+		},
+	}
+
+	pagedClient := mockCloudwatchLogsClient{
+		mockGetLogEvents: func(ctx context.Context, params *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+			return pages[aws.ToString(params.NextToken)], nil
+		},
+	}
+
+	tests := []struct {
+		name     string
+		client   mockCloudwatchLogsClient
+		maxLines int
+		expected []string
+	}{
+		{
+			name:     "given a task that has stopped, it should drain every page of the stream",
+			client:   pagedClient,
+			expected: []string{"migrating beans", "migrating more beans", "beans migrated"},
+		},
+		{
+			name:     "when the output exceeds the maximum number of lines, it should stop with a truncation marker",
+			client:   pagedClient,
+			maxLines: 2,
+			expected: []string{"migrating beans", "migrating more beans", "[output truncated: reached the maximum of 2 lines]"},
+		},
+		{
+			name: "when the log stream has not been created yet, it should return without error",
+			client: mockCloudwatchLogsClient{
+				mockGetLogEvents: func(ctx context.Context, params *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+					return nil, &types.ResourceNotFoundException{Message: aws.String("The specified log stream does not exist.")}
+				},
+			},
+			expected: nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stopped := make(chan struct{})
+			close(stopped)
+
+			var result []string
+
+			err := TailLogs(context.TODO(), tc.client, input, time.Millisecond, tc.maxLines, stopped, func(event types.OutputLogEvent) {
+				result = append(result, *event.Message)
+			})
+
+			t.Logf("result: %v", result)
+			t.Logf("expected: %v", tc.expected)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+
+	t.Run("when the underlying cloudwatch client experiences an error, return it in the function", func(t *testing.T) {
+		client := mockCloudwatchLogsClient{
+			mockGetLogEvents: func(ctx context.Context, params *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+				return nil, errors.New("generic cloudwatch error")
+			},
+		}
+
+		err := TailLogs(context.TODO(), client, input, time.Millisecond, 0, make(chan struct{}), func(types.OutputLogEvent) {})
+		require.EqualError(t, err, "generic cloudwatch error")
+	})
+}
@@ -0,0 +1,111 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBAPI is the subset of the DynamoDB client used to hold migration locks
+type DynamoDBAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+// Attributes of the items in the lock table. The table must have a string partition key named LockKey, and can have
+// TTL enabled on ExpiresAt so that expired locks are removed.
+const (
+	lockKeyAttribute   = "LockKey"
+	holderIDAttribute  = "HolderID"
+	buildURLAttribute  = "BuildURL"
+	expiresAtAttribute = "ExpiresAt"
+)
+
+// LockHolder identifies the job that holds a migration lock
+type LockHolder struct {
+	// ID is shared by every attempt of the job, so that a retry can take over a lock held by an attempt that was lost
+	ID string
+	// BuildURL is shown to other builds waiting for the lock
+	BuildURL string
+}
+
+// DynamoDBLock holds migration locks as leases on items in a DynamoDB table. A lease that has expired can be taken by
+// anyone, so a lock held by an agent that is lost is released once its lease runs out.
+type DynamoDBLock struct {
+	API       DynamoDBAPI
+	TableName string
+}
+
+// TryAcquire takes the lock if it is free or its lease has expired, or renews the lease if it is already held by the
+// holder. When the lock is held by someone else, they are returned as the current holder.
+func (l DynamoDBLock) TryAcquire(ctx context.Context, key string, holder LockHolder, lease time.Duration) (LockHolder, bool, error) {
+	now := time.Now()
+
+	_, err := l.API.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(l.TableName),
+		Item: map[string]types.AttributeValue{
+			lockKeyAttribute:   &types.AttributeValueMemberS{Value: key},
+			holderIDAttribute:  &types.AttributeValueMemberS{Value: holder.ID},
+			buildURLAttribute:  &types.AttributeValueMemberS{Value: holder.BuildURL},
+			expiresAtAttribute: &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(lease).Unix(), 10)},
+		},
+		ConditionExpression: aws.String(fmt.Sprintf("attribute_not_exists(%s) OR %s < :now OR %s = :holder", lockKeyAttribute, expiresAtAttribute, holderIDAttribute)),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			":holder": &types.AttributeValueMemberS{Value: holder.ID},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return lockHolderFromItem(conditionFailed.Item), false, nil
+	}
+
+	if err != nil {
+		return LockHolder{}, false, classifyError("dynamodb:PutItem", err)
+	}
+
+	return holder, true, nil
+}
+
+// Release frees the lock, provided it is still held by the holder
+func (l DynamoDBLock) Release(ctx context.Context, key string, holder LockHolder) error {
+	_, err := l.API.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(l.TableName),
+		Key: map[string]types.AttributeValue{
+			lockKeyAttribute: &types.AttributeValueMemberS{Value: key},
+		},
+		ConditionExpression: aws.String(holderIDAttribute + " = :holder"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":holder": &types.AttributeValueMemberS{Value: holder.ID},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return fmt.Errorf("lock %s is no longer held by %s, its lease may have expired", key, holder.ID)
+	}
+
+	return classifyError("dynamodb:DeleteItem", err)
+}
+
+func lockHolderFromItem(item map[string]types.AttributeValue) LockHolder {
+	var holder LockHolder
+
+	if id, ok := item[holderIDAttribute].(*types.AttributeValueMemberS); ok {
+		holder.ID = id.Value
+	}
+
+	if buildURL, ok := item[buildURLAttribute].(*types.AttributeValueMemberS); ok {
+		holder.BuildURL = buildURL.Value
+	}
+
+	return holder
+}
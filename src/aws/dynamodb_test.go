@@ -0,0 +1,140 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockDynamoDBClient struct {
+	mockPutItem    func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	mockDeleteItem func(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+func (m mockDynamoDBClient) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	return m.mockPutItem(ctx, params, optFns...)
+}
+
+func (m mockDynamoDBClient) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	return m.mockDeleteItem(ctx, params, optFns...)
+}
+
+func TestDynamoDBLockTryAcquire(t *testing.T) {
+	holder := LockHolder{ID: "step-1", BuildURL: "https://buildkite.com/culture-amp/cool-service/builds/1"}
+	otherHolder := LockHolder{ID: "step-2", BuildURL: "https://buildkite.com/culture-amp/cool-service/builds/2"}
+
+	t.Run("given a free lock, it should take it with a lease", func(t *testing.T) {
+		var input *dynamodb.PutItemInput
+
+		lock := DynamoDBLock{
+			TableName: "migration-locks",
+			API: mockDynamoDBClient{
+				mockPutItem: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+					input = params
+					return &dynamodb.PutItemOutput{}, nil
+				},
+			},
+		}
+
+		before := time.Now()
+		current, acquired, err := lock.TryAcquire(context.TODO(), "/cool-service/migrations", holder, time.Minute)
+
+		require.NoError(t, err)
+		assert.True(t, acquired)
+		assert.Equal(t, holder, current)
+		assert.Equal(t, "migration-locks", *input.TableName)
+		assert.Equal(t, &types.AttributeValueMemberS{Value: "/cool-service/migrations"}, input.Item["LockKey"])
+		assert.Equal(t, &types.AttributeValueMemberS{Value: "step-1"}, input.Item["HolderID"])
+		assert.Equal(t, "attribute_not_exists(LockKey) OR ExpiresAt < :now OR HolderID = :holder", *input.ConditionExpression)
+
+		expiresAt, err := strconv.ParseInt(input.Item["ExpiresAt"].(*types.AttributeValueMemberN).Value, 10, 64)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, expiresAt, before.Add(time.Minute).Unix())
+	})
+
+	t.Run("given a lock held by another build, it should return the holder", func(t *testing.T) {
+		lock := DynamoDBLock{
+			TableName: "migration-locks",
+			API: mockDynamoDBClient{
+				mockPutItem: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+					return nil, &types.ConditionalCheckFailedException{
+						Message: aws.String("The conditional request failed"),
+						Item: map[string]types.AttributeValue{
+							"HolderID": &types.AttributeValueMemberS{Value: otherHolder.ID},
+							"BuildURL": &types.AttributeValueMemberS{Value: otherHolder.BuildURL},
+						},
+					}
+				},
+			},
+		}
+
+		current, acquired, err := lock.TryAcquire(context.TODO(), "/cool-service/migrations", holder, time.Minute)
+
+		require.NoError(t, err)
+		assert.False(t, acquired)
+		assert.Equal(t, otherHolder, current)
+	})
+
+	t.Run("when the DynamoDB client experiences an error, it should return it", func(t *testing.T) {
+		lock := DynamoDBLock{
+			TableName: "migration-locks",
+			API: mockDynamoDBClient{
+				mockPutItem: func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+					return nil, errors.New("Requested resource not found")
+				},
+			},
+		}
+
+		_, acquired, err := lock.TryAcquire(context.TODO(), "/cool-service/migrations", holder, time.Minute)
+
+		require.EqualError(t, err, "Requested resource not found")
+		assert.False(t, acquired)
+	})
+}
+
+func TestDynamoDBLockRelease(t *testing.T) {
+	holder := LockHolder{ID: "step-1", BuildURL: "https://buildkite.com/culture-amp/cool-service/builds/1"}
+
+	t.Run("given a lock held by the holder, it should delete it", func(t *testing.T) {
+		var input *dynamodb.DeleteItemInput
+
+		lock := DynamoDBLock{
+			TableName: "migration-locks",
+			API: mockDynamoDBClient{
+				mockDeleteItem: func(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+					input = params
+					return &dynamodb.DeleteItemOutput{}, nil
+				},
+			},
+		}
+
+		err := lock.Release(context.TODO(), "/cool-service/migrations", holder)
+
+		require.NoError(t, err)
+		assert.Equal(t, &types.AttributeValueMemberS{Value: "/cool-service/migrations"}, input.Key["LockKey"])
+		assert.Equal(t, "HolderID = :holder", *input.ConditionExpression)
+	})
+
+	t.Run("given a lock taken over by someone else, it should return an error", func(t *testing.T) {
+		lock := DynamoDBLock{
+			TableName: "migration-locks",
+			API: mockDynamoDBClient{
+				mockDeleteItem: func(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+					return nil, &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+				},
+			},
+		}
+
+		err := lock.Release(context.TODO(), "/cool-service/migrations", holder)
+
+		require.EqualError(t, err, "lock /cool-service/migrations is no longer held by step-1, its lease may have expired")
+	})
+}
@@ -3,94 +3,304 @@ package aws
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
 )
 
+// MigrationsRunnerContainerName is the name of the container in the task definition that runs the migrations
+const MigrationsRunnerContainerName = "migrations-runner"
+
 // EcsClientAPI is an internal interface for ecs
 type EcsClientAPI interface {
 	RunTask(ctx context.Context, params *ecs.RunTaskInput, optFns ...func(*ecs.Options)) (*ecs.RunTaskOutput, error)
 	DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error)
 	DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error)
+	StopTask(ctx context.Context, params *ecs.StopTaskInput, optFns ...func(*ecs.Options)) (*ecs.StopTaskOutput, error)
+	DescribeClusters(ctx context.Context, params *ecs.DescribeClustersInput, optFns ...func(*ecs.Options)) (*ecs.DescribeClustersOutput, error)
 }
 
 type EcsWaiterAPI interface {
 	WaitForOutput(ctx context.Context, params *ecs.DescribeTasksInput, maxWaitDur time.Duration, optFns ...func(*ecs.TasksStoppedWaiterOptions)) (*ecs.DescribeTasksOutput, error)
 }
 
-func SubmitTask(ctx context.Context, ecsAPI EcsClientAPI, input *TaskRunnerConfiguration) (string, error) {
+// SubmitTask runs the task, returning its ARN. When the configuration has a client token and the AWS SDK had to repeat
+// the request, having lost the response to an earlier one, repeated is true: ECS returns the task started by the
+// earlier request with the same token rather than starting another.
+func SubmitTask(ctx context.Context, ecsAPI EcsClientAPI, input *TaskRunnerConfiguration) (string, bool, error) {
+	response, err := ecsAPI.RunTask(ctx, RunTaskInputForConfig(input))
+	if err != nil {
+		return "", false, classifyError("ecs:RunTask", err)
+	}
+
+	// Tasks that could not be placed are reported as failures rather than as an error
+	if len(response.Failures) > 0 {
+		failure := response.Failures[0]
+
+		reason := aws.ToString(failure.Reason)
+		if isCapacityReason(reason) {
+			return "", false, &CapacityUnavailableError{Reason: reason}
+		}
+
+		return "", false, &RunTaskFailedError{Arn: aws.ToString(failure.Arn), Reason: reason, Detail: aws.ToString(failure.Detail)}
+	}
+
+	if len(response.Tasks) == 0 || response.Tasks[0].TaskArn == nil {
+		responseJSON, err := json.Marshal(response)
+		if err != nil {
+			return "", false, fmt.Errorf("error in unmarshalling response for failed RunTask: %w", err)
+		}
+
+		return "", false, fmt.Errorf("ecs:RunTask response contains no TaskArn: %v", string(responseJSON))
+	}
+
+	attempts, _ := retry.GetAttemptResults(response.ResultMetadata)
+	repeated := input.ClientToken != "" && len(attempts.Results) > 1
+
+	// this is working on the assumption that only one task is returned
+	return *response.Tasks[0].TaskArn, repeated, nil
+}
+
+// RunTaskInputForConfig builds the request that SubmitTask makes to run the task
+func RunTaskInputForConfig(input *TaskRunnerConfiguration) *ecs.RunTaskInput {
 	var containerOverrides = ContainerOverrideForConfig(input)
 
-	response, err := ecsAPI.RunTask(ctx, &ecs.RunTaskInput{
-		Cluster:    &input.Cluster,
-		LaunchType: "FARGATE",
+	runTaskInput := &ecs.RunTaskInput{
+		Cluster: &input.Cluster,
 		Overrides: &types.TaskOverride{
 			ContainerOverrides: containerOverrides,
 		},
 		TaskDefinition: &input.TaskDefinitionArn,
-		NetworkConfiguration: &types.NetworkConfiguration{
+	}
+
+	// Only tasks using the awsvpc network mode, including every task on Fargate, are given a network configuration
+	if len(input.SubnetIds) > 0 {
+		runTaskInput.NetworkConfiguration = &types.NetworkConfiguration{
 			AwsvpcConfiguration: &types.AwsVpcConfiguration{
 				Subnets:        input.SubnetIds,
 				SecurityGroups: input.SecurityGroupIds,
 			},
-		},
-	})
-	if err != nil {
-		return "", err
+		}
+
+		if input.AssignPublicIp {
+			runTaskInput.NetworkConfiguration.AwsvpcConfiguration.AssignPublicIp = types.AssignPublicIpEnabled
+		}
 	}
 
-	if response.Tasks[0].TaskArn == nil {
-		responseJSON, err := json.Marshal(response)
-		if err != nil {
-			return "", fmt.Errorf("error in unmarshalling response for failed RunTask: %w", err)
+	// A launch type can't be given alongside a capacity provider strategy
+	if len(input.CapacityProviderStrategy) > 0 {
+		for _, item := range input.CapacityProviderStrategy {
+			runTaskInput.CapacityProviderStrategy = append(runTaskInput.CapacityProviderStrategy, types.CapacityProviderStrategyItem{
+				CapacityProvider: aws.String(item.CapacityProvider),
+				Weight:           item.Weight,
+				Base:             item.Base,
+			})
 		}
+	} else {
+		runTaskInput.LaunchType = types.LaunchType(launchTypeForConfig(input))
+	}
+
+	applyTaskOverrides(input, runTaskInput.Overrides)
 
-		return "", fmt.Errorf("ecs:RunTask response contains no TaskArn: %v", string(responseJSON))
+	if input.ClientToken != "" {
+		runTaskInput.ClientToken = aws.String(input.ClientToken)
 	}
 
-	// this is working on the assumption that only one task is returned
-	return *response.Tasks[0].TaskArn, nil
+	if input.PlatformVersion != "" {
+		runTaskInput.PlatformVersion = aws.String(input.PlatformVersion)
+	}
+
+	for _, constraint := range input.PlacementConstraints {
+		placementConstraint := types.PlacementConstraint{Type: types.PlacementConstraintType(constraint.Type)}
+		if constraint.Expression != "" {
+			placementConstraint.Expression = aws.String(constraint.Expression)
+		}
+
+		runTaskInput.PlacementConstraints = append(runTaskInput.PlacementConstraints, placementConstraint)
+	}
+
+	for _, strategy := range input.PlacementStrategy {
+		placementStrategy := types.PlacementStrategy{Type: types.PlacementStrategyType(strategy.Type)}
+		if strategy.Field != "" {
+			placementStrategy.Field = aws.String(strategy.Field)
+		}
+
+		runTaskInput.PlacementStrategy = append(runTaskInput.PlacementStrategy, placementStrategy)
+	}
+
+	return runTaskInput
 }
 
+// launchTypeForConfig returns the launch type the task is run with when no capacity provider strategy is given,
+// which is Fargate unless the configuration says otherwise
+func launchTypeForConfig(input *TaskRunnerConfiguration) string {
+	if input.LaunchType == "" {
+		return string(types.LaunchTypeFargate)
+	}
+
+	return input.LaunchType
+}
+
+// DescribeTaskDefinition retrieves the task definition
+func DescribeTaskDefinition(ctx context.Context, ecsAPI EcsClientAPI, taskDefinitionArn string) (*types.TaskDefinition, error) {
+	response, err := ecsAPI.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(taskDefinitionArn),
+	})
+	if err != nil {
+		return nil, classifyError("ecs:DescribeTaskDefinition", err)
+	}
+
+	if response.TaskDefinition == nil {
+		return nil, fmt.Errorf("ecs:DescribeTaskDefinition response contains no task definition for %s", taskDefinitionArn)
+	}
+
+	return response.TaskDefinition, nil
+}
+
+// waiterDeadlinePadding extends the deadline given to the waiter beyond the timeout, so that the timeout is always
+// enforced by the context and can be identified as a TimeoutError rather than from the waiter's error message
+const waiterDeadlinePadding = time.Minute
+
 func WaitForCompletion(ctx context.Context, waiter EcsWaiterAPI, taskArn string, timeOut int) (*ecs.DescribeTasksOutput, error) {
 	cluster := ClusterFromTaskArn(taskArn)
 
 	maxWaitDuration := time.Duration(timeOut) * time.Second
-	result, err := waiter.WaitForOutput(ctx, &ecs.DescribeTasksInput{
+
+	waitCtx, cancel := context.WithTimeout(ctx, maxWaitDuration)
+	defer cancel()
+
+	result, err := waiter.WaitForOutput(waitCtx, &ecs.DescribeTasksInput{
 		Cluster: aws.String(cluster),
 		Tasks:   []string{taskArn},
-	}, maxWaitDuration)
+	}, maxWaitDuration+waiterDeadlinePadding)
 
 	// the `DescribeTasksOutput` struct is returned even if there is an error. Counterintuitively, it happens to include failure information
 	// which we may want to surface from the `Failures` struct field
 	if err != nil {
-		return result, err
+		// only our own deadline is a timeout, the parent context expiring means the plugin itself is being stopped
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return result, &TimeoutError{TaskArn: taskArn, Timeout: maxWaitDuration}
+		}
+
+		return result, classifyError("ecs:DescribeTasks", err)
 	}
 
 	// In a successful scenario, we should have a `tasks` slice with a single element
 	return result, nil
 }
 
+// StopTask stops a running task, recording the reason against it so it is visible in the ECS console
+func StopTask(ctx context.Context, ecsAPI EcsClientAPI, taskArn string, reason string) error {
+	_, err := ecsAPI.StopTask(ctx, &ecs.StopTaskInput{
+		Cluster: aws.String(ClusterFromTaskArn(taskArn)),
+		Task:    aws.String(taskArn),
+		Reason:  aws.String(reason),
+	})
+
+	return classifyError("ecs:StopTask", err)
+}
+
+// DescribeTask retrieves a task by its ARN. ECS only keeps stopped tasks for a short time, so a task that is no longer
+// known is reported as not found rather than as an error.
+func DescribeTask(ctx context.Context, ecsAPI EcsClientAPI, taskArn string) (types.Task, bool, error) {
+	response, err := ecsAPI.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+		Cluster: aws.String(ClusterFromTaskArn(taskArn)),
+		Tasks:   []string{taskArn},
+	})
+	if err != nil {
+		return types.Task{}, false, classifyError("ecs:DescribeTasks", err)
+	}
+
+	if len(response.Tasks) == 0 {
+		return types.Task{}, false, nil
+	}
+
+	return response.Tasks[0], true, nil
+}
+
 func ContainerOverrideForConfig(input *TaskRunnerConfiguration) []types.ContainerOverride {
-	if len(input.Command) == 0 {
-		return []types.ContainerOverride{
-			{
-				Name: aws.String("migrations-runner"),
-			},
+	override := types.ContainerOverride{
+		Name:        aws.String(MigrationsRunnerContainerName),
+		Environment: environmentForConfig(input),
+	}
+
+	if len(input.Command) > 0 {
+		override.Command = input.Command
+	}
+
+	if input.ContainerCpu > 0 {
+		override.Cpu = aws.Int32(input.ContainerCpu)
+	}
+
+	if input.ContainerMemory > 0 {
+		override.Memory = aws.Int32(input.ContainerMemory)
+	}
+
+	return []types.ContainerOverride{override}
+}
+
+// applyTaskOverrides adds the task-level resource and role overrides in the configuration to the override
+func applyTaskOverrides(input *TaskRunnerConfiguration, override *types.TaskOverride) {
+	if input.Cpu != "" {
+		override.Cpu = aws.String(input.Cpu)
+	}
+
+	if input.Memory != "" {
+		override.Memory = aws.String(input.Memory)
+	}
+
+	if input.EphemeralStorage > 0 {
+		override.EphemeralStorage = &types.EphemeralStorage{SizeInGiB: input.EphemeralStorage}
+	}
+
+	if input.TaskRoleArn != "" {
+		override.TaskRoleArn = aws.String(input.TaskRoleArn)
+	}
+
+	if input.ExecutionRoleArn != "" {
+		override.ExecutionRoleArn = aws.String(input.ExecutionRoleArn)
+	}
+}
+
+// environmentForConfig combines the plain environment variables and resolved secrets, sorted by name so the
+// override is stable between runs
+func environmentForConfig(input *TaskRunnerConfiguration) []types.KeyValuePair {
+	names := make([]string, 0, len(input.Environment)+len(input.SecretValues))
+	values := make(map[string]string, cap(names))
+
+	for _, variables := range []map[string]string{input.Environment, input.SecretValues} {
+		for name, value := range variables {
+			if _, exists := values[name]; !exists {
+				names = append(names, name)
+			}
+
+			values[name] = value
 		}
 	}
 
-	return []types.ContainerOverride{
-		{
-			Name:    aws.String("migrations-runner"),
-			Command: input.Command,
-		},
+	if len(names) == 0 {
+		return nil
+	}
+
+	sort.Strings(names)
+
+	environment := make([]types.KeyValuePair, 0, len(names))
+	for _, name := range names {
+		environment = append(environment, types.KeyValuePair{
+			Name:  aws.String(name),
+			Value: aws.String(values[name]),
+		})
 	}
+
+	return environment
 }
 
 func ClusterFromTaskArn(arn string) string {
@@ -109,14 +319,22 @@ func FindLogStreamFromTask(ctx context.Context, ecsClientAPI EcsClientAPI, task
 		TaskDefinition: task.TaskDefinitionArn,
 	})
 	if err != nil {
-		return LogDetails{}, err
+		return LogDetails{}, classifyError("ecs:DescribeTaskDefinition", err)
 	}
 
 	if len(response.TaskDefinition.ContainerDefinitions) == 0 {
 		return LogDetails{}, fmt.Errorf("ecs:DescribeTaskDefinition response is missing ContainerDefinitions data: %v", response)
 	}
 
-	container := response.TaskDefinition.ContainerDefinitions[0] // assume first container is the application container
+	container, ok := findContainerDefinition(response.TaskDefinition.ContainerDefinitions, MigrationsRunnerContainerName)
+	if !ok {
+		return LogDetails{}, fmt.Errorf("task definition %s has no %s container", aws.ToString(task.TaskDefinitionArn), MigrationsRunnerContainerName)
+	}
+
+	if container.LogConfiguration == nil {
+		return LogDetails{}, fmt.Errorf("cannot trace task output: container logging is not configured on task definition: %s", aws.ToString(task.TaskDefinitionArn))
+	}
+
 	logGroupName := container.LogConfiguration.Options["awslogs-group"]
 	//NOTE: Takes the format: prefix-name/container-name/ecs-task-id
 	streamPrefix := container.LogConfiguration.Options["awslogs-stream-prefix"]
@@ -131,3 +349,184 @@ func FindLogStreamFromTask(ctx context.Context, ecsClientAPI EcsClientAPI, task
 		logStreamName: fmt.Sprintf("%s/%s/%s", streamPrefix, *container.Name, TaskIDFromArn(*task.TaskArn)),
 	}, nil
 }
+
+// ContainerResult is how a single container in a stopped task exited
+type ContainerResult struct {
+	Name      string
+	Essential bool
+	// ExitCode is nil when the container never ran, e.g. when its image could not be pulled
+	ExitCode *int32
+	Reason   string
+	Image    string
+	// ImageDigest identifies the exact image the container ran, whatever tag Image refers to
+	ImageDigest string
+}
+
+// TaskResult is how a stopped task and each of its containers exited
+type TaskResult struct {
+	TaskArn           string
+	Cluster           string
+	TaskDefinitionArn string
+	StoppedReason     string
+	StopCode          string
+	// StartedAt and StoppedAt are zero when the task never started
+	StartedAt  time.Time
+	StoppedAt  time.Time
+	Command    []string
+	Containers []ContainerResult
+}
+
+// DescribeTaskResult summarises how a stopped task exited. The task definition is consulted to find which of the
+// task's containers are essential, as this isn't reported on the task itself.
+func DescribeTaskResult(ctx context.Context, ecsAPI EcsClientAPI, task types.Task) (TaskResult, error) {
+	response, err := ecsAPI.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: task.TaskDefinitionArn,
+	})
+	if err != nil {
+		return TaskResult{}, classifyError("ecs:DescribeTaskDefinition", err)
+	}
+
+	result := TaskResult{
+		TaskArn:           aws.ToString(task.TaskArn),
+		Cluster:           clusterForTask(task),
+		TaskDefinitionArn: aws.ToString(task.TaskDefinitionArn),
+		StoppedReason:     aws.ToString(task.StoppedReason),
+		StopCode:          string(task.StopCode),
+		StartedAt:         aws.ToTime(task.StartedAt),
+		StoppedAt:         aws.ToTime(task.StoppedAt),
+		Command:           commandForTask(task, response.TaskDefinition),
+	}
+
+	for _, container := range task.Containers {
+		name := aws.ToString(container.Name)
+		// containers are essential unless the task definition says otherwise
+		essential := true
+
+		definition, ok := findContainerDefinition(response.TaskDefinition.ContainerDefinitions, name)
+		if ok && definition.Essential != nil {
+			essential = *definition.Essential
+		}
+
+		result.Containers = append(result.Containers, ContainerResult{
+			Name:        name,
+			Essential:   essential,
+			ExitCode:    container.ExitCode,
+			Reason:      aws.ToString(container.Reason),
+			Image:       aws.ToString(container.Image),
+			ImageDigest: aws.ToString(container.ImageDigest),
+		})
+	}
+
+	return result, nil
+}
+
+// clusterForTask returns the name of the cluster the task ran in
+func clusterForTask(task types.Task) string {
+	if task.ClusterArn != nil {
+		return TaskIDFromArn(*task.ClusterArn)
+	}
+
+	if RegionFromArn(aws.ToString(task.TaskArn)) == "" {
+		return ""
+	}
+
+	return ClusterFromTaskArn(*task.TaskArn)
+}
+
+// commandForTask returns the command the migrations-runner container ran: the command it was given when the task was
+// run, or otherwise the one in its task definition
+func commandForTask(task types.Task, definition *types.TaskDefinition) []string {
+	if task.Overrides != nil {
+		for _, override := range task.Overrides.ContainerOverrides {
+			if aws.ToString(override.Name) == MigrationsRunnerContainerName && len(override.Command) > 0 {
+				return override.Command
+			}
+		}
+	}
+
+	container, ok := findContainerDefinition(definition.ContainerDefinitions, MigrationsRunnerContainerName)
+	if !ok {
+		return nil
+	}
+
+	return container.Command
+}
+
+// Duration is how long the task ran for, or zero if it never started
+func (r TaskResult) Duration() time.Duration {
+	if r.StartedAt.IsZero() || r.StoppedAt.IsZero() {
+		return 0
+	}
+
+	return r.StoppedAt.Sub(r.StartedAt)
+}
+
+// TaskConsoleURL links to the task in the ECS console, or is empty if the task ARN is not known
+func TaskConsoleURL(taskArn string) string {
+	region := RegionFromArn(taskArn)
+	if region == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("https://%s.console.aws.amazon.com/ecs/v2/clusters/%s/tasks/%s?region=%s", region, ClusterFromTaskArn(taskArn), TaskIDFromArn(taskArn), region)
+}
+
+// RegionFromArn returns the region of an ARN, or an empty string if it is not an ARN
+func RegionFromArn(value string) string {
+	parsed, err := arn.Parse(value)
+	if err != nil {
+		return ""
+	}
+
+	return parsed.Region
+}
+
+// Runner returns the result of the container that ran the migrations
+func (r TaskResult) Runner() (ContainerResult, bool) {
+	for _, container := range r.Containers {
+		if container.Name == MigrationsRunnerContainerName {
+			return container, true
+		}
+	}
+
+	return ContainerResult{}, false
+}
+
+// Err returns an error describing why the task failed, or nil if the migrations ran successfully. The task fails
+// if the migrations-runner container did not exit cleanly, or if any other essential container exited non-zero.
+func (r TaskResult) Err() error {
+	runner, ok := r.Runner()
+	if !ok {
+		return fmt.Errorf("task has no %s container: %s", MigrationsRunnerContainerName, r.StoppedReason)
+	}
+
+	if runner.ExitCode == nil {
+		if isCapacityReason(r.StoppedReason) {
+			return &CapacityUnavailableError{Reason: r.StoppedReason}
+		}
+
+		return &TaskFailedToStartError{TaskArn: r.TaskArn, Reason: r.StoppedReason}
+	}
+
+	if *runner.ExitCode != 0 {
+		return &NonZeroExitError{Container: runner.Name, ExitCode: *runner.ExitCode}
+	}
+
+	for _, container := range r.Containers {
+		if container.Essential && container.ExitCode != nil && *container.ExitCode != 0 {
+			return &NonZeroExitError{Container: container.Name, ExitCode: *container.ExitCode}
+		}
+	}
+
+	return nil
+}
+
+func findContainerDefinition(definitions []types.ContainerDefinition, name string) (types.ContainerDefinition, bool) {
+	for _, definition := range definitions {
+		if aws.ToString(definition.Name) == name {
+			return definition, true
+		}
+	}
+
+	return types.ContainerDefinition{}, false
+}
@@ -3,10 +3,15 @@ package aws
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	"github.com/stretchr/testify/assert"
@@ -17,6 +22,8 @@ type mockECSClient struct {
 	mockRunTask                func(ctx context.Context, params *ecs.RunTaskInput, optFns ...func(*ecs.Options)) (*ecs.RunTaskOutput, error)
 	mockDescribeTasks          func(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error)
 	mockDescribeTaskDefinition func(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error)
+	mockStopTask               func(ctx context.Context, params *ecs.StopTaskInput, optFns ...func(*ecs.Options)) (*ecs.StopTaskOutput, error)
+	mockDescribeClusters       func(ctx context.Context, params *ecs.DescribeClustersInput, optFns ...func(*ecs.Options)) (*ecs.DescribeClustersOutput, error)
 }
 
 type mockECSWaiter struct {
@@ -35,6 +42,14 @@ func (m mockECSClient) DescribeTaskDefinition(ctx context.Context, params *ecs.D
 	return m.mockDescribeTaskDefinition(ctx, params, optFns...)
 }
 
+func (m mockECSClient) StopTask(ctx context.Context, params *ecs.StopTaskInput, optFns ...func(*ecs.Options)) (*ecs.StopTaskOutput, error) {
+	return m.mockStopTask(ctx, params, optFns...)
+}
+
+func (m mockECSClient) DescribeClusters(ctx context.Context, params *ecs.DescribeClustersInput, optFns ...func(*ecs.Options)) (*ecs.DescribeClustersOutput, error) {
+	return m.mockDescribeClusters(ctx, params, optFns...)
+}
+
 func (m mockECSWaiter) WaitForOutput(ctx context.Context, params *ecs.DescribeTasksInput, maxWaitDur time.Duration, optFns ...func(*ecs.TasksStoppedWaiterOptions)) (*ecs.DescribeTasksOutput, error) {
 	return m.mockWaitForOutput(ctx, params, maxWaitDur, optFns...)
 }
@@ -95,7 +110,7 @@ func TestSubmitTask(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			result, err := SubmitTask(context.TODO(), tc.client, tc.input)
+			result, _, err := SubmitTask(context.TODO(), tc.client, tc.input)
 
 			t.Logf("result: %v", result)
 			t.Logf("expected: %v", tc.expected)
@@ -105,6 +120,283 @@ func TestSubmitTask(t *testing.T) {
 	}
 }
 
+func TestSubmitTaskWithClientToken(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"
+
+	taskConfig := TaskRunnerConfiguration{
+		Cluster:           "test-cluster",
+		SubnetIds:         []string{"subnet-123456"},
+		TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task-1",
+		ClientToken:       "0123456789abcdef",
+	}
+
+	client := mockECSClient{
+		mockRunTask: func(ctx context.Context, params *ecs.RunTaskInput, optFns ...func(*ecs.Options)) (*ecs.RunTaskOutput, error) {
+			assert.Equal(t, aws.String("0123456789abcdef"), params.ClientToken)
+
+			return &ecs.RunTaskOutput{Tasks: []types.Task{{TaskArn: aws.String(taskArn)}}}, nil
+		},
+	}
+
+	result, repeated, err := SubmitTask(context.TODO(), client, &taskConfig)
+
+	require.NoError(t, err)
+	assert.Equal(t, taskArn, result)
+	assert.False(t, repeated)
+}
+
+// sequenceHTTPClient answers each request with the next of its status codes, repeating the last one. Successful
+// requests are answered with the body.
+type sequenceHTTPClient struct {
+	statuses []int
+	body     string
+	requests int
+}
+
+func (c *sequenceHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	status := c.statuses[min(c.requests, len(c.statuses)-1)]
+	c.requests++
+
+	body := c.body
+	if status != http.StatusOK {
+		body = `{"__type": "ServerException", "message": "internal error"}`
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/x-amz-json-1.1"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// ecsClientOver is an ECS client sending its requests to the HTTP client, retrying them without waiting
+func ecsClientOver(httpClient ecs.HTTPClient) *ecs.Client {
+	return ecs.New(ecs.Options{
+		Region:      "us-west-2",
+		Credentials: aws.AnonymousCredentials{},
+		HTTPClient:  httpClient,
+		Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+			o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+		}),
+	})
+}
+
+func TestSubmitTaskRepeatedBySDK(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"
+	body := fmt.Sprintf(`{"tasks": [{"taskArn": %q}], "failures": []}`, taskArn)
+
+	taskConfig := TaskRunnerConfiguration{
+		Cluster:           "test-cluster",
+		TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task-1",
+		ClientToken:       "0123456789abcdef",
+	}
+
+	t.Run("given the SDK repeated the request, it should report the task as returned to a repeated request", func(t *testing.T) {
+		httpClient := &sequenceHTTPClient{statuses: []int{http.StatusInternalServerError, http.StatusOK}, body: body}
+
+		result, repeated, err := SubmitTask(context.TODO(), ecsClientOver(httpClient), &taskConfig)
+
+		require.NoError(t, err)
+		assert.Equal(t, 2, httpClient.requests)
+		assert.Equal(t, taskArn, result)
+		assert.True(t, repeated)
+	})
+
+	t.Run("given a single request, it should not report the task as returned to a repeated request", func(t *testing.T) {
+		httpClient := &sequenceHTTPClient{statuses: []int{http.StatusOK}, body: body}
+
+		result, repeated, err := SubmitTask(context.TODO(), ecsClientOver(httpClient), &taskConfig)
+
+		require.NoError(t, err)
+		assert.Equal(t, taskArn, result)
+		assert.False(t, repeated)
+	})
+
+	t.Run("given no client token, it should not report the task as returned to a repeated request", func(t *testing.T) {
+		httpClient := &sequenceHTTPClient{statuses: []int{http.StatusInternalServerError, http.StatusOK}, body: body}
+		withoutToken := taskConfig
+		withoutToken.ClientToken = ""
+
+		_, repeated, err := SubmitTask(context.TODO(), ecsClientOver(httpClient), &withoutToken)
+
+		require.NoError(t, err)
+		assert.False(t, repeated)
+	})
+}
+
+func TestRunTaskInputForConfig(t *testing.T) {
+	base := func() *TaskRunnerConfiguration {
+		return &TaskRunnerConfiguration{
+			Cluster:           "test-cluster",
+			SecurityGroupIds:  []string{"sg-123456"},
+			SubnetIds:         []string{"subnet-123456"},
+			TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task-1",
+		}
+	}
+
+	t.Run("given no launch options, it should run on Fargate", func(t *testing.T) {
+		input := RunTaskInputForConfig(base())
+
+		assert.Equal(t, types.LaunchTypeFargate, input.LaunchType)
+		assert.Empty(t, input.CapacityProviderStrategy)
+		assert.Nil(t, input.PlatformVersion)
+		assert.Equal(t, types.AssignPublicIp(""), input.NetworkConfiguration.AwsvpcConfiguration.AssignPublicIp)
+	})
+
+	t.Run("given a capacity provider strategy, it should not set a launch type", func(t *testing.T) {
+		config := base()
+		config.CapacityProviderStrategy = []CapacityProviderStrategyItem{{CapacityProvider: "FARGATE_SPOT", Weight: 1, Base: 1}}
+		config.PlatformVersion = "1.4.0"
+		config.AssignPublicIp = true
+
+		input := RunTaskInputForConfig(config)
+
+		assert.Equal(t, types.LaunchType(""), input.LaunchType)
+		assert.Equal(t, []types.CapacityProviderStrategyItem{{CapacityProvider: aws.String("FARGATE_SPOT"), Weight: 1, Base: 1}}, input.CapacityProviderStrategy)
+		assert.Equal(t, aws.String("1.4.0"), input.PlatformVersion)
+		assert.Equal(t, types.AssignPublicIpEnabled, input.NetworkConfiguration.AwsvpcConfiguration.AssignPublicIp)
+	})
+
+	t.Run("given no subnets, it should not give a network configuration", func(t *testing.T) {
+		config := base()
+		config.LaunchType = "EC2"
+		config.SubnetIds = nil
+		config.SecurityGroupIds = nil
+
+		input := RunTaskInputForConfig(config)
+
+		assert.Nil(t, input.NetworkConfiguration)
+	})
+
+	t.Run("given the EC2 launch type with placement, it should include the placement", func(t *testing.T) {
+		config := base()
+		config.LaunchType = "EC2"
+		config.PlacementConstraints = []PlacementConstraint{{Type: "distinctInstance"}, {Type: "memberOf", Expression: "attribute:ecs.availability-zone == us-west-2a"}}
+		config.PlacementStrategy = []PlacementStrategy{{Type: "random"}, {Type: "binpack", Field: "memory"}}
+
+		input := RunTaskInputForConfig(config)
+
+		assert.Equal(t, types.LaunchTypeEc2, input.LaunchType)
+		assert.Equal(t, []types.PlacementConstraint{
+			{Type: types.PlacementConstraintTypeDistinctInstance},
+			{Type: types.PlacementConstraintTypeMemberOf, Expression: aws.String("attribute:ecs.availability-zone == us-west-2a")},
+		}, input.PlacementConstraints)
+		assert.Equal(t, []types.PlacementStrategy{
+			{Type: types.PlacementStrategyTypeRandom},
+			{Type: types.PlacementStrategyTypeBinpack, Field: aws.String("memory")},
+		}, input.PlacementStrategy)
+	})
+}
+
+func TestRunTaskInputForConfigResources(t *testing.T) {
+	config := &TaskRunnerConfiguration{
+		Cluster:           "test-cluster",
+		SubnetIds:         []string{"subnet-123456"},
+		TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task-1",
+		Cpu:               "2048",
+		Memory:            "8 GB",
+		EphemeralStorage:  50,
+		TaskRoleArn:       "arn:aws:iam::123456789012:role/backfill",
+		ExecutionRoleArn:  "arn:aws:iam::123456789012:role/backfill-execution",
+		ContainerCpu:      1024,
+		ContainerMemory:   6144,
+	}
+
+	input := RunTaskInputForConfig(config)
+
+	assert.Equal(t, aws.String("2048"), input.Overrides.Cpu)
+	assert.Equal(t, aws.String("8 GB"), input.Overrides.Memory)
+	assert.Equal(t, &types.EphemeralStorage{SizeInGiB: 50}, input.Overrides.EphemeralStorage)
+	assert.Equal(t, aws.String("arn:aws:iam::123456789012:role/backfill"), input.Overrides.TaskRoleArn)
+	assert.Equal(t, aws.String("arn:aws:iam::123456789012:role/backfill-execution"), input.Overrides.ExecutionRoleArn)
+
+	require.Len(t, input.Overrides.ContainerOverrides, 1)
+	assert.Equal(t, aws.Int32(1024), input.Overrides.ContainerOverrides[0].Cpu)
+	assert.Equal(t, aws.Int32(6144), input.Overrides.ContainerOverrides[0].Memory)
+}
+
+func TestStopTask(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"
+
+	t.Run("given a task ARN, it should stop the task in its cluster with the reason", func(t *testing.T) {
+		var input *ecs.StopTaskInput
+
+		client := mockECSClient{
+			mockStopTask: func(ctx context.Context, params *ecs.StopTaskInput, optFns ...func(*ecs.Options)) (*ecs.StopTaskOutput, error) {
+				input = params
+				return &ecs.StopTaskOutput{}, nil
+			},
+		}
+
+		err := StopTask(context.TODO(), client, taskArn, "buildkite job was cancelled")
+		require.NoError(t, err)
+		assert.Equal(t, "test-cluster", *input.Cluster)
+		assert.Equal(t, taskArn, *input.Task)
+		assert.Equal(t, "buildkite job was cancelled", *input.Reason)
+	})
+
+	t.Run("when the ECS client experiences an error, it should return it", func(t *testing.T) {
+		client := mockECSClient{
+			mockStopTask: func(ctx context.Context, params *ecs.StopTaskInput, optFns ...func(*ecs.Options)) (*ecs.StopTaskOutput, error) {
+				return nil, errors.New("task is already stopped")
+			},
+		}
+
+		err := StopTask(context.TODO(), client, taskArn, "buildkite job was cancelled")
+		require.EqualError(t, err, "task is already stopped")
+	})
+}
+
+func TestDescribeTask(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"
+
+	t.Run("given a task that exists, it should describe it in its cluster", func(t *testing.T) {
+		var input *ecs.DescribeTasksInput
+
+		client := mockECSClient{
+			mockDescribeTasks: func(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+				input = params
+				return &ecs.DescribeTasksOutput{
+					Tasks: []types.Task{{TaskArn: aws.String(taskArn), LastStatus: aws.String("RUNNING")}},
+				}, nil
+			},
+		}
+
+		task, found, err := DescribeTask(context.TODO(), client, taskArn)
+		require.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, "RUNNING", *task.LastStatus)
+		assert.Equal(t, "test-cluster", *input.Cluster)
+		assert.Equal(t, []string{taskArn}, input.Tasks)
+	})
+
+	t.Run("given a task ECS no longer knows about, it should report it as not found", func(t *testing.T) {
+		client := mockECSClient{
+			mockDescribeTasks: func(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+				return &ecs.DescribeTasksOutput{
+					Failures: []types.Failure{{Arn: aws.String(taskArn), Reason: aws.String("MISSING")}},
+				}, nil
+			},
+		}
+
+		_, found, err := DescribeTask(context.TODO(), client, taskArn)
+		require.NoError(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("when the ECS client experiences an error, it should return it", func(t *testing.T) {
+		client := mockECSClient{
+			mockDescribeTasks: func(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+				return nil, errors.New("Unable to describe task.")
+			},
+		}
+
+		_, _, err := DescribeTask(context.TODO(), client, taskArn)
+		require.EqualError(t, err, "Unable to describe task.")
+	})
+}
+
 func TestContainerOverrideForConfig(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -143,6 +435,30 @@ func TestContainerOverrideForConfig(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "when given config with environment variables and secrets, it should return a ContainerOverride with a sorted Environment",
+			input: &TaskRunnerConfiguration{
+				Cluster:           "test-cluster",
+				Command:           []string{"bin/migrate"},
+				Environment:       map[string]string{"MIGRATION_TARGET_VERSION": "42", "DRY_RUN": "true"},
+				Secrets:           map[string]string{"DATABASE_PASSWORD": "arn:aws:ssm:us-west-2:123456789012:parameter/cool-service/database-password"},
+				SecretValues:      map[string]string{"DATABASE_PASSWORD": "hunter2"},
+				SecurityGroupIds:  []string{"sg-123456"},
+				SubnetIds:         []string{"subnet-123456"},
+				TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task-1",
+			},
+			expected: []types.ContainerOverride{
+				{
+					Name:    aws.String("migrations-runner"),
+					Command: []string{"bin/migrate"},
+					Environment: []types.KeyValuePair{
+						{Name: aws.String("DATABASE_PASSWORD"), Value: aws.String("hunter2")},
+						{Name: aws.String("DRY_RUN"), Value: aws.String("true")},
+						{Name: aws.String("MIGRATION_TARGET_VERSION"), Value: aws.String("42")},
+					},
+				},
+			},
+		},
 		{
 			name: "when given config without a command, it should return a ContainerOverride with just the Name",
 			input: &TaskRunnerConfiguration{
@@ -171,6 +487,16 @@ func TestContainerOverrideForConfig(t *testing.T) {
 	}
 }
 
+func TestConsoleURLs(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"
+
+	assert.Equal(t, "https://us-west-2.console.aws.amazon.com/ecs/v2/clusters/test-cluster/tasks/07cc583696bd44e0be450bff7314ddaf?region=us-west-2", TaskConsoleURL(taskArn))
+	assert.Empty(t, TaskConsoleURL(""))
+
+	logs := LogDetails{logGroupName: "/ecs/cool-service", logStreamName: "migrations/migrations-runner/07cc583696bd44e0be450bff7314ddaf"}
+	assert.Equal(t, "https://us-west-2.console.aws.amazon.com/cloudwatch/home?region=us-west-2#logsV2:log-groups/log-group/$252Fecs$252Fcool-service/log-events/migrations$252Fmigrations-runner$252F07cc583696bd44e0be450bff7314ddaf", logs.ConsoleURL("us-west-2"))
+}
+
 func TestClusterFromTaskArn(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -245,18 +571,21 @@ func TestFindLogStreamFromTaskPositive(t *testing.T) {
 		TaskDefinitionArn: aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/test-task-1"),
 	}
 
-	taskDefinitionOutput := &ecs.DescribeTaskDefinitionOutput{
-		TaskDefinition: &types.TaskDefinition{
-			ContainerDefinitions: []types.ContainerDefinition{
-				{
-					Name: aws.String("test-container"),
-					LogConfiguration: &types.LogConfiguration{
-						Options: map[string]string{
-							"awslogs-group":         "test-group",
-							"awslogs-stream-prefix": "test-stream",
-						},
-					},
-				},
+	runnerContainer := types.ContainerDefinition{
+		Name: aws.String("migrations-runner"),
+		LogConfiguration: &types.LogConfiguration{
+			Options: map[string]string{
+				"awslogs-group":         "test-group",
+				"awslogs-stream-prefix": "test-stream",
+			},
+		},
+	}
+	sidecarContainer := types.ContainerDefinition{
+		Name: aws.String("datadog-agent"),
+		LogConfiguration: &types.LogConfiguration{
+			Options: map[string]string{
+				"awslogs-group":         "sidecar-group",
+				"awslogs-stream-prefix": "sidecar-stream",
 			},
 		},
 	}
@@ -272,12 +601,33 @@ func TestFindLogStreamFromTaskPositive(t *testing.T) {
 			input: task,
 			client: mockECSClient{
 				mockDescribeTaskDefinition: func(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
-					return taskDefinitionOutput, nil
+					return &ecs.DescribeTaskDefinitionOutput{
+						TaskDefinition: &types.TaskDefinition{
+							ContainerDefinitions: []types.ContainerDefinition{runnerContainer},
+						},
+					}, nil
 				},
 			},
 			expected: LogDetails{
 				logGroupName:  "test-group",
-				logStreamName: "test-stream/test-container/07cc583696bd44e0be450bff7314ddaf",
+				logStreamName: "test-stream/migrations-runner/07cc583696bd44e0be450bff7314ddaf",
+			},
+		},
+		{
+			name:  "given a task with a sidecar defined first, it uses the migrations-runner container",
+			input: task,
+			client: mockECSClient{
+				mockDescribeTaskDefinition: func(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+					return &ecs.DescribeTaskDefinitionOutput{
+						TaskDefinition: &types.TaskDefinition{
+							ContainerDefinitions: []types.ContainerDefinition{sidecarContainer, runnerContainer},
+						},
+					}, nil
+				},
+			},
+			expected: LogDetails{
+				logGroupName:  "test-group",
+				logStreamName: "test-stream/migrations-runner/07cc583696bd44e0be450bff7314ddaf",
 			},
 		},
 	}
@@ -320,6 +670,30 @@ func TestFindLogStreamFromTaskNegative(t *testing.T) {
 			},
 			expected: LogDetails{},
 		},
+		{
+			name:  "when there is no migrations-runner container, it should return an error indicating the container is missing",
+			input: task,
+			client: mockECSClient{
+				mockDescribeTaskDefinition: func(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+					return &ecs.DescribeTaskDefinitionOutput{
+						TaskDefinition: &types.TaskDefinition{
+							ContainerDefinitions: []types.ContainerDefinition{
+								{
+									Name: aws.String("datadog-agent"),
+									LogConfiguration: &types.LogConfiguration{
+										Options: map[string]string{
+											"awslogs-group":         "test-group",
+											"awslogs-stream-prefix": "test-stream",
+										},
+									},
+								},
+							},
+						},
+					}, nil
+				},
+			},
+			expected: LogDetails{},
+		},
 		{
 			name:  "when logGroupName is empty, it should return an error indicating the logging configuration is incomplete",
 			input: task,
@@ -329,7 +703,7 @@ func TestFindLogStreamFromTaskNegative(t *testing.T) {
 						TaskDefinition: &types.TaskDefinition{
 							ContainerDefinitions: []types.ContainerDefinition{
 								{
-									Name: aws.String("test-container"),
+									Name: aws.String("migrations-runner"),
 									LogConfiguration: &types.LogConfiguration{
 										Options: map[string]string{
 											"awslogs-group":         "",
@@ -353,7 +727,7 @@ func TestFindLogStreamFromTaskNegative(t *testing.T) {
 						TaskDefinition: &types.TaskDefinition{
 							ContainerDefinitions: []types.ContainerDefinition{
 								{
-									Name: aws.String("test-container"),
+									Name: aws.String("migrations-runner"),
 									LogConfiguration: &types.LogConfiguration{
 										Options: map[string]string{
 											"awslogs-group":         "test-group",
@@ -455,3 +829,144 @@ func TestWaitForCompletion(t *testing.T) {
 		})
 	}
 }
+
+func TestDescribeTaskResult(t *testing.T) {
+	startedAt := time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+
+	task := types.Task{
+		TaskArn:           aws.String("arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"),
+		TaskDefinitionArn: aws.String("arn:aws:ecs:us-west-2:123456789012:task-definition/test-task-1"),
+		StoppedReason:     aws.String("Essential container in task exited"),
+		StopCode:          types.TaskStopCodeEssentialContainerExited,
+		StartedAt:         aws.Time(startedAt),
+		StoppedAt:         aws.Time(startedAt.Add(time.Minute)),
+		Overrides: &types.TaskOverride{ContainerOverrides: []types.ContainerOverride{
+			{Name: aws.String("migrations-runner"), Command: []string{"bin/rails", "db:migrate"}},
+		}},
+		Containers: []types.Container{
+			{Name: aws.String("datadog-agent"), ExitCode: aws.Int32(143), Reason: aws.String("Terminated")},
+			{Name: aws.String("migrations-runner"), ExitCode: aws.Int32(0), Image: aws.String("cool-service:latest"), ImageDigest: aws.String("sha256:0123456789abcdef")},
+		},
+	}
+
+	client := mockECSClient{
+		mockDescribeTaskDefinition: func(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+			return &ecs.DescribeTaskDefinitionOutput{
+				TaskDefinition: &types.TaskDefinition{
+					ContainerDefinitions: []types.ContainerDefinition{
+						{Name: aws.String("datadog-agent"), Essential: aws.Bool(false)},
+						{Name: aws.String("migrations-runner")},
+					},
+				},
+			}, nil
+		},
+	}
+
+	result, err := DescribeTaskResult(context.TODO(), client, task)
+	require.NoError(t, err)
+	assert.Equal(t, TaskResult{
+		TaskArn:           "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf",
+		Cluster:           "test-cluster",
+		TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task-1",
+		StoppedReason:     "Essential container in task exited",
+		StopCode:          "EssentialContainerExited",
+		StartedAt:         startedAt,
+		StoppedAt:         startedAt.Add(time.Minute),
+		Command:           []string{"bin/rails", "db:migrate"},
+		Containers: []ContainerResult{
+			{Name: "datadog-agent", Essential: false, ExitCode: aws.Int32(143), Reason: "Terminated"},
+			{Name: "migrations-runner", Essential: true, ExitCode: aws.Int32(0), Image: "cool-service:latest", ImageDigest: "sha256:0123456789abcdef"},
+		},
+	}, result)
+	assert.Equal(t, time.Minute, result.Duration())
+}
+
+func TestTaskResultErr(t *testing.T) {
+	runner := func(exitCode *int32) ContainerResult {
+		return ContainerResult{Name: "migrations-runner", Essential: true, ExitCode: exitCode}
+	}
+
+	tests := []struct {
+		name        string
+		input       TaskResult
+		expectedErr string
+	}{
+		{
+			name:  "when the migrations-runner container exits cleanly, it should succeed",
+			input: TaskResult{Containers: []ContainerResult{runner(aws.Int32(0))}},
+		},
+		{
+			name: "when a non-essential sidecar exits non-zero, it should succeed",
+			input: TaskResult{Containers: []ContainerResult{
+				runner(aws.Int32(0)),
+				{Name: "datadog-agent", Essential: false, ExitCode: aws.Int32(143)},
+			}},
+		},
+		{
+			name:        "when the migrations-runner container exits non-zero, it should fail",
+			input:       TaskResult{Containers: []ContainerResult{runner(aws.Int32(1))}},
+			expectedErr: "task stopped with a non-zero exit code: 1",
+		},
+		{
+			name:        "when the migrations-runner container has no exit code, it should fail rather than panic",
+			input:       TaskResult{StoppedReason: "CannotPullContainerError", Containers: []ContainerResult{runner(nil)}},
+			expectedErr: "task failed to start: CannotPullContainerError",
+		},
+		{
+			name: "when an essential sidecar exits non-zero, it should fail",
+			input: TaskResult{Containers: []ContainerResult{
+				{Name: "envoy", Essential: true, ExitCode: aws.Int32(2)},
+				runner(aws.Int32(0)),
+			}},
+			expectedErr: "essential container envoy stopped with a non-zero exit code: 2",
+		},
+		{
+			name:        "when there is no migrations-runner container, it should fail",
+			input:       TaskResult{StoppedReason: "Task stopped by user", Containers: []ContainerResult{{Name: "gateway", ExitCode: aws.Int32(0)}}},
+			expectedErr: "task has no migrations-runner container: Task stopped by user",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.input.Err()
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
+
+func TestWaitForCompletionTimeout(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"
+
+	// waits until the context is done, as the stopped-waiter does when the task never stops
+	neverStops := mockECSWaiter{
+		mockWaitForOutput: func(ctx context.Context, params *ecs.DescribeTasksInput, maxWaitDur time.Duration, optFns ...func(*ecs.TasksStoppedWaiterOptions)) (*ecs.DescribeTasksOutput, error) {
+			<-ctx.Done()
+			return nil, fmt.Errorf("request cancelled while waiting, %w", ctx.Err())
+		},
+	}
+
+	t.Run("given a task that does not stop in time, it should return a TimeoutError", func(t *testing.T) {
+		_, err := WaitForCompletion(context.TODO(), neverStops, taskArn, 0)
+
+		var timeoutErr *TimeoutError
+		require.ErrorAs(t, err, &timeoutErr)
+		assert.Equal(t, taskArn, timeoutErr.TaskArn)
+	})
+
+	t.Run("when the parent context is cancelled, it should not return a TimeoutError", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.TODO())
+		cancel()
+
+		_, err := WaitForCompletion(ctx, neverStops, taskArn, 15)
+
+		var timeoutErr *TimeoutError
+		require.Error(t, err)
+		assert.NotErrorAs(t, err, &timeoutErr)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
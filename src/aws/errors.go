@@ -0,0 +1,156 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// TimeoutError is returned when a task does not stop within the time allowed
+type TimeoutError struct {
+	TaskArn string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("task %s did not stop within %s", e.TaskArn, e.Timeout)
+}
+
+// TaskFailedToStartError is returned when a task stops before the migrations-runner container runs, e.g. because its
+// image could not be pulled or its secrets could not be retrieved
+type TaskFailedToStartError struct {
+	TaskArn string
+	Reason  string
+}
+
+func (e *TaskFailedToStartError) Error() string {
+	return fmt.Sprintf("task failed to start: %s", e.Reason)
+}
+
+// StuckPendingError is returned when a task does not start running within the time allowed, e.g. because its image
+// is slow to pull or the cluster is waiting on capacity
+type StuckPendingError struct {
+	TaskArn        string
+	Status         string
+	PendingTimeout time.Duration
+}
+
+func (e *StuckPendingError) Error() string {
+	return fmt.Sprintf("task %s was still %s after %s", e.TaskArn, e.Status, e.PendingTimeout)
+}
+
+// NonZeroExitError is returned when a container in the task that must succeed exits with a non-zero code
+type NonZeroExitError struct {
+	Container string
+	ExitCode  int32
+}
+
+func (e *NonZeroExitError) Error() string {
+	if e.Container == MigrationsRunnerContainerName {
+		return fmt.Sprintf("task stopped with a non-zero exit code: %d", e.ExitCode)
+	}
+
+	return fmt.Sprintf("essential container %s stopped with a non-zero exit code: %d", e.Container, e.ExitCode)
+}
+
+// CapacityUnavailableError is returned when ECS does not have the capacity to place or start the task
+type CapacityUnavailableError struct {
+	Reason string
+}
+
+func (e *CapacityUnavailableError) Error() string {
+	return fmt.Sprintf("capacity is unavailable to run the task: %s", e.Reason)
+}
+
+// RunTaskFailedError is returned when ECS reports a failure to run the task that is not a lack of capacity, e.g. a
+// missing cluster or an invalid task definition
+type RunTaskFailedError struct {
+	Arn    string
+	Reason string
+	Detail string
+}
+
+func (e *RunTaskFailedError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("ecs:RunTask failed to start the task: %s", e.Reason)
+	}
+
+	return fmt.Sprintf("ecs:RunTask failed to start the task: %s (%s)", e.Reason, e.Detail)
+}
+
+// PermissionDeniedError is returned when the credentials in use are not allowed to perform an AWS operation
+type PermissionDeniedError struct {
+	Operation string
+	Err       error
+}
+
+func (e *PermissionDeniedError) Error() string {
+	return fmt.Sprintf("permission denied for %s: %v", e.Operation, e.Err)
+}
+
+func (e *PermissionDeniedError) Unwrap() error {
+	return e.Err
+}
+
+// permissionDeniedErrorCodes are the error codes AWS services use when a request is not authorized
+var permissionDeniedErrorCodes = []string{
+	"AccessDenied",
+	"AccessDeniedException",
+	"UnauthorizedOperation",
+	"UnrecognizedClientException",
+}
+
+// throttlingErrorCodes are the error codes AWS services use when a request is rate limited
+var throttlingErrorCodes = []string{
+	"ThrottlingException",
+	"Throttling",
+	"TooManyRequestsException",
+	"RequestLimitExceeded",
+}
+
+// classifyError wraps errors returned from AWS operations in a typed error where the cause is known
+func classifyError(operation string, err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		for _, code := range permissionDeniedErrorCodes {
+			if apiErr.ErrorCode() == code {
+				return &PermissionDeniedError{Operation: operation, Err: err}
+			}
+		}
+	}
+
+	return err
+}
+
+// isCapacityReason reports whether a failure or stopped reason from ECS indicates a lack of capacity
+func isCapacityReason(reason string) bool {
+	return strings.HasPrefix(reason, "RESOURCE:") || strings.Contains(strings.ToLower(reason), "capacity is unavailable")
+}
+
+// IsTransientRunTaskError reports whether a failure to run a task is likely to succeed if the task is run again: a
+// lack of capacity, including ENIs, or the request being throttled
+func IsTransientRunTaskError(err error) bool {
+	var capacityUnavailable *CapacityUnavailableError
+	if errors.As(err, &capacityUnavailable) {
+		return true
+	}
+
+	return isThrottlingError(err)
+}
+
+// isThrottlingError reports whether the request was rate limited, and can be made again after a delay
+func isThrottlingError(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		for _, code := range throttlingErrorCodes {
+			if apiErr.ErrorCode() == code {
+				return true
+			}
+		}
+	}
+
+	return false
+}
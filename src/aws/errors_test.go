@@ -0,0 +1,103 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name             string
+		input            error
+		permissionDenied bool
+	}{
+		{
+			name:             "given an AccessDeniedException, it should be classified as permission denied",
+			input:            &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized to perform ecs:RunTask"},
+			permissionDenied: true,
+		},
+		{
+			name:             "given an AccessDenied error, it should be classified as permission denied",
+			input:            &smithy.GenericAPIError{Code: "AccessDenied", Message: "not authorized"},
+			permissionDenied: true,
+		},
+		{
+			name:             "given any other API error, it should be returned unchanged",
+			input:            &smithy.GenericAPIError{Code: "ClusterNotFoundException", Message: "cluster not found"},
+			permissionDenied: false,
+		},
+		{
+			name:             "given an error that is not from an AWS API, it should be returned unchanged",
+			input:            errors.New("generic error"),
+			permissionDenied: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result := classifyError("ecs:RunTask", tc.input)
+
+			var permissionDenied *PermissionDeniedError
+			assert.Equal(t, tc.permissionDenied, errors.As(result, &permissionDenied))
+			assert.ErrorIs(t, result, tc.input)
+		})
+	}
+}
+
+func TestIsCapacityReason(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{input: "RESOURCE:ENI", expected: true},
+		{input: "RESOURCE:MEMORY", expected: true},
+		{input: "Capacity is unavailable at this time. Please try again later or in a different availability zone", expected: true},
+		{input: "CannotPullContainerError: pull image manifest has been retried 5 time(s)", expected: false},
+		{input: "MISSING", expected: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			assert.Equal(t, tc.expected, isCapacityReason(tc.input))
+		})
+	}
+}
+
+func TestIsTransientRunTaskError(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    error
+		expected bool
+	}{
+		{
+			name:     "given a lack of capacity, it should be transient",
+			input:    &CapacityUnavailableError{Reason: "RESOURCE:ENI"},
+			expected: true,
+		},
+		{
+			name:     "given a throttled request, it should be transient",
+			input:    fmt.Errorf("wrapped: %w", &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}),
+			expected: true,
+		},
+		{
+			name:     "given a failure to run the task, it should not be transient",
+			input:    &RunTaskFailedError{Reason: "MISSING"},
+			expected: false,
+		},
+		{
+			name:     "given a denied request, it should not be transient",
+			input:    &PermissionDeniedError{Operation: "ecs:RunTask", Err: &smithy.GenericAPIError{Code: "AccessDeniedException"}},
+			expected: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, IsTransientRunTaskError(tc.input))
+		})
+	}
+}
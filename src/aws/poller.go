@@ -0,0 +1,108 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+)
+
+// TaskTransition is a change in the last status of a task seen while polling it
+type TaskTransition struct {
+	TaskArn string
+	// From is empty for the first status seen
+	From string
+	To   string
+	At   time.Time
+}
+
+// TaskPoller waits for tasks to stop by describing them on a fixed interval, reporting each change in their status as
+// it is seen. It implements EcsWaiterAPI, so it can be used with WaitForCompletion in place of the ECS stopped-waiter.
+type TaskPoller struct {
+	API EcsClientAPI
+	// Interval is the time between each ecs:DescribeTasks request
+	Interval time.Duration
+	// PendingTimeout is how long a task can take to reach RUNNING before it is reported as stuck, regardless of how
+	// long the overall wait is allowed to take. Zero allows the task as long as the overall wait to start.
+	PendingTimeout time.Duration
+	// OnTransition is called for each change of status, if set
+	OnTransition func(TaskTransition)
+}
+
+// notStartedStatuses are the statuses a task passes through before its containers are running
+var notStartedStatuses = map[string]bool{
+	"PROVISIONING": true,
+	"PENDING":      true,
+	"ACTIVATING":   true,
+}
+
+// WaitForOutput polls the tasks until every one of them has stopped or cannot be found, returning the last
+// description of them. The waiter options are accepted to satisfy EcsWaiterAPI, and ignored.
+func (p *TaskPoller) WaitForOutput(ctx context.Context, params *ecs.DescribeTasksInput, maxWaitDur time.Duration, _ ...func(*ecs.TasksStoppedWaiterOptions)) (*ecs.DescribeTasksOutput, error) {
+	ctx, cancel := context.WithTimeout(ctx, maxWaitDur)
+	defer cancel()
+
+	// output is the last successful description of the tasks, returned if the wait ends before they stop
+	var output *ecs.DescribeTasksOutput
+
+	statuses := map[string]string{}
+	started := time.Now()
+
+	for {
+		described, err := p.API.DescribeTasks(ctx, params)
+
+		switch {
+		case err == nil:
+			output = described
+
+			stopped, stuckErr := p.observe(output, statuses, started)
+			if stopped || stuckErr != nil {
+				return output, stuckErr
+			}
+		// a throttled request is tried again at the next interval, like any other poll
+		case !IsTransientRunTaskError(err):
+			return output, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return output, fmt.Errorf("stopped waiting for task: %w", ctx.Err())
+		case <-time.After(p.Interval):
+		}
+	}
+}
+
+// observe records the status of each task, reporting any that changed, and returns whether every task has stopped.
+// Tasks ECS could not find are reported as failures in the output, so are treated as stopped.
+func (p *TaskPoller) observe(output *ecs.DescribeTasksOutput, statuses map[string]string, started time.Time) (bool, error) {
+	if len(output.Failures) > 0 {
+		return true, nil
+	}
+
+	stopped := true
+
+	for _, task := range output.Tasks {
+		taskArn := aws.ToString(task.TaskArn)
+		status := aws.ToString(task.LastStatus)
+
+		if status != statuses[taskArn] {
+			if p.OnTransition != nil {
+				p.OnTransition(TaskTransition{TaskArn: taskArn, From: statuses[taskArn], To: status, At: time.Now()})
+			}
+
+			statuses[taskArn] = status
+		}
+
+		if status != "STOPPED" {
+			stopped = false
+		}
+
+		if p.PendingTimeout > 0 && notStartedStatuses[status] && time.Since(started) > p.PendingTimeout {
+			return false, &StuckPendingError{TaskArn: taskArn, Status: status, PendingTimeout: p.PendingTimeout}
+		}
+	}
+
+	return stopped, nil
+}
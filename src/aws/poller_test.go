@@ -0,0 +1,139 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskPoller(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"
+
+	withStatus := func(status string) *ecs.DescribeTasksOutput {
+		return &ecs.DescribeTasksOutput{Tasks: []types.Task{{TaskArn: aws.String(taskArn), LastStatus: aws.String(status)}}}
+	}
+
+	// describes the task with each of the given responses in turn, repeating the last one
+	sequence := func(responses ...any) EcsClientAPI {
+		calls := 0
+
+		return mockECSClient{
+			mockDescribeTasks: func(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+				response := responses[min(calls, len(responses)-1)]
+				calls++
+
+				if err, ok := response.(error); ok {
+					return nil, err
+				}
+
+				return response.(*ecs.DescribeTasksOutput), nil
+			},
+		}
+	}
+
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+
+	tests := []struct {
+		name                string
+		client              EcsClientAPI
+		pendingTimeout      time.Duration
+		maxWait             time.Duration
+		expectedTransitions []string
+		expectedStatus      string
+		expectedErr         error
+	}{
+		{
+			name:                "given a task that runs and stops, it should report each transition once",
+			client:              sequence(withStatus("PROVISIONING"), withStatus("PENDING"), withStatus("PENDING"), withStatus("RUNNING"), throttled, withStatus("STOPPING"), withStatus("STOPPED")),
+			maxWait:             time.Minute,
+			expectedTransitions: []string{"→PROVISIONING", "PROVISIONING→PENDING", "PENDING→RUNNING", "RUNNING→STOPPING", "STOPPING→STOPPED"},
+			expectedStatus:      "STOPPED",
+		},
+		{
+			name:                "given a task that stays pending, it should report it as stuck",
+			client:              sequence(withStatus("PENDING")),
+			pendingTimeout:      20 * time.Millisecond,
+			maxWait:             time.Minute,
+			expectedTransitions: []string{"→PENDING"},
+			expectedStatus:      "PENDING",
+			expectedErr:         &StuckPendingError{TaskArn: taskArn, Status: "PENDING", PendingTimeout: 20 * time.Millisecond},
+		},
+		{
+			name:                "given a task that keeps running, it should stop waiting at the deadline with the last status",
+			client:              sequence(withStatus("RUNNING")),
+			pendingTimeout:      20 * time.Millisecond,
+			maxWait:             50 * time.Millisecond,
+			expectedTransitions: []string{"→RUNNING"},
+			expectedStatus:      "RUNNING",
+			expectedErr:         context.DeadlineExceeded,
+		},
+		{
+			name:           "given an error describing the task, it should return it",
+			client:         sequence(withStatus("RUNNING"), errors.New("cluster not found")),
+			maxWait:        time.Minute,
+			expectedStatus: "RUNNING",
+			expectedErr:    errors.New("cluster not found"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var transitions []string
+
+			poller := &TaskPoller{
+				API:            tc.client,
+				Interval:       time.Millisecond,
+				PendingTimeout: tc.pendingTimeout,
+				OnTransition: func(transition TaskTransition) {
+					assert.Equal(t, taskArn, transition.TaskArn)
+					transitions = append(transitions, transition.From+"→"+transition.To)
+				},
+			}
+
+			output, err := poller.WaitForOutput(context.TODO(), &ecs.DescribeTasksInput{Tasks: []string{taskArn}}, tc.maxWait)
+
+			switch expected := tc.expectedErr; {
+			case expected == nil:
+				require.NoError(t, err)
+			case errors.Is(expected, context.DeadlineExceeded):
+				require.ErrorIs(t, err, context.DeadlineExceeded)
+			default:
+				require.EqualError(t, err, expected.Error())
+			}
+
+			if tc.expectedTransitions != nil {
+				assert.Equal(t, tc.expectedTransitions, transitions)
+			}
+
+			require.NotNil(t, output)
+			assert.Equal(t, tc.expectedStatus, aws.ToString(output.Tasks[0].LastStatus))
+		})
+	}
+
+	t.Run("given a task that cannot be found, it should return the failure", func(t *testing.T) {
+		missing := &ecs.DescribeTasksOutput{Failures: []types.Failure{{Arn: aws.String(taskArn), Reason: aws.String("MISSING")}}}
+		poller := &TaskPoller{API: sequence(missing), Interval: time.Millisecond}
+
+		output, err := poller.WaitForOutput(context.TODO(), &ecs.DescribeTasksInput{Tasks: []string{taskArn}}, time.Minute)
+
+		require.NoError(t, err)
+		assert.Equal(t, missing, output)
+	})
+
+	t.Run("given a task that times out, it should be returned by WaitForCompletion as a TimeoutError", func(t *testing.T) {
+		poller := &TaskPoller{API: sequence(withStatus("RUNNING")), Interval: time.Millisecond}
+
+		_, err := WaitForCompletion(context.TODO(), poller, taskArn, 0)
+
+		var timeoutErr *TimeoutError
+		require.ErrorAs(t, err, &timeoutErr)
+	})
+}
@@ -0,0 +1,284 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+)
+
+// RDSAPI is the subset of the RDS client used to snapshot databases before migrations are run
+type RDSAPI interface {
+	CreateDBSnapshot(ctx context.Context, params *rds.CreateDBSnapshotInput, optFns ...func(*rds.Options)) (*rds.CreateDBSnapshotOutput, error)
+	DescribeDBSnapshots(ctx context.Context, params *rds.DescribeDBSnapshotsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBSnapshotsOutput, error)
+	DeleteDBSnapshot(ctx context.Context, params *rds.DeleteDBSnapshotInput, optFns ...func(*rds.Options)) (*rds.DeleteDBSnapshotOutput, error)
+	CreateDBClusterSnapshot(ctx context.Context, params *rds.CreateDBClusterSnapshotInput, optFns ...func(*rds.Options)) (*rds.CreateDBClusterSnapshotOutput, error)
+	DescribeDBClusterSnapshots(ctx context.Context, params *rds.DescribeDBClusterSnapshotsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBClusterSnapshotsOutput, error)
+	DeleteDBClusterSnapshot(ctx context.Context, params *rds.DeleteDBClusterSnapshotInput, optFns ...func(*rds.Options)) (*rds.DeleteDBClusterSnapshotOutput, error)
+}
+
+// Snapshots taken by the plugin are tagged, so that only they are ever pruned
+const (
+	snapshotCreatedByTag   = "created-by"
+	snapshotCreatedByValue = "migrations-runner-buildkite-plugin"
+	snapshotBuildURLTag    = "buildkite-build-url"
+)
+
+const (
+	snapshotAvailableStatus = "available"
+	manualSnapshotType      = "manual"
+)
+
+// failedSnapshotStatuses are the statuses of a snapshot that will never become available
+var failedSnapshotStatuses = []string{"failed", "error", "deleting", "deleted"}
+
+// SnapshotTarget is the database to snapshot, either a DB instance or an Aurora DB cluster
+type SnapshotTarget struct {
+	DBInstanceIdentifier string
+	DBClusterIdentifier  string
+}
+
+// Identifier is the identifier of the DB instance or cluster
+func (t SnapshotTarget) Identifier() string {
+	if t.DBClusterIdentifier != "" {
+		return t.DBClusterIdentifier
+	}
+
+	return t.DBInstanceIdentifier
+}
+
+// Snapshot is a manual snapshot of a DB instance or cluster
+type Snapshot struct {
+	ID              string
+	Status          string
+	PercentProgress int32
+	// CreatedAt is zero until the snapshot has started
+	CreatedAt time.Time
+	// CreatedByPlugin is set for snapshots tagged as taken by the plugin
+	CreatedByPlugin bool
+}
+
+// Available is whether the snapshot has been created and can be restored from
+func (s Snapshot) Available() bool {
+	return s.Status == snapshotAvailableStatus
+}
+
+// CreateSnapshot starts a snapshot of the database, tagged as taken by the plugin for the build. It does not wait for
+// the snapshot to become available.
+func CreateSnapshot(ctx context.Context, api RDSAPI, target SnapshotTarget, snapshotID string, buildURL string) error {
+	tags := []types.Tag{{Key: aws.String(snapshotCreatedByTag), Value: aws.String(snapshotCreatedByValue)}}
+	if buildURL != "" {
+		tags = append(tags, types.Tag{Key: aws.String(snapshotBuildURLTag), Value: aws.String(buildURL)})
+	}
+
+	if target.DBClusterIdentifier != "" {
+		_, err := api.CreateDBClusterSnapshot(ctx, &rds.CreateDBClusterSnapshotInput{
+			DBClusterIdentifier:         aws.String(target.DBClusterIdentifier),
+			DBClusterSnapshotIdentifier: aws.String(snapshotID),
+			Tags:                        tags,
+		})
+
+		return classifyError("rds:CreateDBClusterSnapshot", err)
+	}
+
+	_, err := api.CreateDBSnapshot(ctx, &rds.CreateDBSnapshotInput{
+		DBInstanceIdentifier: aws.String(target.DBInstanceIdentifier),
+		DBSnapshotIdentifier: aws.String(snapshotID),
+		Tags:                 tags,
+	})
+
+	return classifyError("rds:CreateDBSnapshot", err)
+}
+
+// DescribeSnapshot returns the snapshot of the database with the ID
+func DescribeSnapshot(ctx context.Context, api RDSAPI, target SnapshotTarget, snapshotID string) (Snapshot, error) {
+	var snapshots []Snapshot
+
+	if target.DBClusterIdentifier != "" {
+		response, err := api.DescribeDBClusterSnapshots(ctx, &rds.DescribeDBClusterSnapshotsInput{
+			DBClusterSnapshotIdentifier: aws.String(snapshotID),
+		})
+		if err != nil {
+			return Snapshot{}, classifyError("rds:DescribeDBClusterSnapshots", err)
+		}
+
+		snapshots = clusterSnapshots(response.DBClusterSnapshots)
+	} else {
+		response, err := api.DescribeDBSnapshots(ctx, &rds.DescribeDBSnapshotsInput{
+			DBSnapshotIdentifier: aws.String(snapshotID),
+		})
+		if err != nil {
+			return Snapshot{}, classifyError("rds:DescribeDBSnapshots", err)
+		}
+
+		snapshots = instanceSnapshots(response.DBSnapshots)
+	}
+
+	if len(snapshots) == 0 {
+		return Snapshot{}, fmt.Errorf("snapshot %s of %s not found", snapshotID, target.Identifier())
+	}
+
+	return snapshots[0], nil
+}
+
+// ListSnapshots returns the manual snapshots of the database, newest first
+func ListSnapshots(ctx context.Context, api RDSAPI, target SnapshotTarget) ([]Snapshot, error) {
+	var snapshots []Snapshot
+
+	if target.DBClusterIdentifier != "" {
+		paginator := rds.NewDescribeDBClusterSnapshotsPaginator(api, &rds.DescribeDBClusterSnapshotsInput{
+			DBClusterIdentifier: aws.String(target.DBClusterIdentifier),
+			SnapshotType:        aws.String(manualSnapshotType),
+		})
+
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, classifyError("rds:DescribeDBClusterSnapshots", err)
+			}
+
+			snapshots = append(snapshots, clusterSnapshots(page.DBClusterSnapshots)...)
+		}
+	} else {
+		paginator := rds.NewDescribeDBSnapshotsPaginator(api, &rds.DescribeDBSnapshotsInput{
+			DBInstanceIdentifier: aws.String(target.DBInstanceIdentifier),
+			SnapshotType:         aws.String(manualSnapshotType),
+		})
+
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, classifyError("rds:DescribeDBSnapshots", err)
+			}
+
+			snapshots = append(snapshots, instanceSnapshots(page.DBSnapshots)...)
+		}
+	}
+
+	slices.SortStableFunc(snapshots, func(a, b Snapshot) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return snapshots, nil
+}
+
+// DeleteSnapshot deletes the snapshot of the database
+func DeleteSnapshot(ctx context.Context, api RDSAPI, target SnapshotTarget, snapshotID string) error {
+	if target.DBClusterIdentifier != "" {
+		_, err := api.DeleteDBClusterSnapshot(ctx, &rds.DeleteDBClusterSnapshotInput{
+			DBClusterSnapshotIdentifier: aws.String(snapshotID),
+		})
+
+		return classifyError("rds:DeleteDBClusterSnapshot", err)
+	}
+
+	_, err := api.DeleteDBSnapshot(ctx, &rds.DeleteDBSnapshotInput{
+		DBSnapshotIdentifier: aws.String(snapshotID),
+	})
+
+	return classifyError("rds:DeleteDBSnapshot", err)
+}
+
+// SnapshotPoller waits for a snapshot to become available by describing it on a fixed interval, reporting its progress
+// as it changes
+type SnapshotPoller struct {
+	API RDSAPI
+	// Interval is the time between each request to describe the snapshot
+	Interval time.Duration
+	// OnProgress is called when the status or progress of the snapshot changes, if set
+	OnProgress func(Snapshot)
+}
+
+// WaitForAvailable polls the snapshot until it is available, it fails, or the timeout passes
+func (p SnapshotPoller) WaitForAvailable(ctx context.Context, target SnapshotTarget, snapshotID string, timeout time.Duration) (Snapshot, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var last Snapshot
+
+	for {
+		snapshot, err := DescribeSnapshot(ctx, p.API, target, snapshotID)
+
+		switch {
+		case err == nil:
+			if p.OnProgress != nil && (snapshot.Status != last.Status || snapshot.PercentProgress != last.PercentProgress) {
+				p.OnProgress(snapshot)
+			}
+
+			last = snapshot
+
+			if snapshot.Available() {
+				return snapshot, nil
+			}
+
+			if slices.Contains(failedSnapshotStatuses, snapshot.Status) {
+				return snapshot, fmt.Errorf("snapshot %s of %s is %s", snapshotID, target.Identifier(), snapshot.Status)
+			}
+		// a newly created snapshot may not be found at first, and throttled requests are tried again
+		case !isThrottlingError(err) && !isSnapshotNotFound(err):
+			return last, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return last, fmt.Errorf("snapshot %s of %s was not available within %s: %w", snapshotID, target.Identifier(), timeout, ctx.Err())
+		case <-time.After(p.Interval):
+		}
+	}
+}
+
+func isSnapshotNotFound(err error) bool {
+	var (
+		instanceNotFound *types.DBSnapshotNotFoundFault
+		clusterNotFound  *types.DBClusterSnapshotNotFoundFault
+	)
+
+	return errors.As(err, &instanceNotFound) || errors.As(err, &clusterNotFound)
+}
+
+func instanceSnapshots(described []types.DBSnapshot) []Snapshot {
+	snapshots := make([]Snapshot, 0, len(described))
+
+	for _, snapshot := range described {
+		snapshots = append(snapshots, Snapshot{
+			ID:              aws.ToString(snapshot.DBSnapshotIdentifier),
+			Status:          aws.ToString(snapshot.Status),
+			PercentProgress: aws.ToInt32(snapshot.PercentProgress),
+			CreatedAt:       aws.ToTime(snapshot.SnapshotCreateTime),
+			CreatedByPlugin: createdByPlugin(snapshot.TagList),
+		})
+	}
+
+	return snapshots
+}
+
+func clusterSnapshots(described []types.DBClusterSnapshot) []Snapshot {
+	snapshots := make([]Snapshot, 0, len(described))
+
+	for _, snapshot := range described {
+		snapshots = append(snapshots, Snapshot{
+			ID:              aws.ToString(snapshot.DBClusterSnapshotIdentifier),
+			Status:          aws.ToString(snapshot.Status),
+			PercentProgress: aws.ToInt32(snapshot.PercentProgress),
+			CreatedAt:       aws.ToTime(snapshot.SnapshotCreateTime),
+			CreatedByPlugin: createdByPlugin(snapshot.TagList),
+		})
+	}
+
+	return snapshots
+}
+
+func createdByPlugin(tags []types.Tag) bool {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == snapshotCreatedByTag && aws.ToString(tag.Value) == snapshotCreatedByValue {
+			return true
+		}
+	}
+
+	return false
+}
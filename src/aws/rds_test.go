@@ -0,0 +1,259 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockRDSClient struct {
+	mockCreateDBSnapshot           func(ctx context.Context, params *rds.CreateDBSnapshotInput, optFns ...func(*rds.Options)) (*rds.CreateDBSnapshotOutput, error)
+	mockDescribeDBSnapshots        func(ctx context.Context, params *rds.DescribeDBSnapshotsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBSnapshotsOutput, error)
+	mockDeleteDBSnapshot           func(ctx context.Context, params *rds.DeleteDBSnapshotInput, optFns ...func(*rds.Options)) (*rds.DeleteDBSnapshotOutput, error)
+	mockCreateDBClusterSnapshot    func(ctx context.Context, params *rds.CreateDBClusterSnapshotInput, optFns ...func(*rds.Options)) (*rds.CreateDBClusterSnapshotOutput, error)
+	mockDescribeDBClusterSnapshots func(ctx context.Context, params *rds.DescribeDBClusterSnapshotsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBClusterSnapshotsOutput, error)
+	mockDeleteDBClusterSnapshot    func(ctx context.Context, params *rds.DeleteDBClusterSnapshotInput, optFns ...func(*rds.Options)) (*rds.DeleteDBClusterSnapshotOutput, error)
+}
+
+func (m mockRDSClient) CreateDBSnapshot(ctx context.Context, params *rds.CreateDBSnapshotInput, optFns ...func(*rds.Options)) (*rds.CreateDBSnapshotOutput, error) {
+	return m.mockCreateDBSnapshot(ctx, params, optFns...)
+}
+
+func (m mockRDSClient) DescribeDBSnapshots(ctx context.Context, params *rds.DescribeDBSnapshotsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBSnapshotsOutput, error) {
+	return m.mockDescribeDBSnapshots(ctx, params, optFns...)
+}
+
+func (m mockRDSClient) DeleteDBSnapshot(ctx context.Context, params *rds.DeleteDBSnapshotInput, optFns ...func(*rds.Options)) (*rds.DeleteDBSnapshotOutput, error) {
+	return m.mockDeleteDBSnapshot(ctx, params, optFns...)
+}
+
+func (m mockRDSClient) CreateDBClusterSnapshot(ctx context.Context, params *rds.CreateDBClusterSnapshotInput, optFns ...func(*rds.Options)) (*rds.CreateDBClusterSnapshotOutput, error) {
+	return m.mockCreateDBClusterSnapshot(ctx, params, optFns...)
+}
+
+func (m mockRDSClient) DescribeDBClusterSnapshots(ctx context.Context, params *rds.DescribeDBClusterSnapshotsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBClusterSnapshotsOutput, error) {
+	return m.mockDescribeDBClusterSnapshots(ctx, params, optFns...)
+}
+
+func (m mockRDSClient) DeleteDBClusterSnapshot(ctx context.Context, params *rds.DeleteDBClusterSnapshotInput, optFns ...func(*rds.Options)) (*rds.DeleteDBClusterSnapshotOutput, error) {
+	return m.mockDeleteDBClusterSnapshot(ctx, params, optFns...)
+}
+
+var (
+	instanceTarget = SnapshotTarget{DBInstanceIdentifier: "cool-service-db"}
+	clusterTarget  = SnapshotTarget{DBClusterIdentifier: "cool-service-cluster"}
+)
+
+func TestCreateSnapshot(t *testing.T) {
+	t.Run("given a DB instance, it should snapshot it tagged as taken by the plugin", func(t *testing.T) {
+		var input *rds.CreateDBSnapshotInput
+
+		api := mockRDSClient{
+			mockCreateDBSnapshot: func(ctx context.Context, params *rds.CreateDBSnapshotInput, optFns ...func(*rds.Options)) (*rds.CreateDBSnapshotOutput, error) {
+				input = params
+				return &rds.CreateDBSnapshotOutput{}, nil
+			},
+		}
+
+		err := CreateSnapshot(context.TODO(), api, instanceTarget, "migrations-runner-cool-service-db-1", "https://buildkite.com/culture-amp/cool-service/builds/1")
+
+		require.NoError(t, err)
+		assert.Equal(t, "cool-service-db", *input.DBInstanceIdentifier)
+		assert.Equal(t, "migrations-runner-cool-service-db-1", *input.DBSnapshotIdentifier)
+		assert.Equal(t, []types.Tag{
+			{Key: aws.String("created-by"), Value: aws.String("migrations-runner-buildkite-plugin")},
+			{Key: aws.String("buildkite-build-url"), Value: aws.String("https://buildkite.com/culture-amp/cool-service/builds/1")},
+		}, input.Tags)
+	})
+
+	t.Run("given an Aurora cluster, it should snapshot the cluster", func(t *testing.T) {
+		var input *rds.CreateDBClusterSnapshotInput
+
+		api := mockRDSClient{
+			mockCreateDBClusterSnapshot: func(ctx context.Context, params *rds.CreateDBClusterSnapshotInput, optFns ...func(*rds.Options)) (*rds.CreateDBClusterSnapshotOutput, error) {
+				input = params
+				return &rds.CreateDBClusterSnapshotOutput{}, nil
+			},
+		}
+
+		err := CreateSnapshot(context.TODO(), api, clusterTarget, "migrations-runner-cool-service-cluster-1", "")
+
+		require.NoError(t, err)
+		assert.Equal(t, "cool-service-cluster", *input.DBClusterIdentifier)
+		assert.Equal(t, "migrations-runner-cool-service-cluster-1", *input.DBClusterSnapshotIdentifier)
+		assert.Equal(t, []types.Tag{{Key: aws.String("created-by"), Value: aws.String("migrations-runner-buildkite-plugin")}}, input.Tags)
+	})
+
+	t.Run("given access is denied, it should return a permission error", func(t *testing.T) {
+		api := mockRDSClient{
+			mockCreateDBSnapshot: func(ctx context.Context, params *rds.CreateDBSnapshotInput, optFns ...func(*rds.Options)) (*rds.CreateDBSnapshotOutput, error) {
+				return nil, &smithy.GenericAPIError{Code: "AccessDenied", Message: "not authorized to perform rds:CreateDBSnapshot"}
+			},
+		}
+
+		err := CreateSnapshot(context.TODO(), api, instanceTarget, "migrations-runner-cool-service-db-1", "")
+
+		var permissionDenied *PermissionDeniedError
+		require.ErrorAs(t, err, &permissionDenied)
+		assert.Equal(t, "rds:CreateDBSnapshot", permissionDenied.Operation)
+	})
+}
+
+func TestSnapshotPollerWaitForAvailable(t *testing.T) {
+	t.Run("given a snapshot being created, it should report its progress until it is available", func(t *testing.T) {
+		responses := []struct {
+			snapshots []types.DBSnapshot
+			err       error
+		}{
+			{err: &types.DBSnapshotNotFoundFault{Message: aws.String("not found")}},
+			{snapshots: []types.DBSnapshot{{DBSnapshotIdentifier: aws.String("snap"), Status: aws.String("creating"), PercentProgress: aws.Int32(0)}}},
+			{err: &smithy.GenericAPIError{Code: "Throttling", Message: "Rate exceeded"}},
+			{snapshots: []types.DBSnapshot{{DBSnapshotIdentifier: aws.String("snap"), Status: aws.String("creating"), PercentProgress: aws.Int32(0)}}},
+			{snapshots: []types.DBSnapshot{{DBSnapshotIdentifier: aws.String("snap"), Status: aws.String("creating"), PercentProgress: aws.Int32(60)}}},
+			{snapshots: []types.DBSnapshot{{DBSnapshotIdentifier: aws.String("snap"), Status: aws.String("available"), PercentProgress: aws.Int32(100)}}},
+		}
+
+		calls := 0
+		api := mockRDSClient{
+			mockDescribeDBSnapshots: func(ctx context.Context, params *rds.DescribeDBSnapshotsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBSnapshotsOutput, error) {
+				assert.Equal(t, "snap", *params.DBSnapshotIdentifier)
+
+				response := responses[calls]
+				calls++
+
+				return &rds.DescribeDBSnapshotsOutput{DBSnapshots: response.snapshots}, response.err
+			},
+		}
+
+		var progress []int32
+
+		poller := SnapshotPoller{
+			API:        api,
+			Interval:   time.Millisecond,
+			OnProgress: func(snapshot Snapshot) { progress = append(progress, snapshot.PercentProgress) },
+		}
+
+		snapshot, err := poller.WaitForAvailable(context.TODO(), instanceTarget, "snap", time.Minute)
+
+		require.NoError(t, err)
+		assert.Equal(t, "available", snapshot.Status)
+		assert.Equal(t, len(responses), calls)
+		assert.Equal(t, []int32{0, 60, 100}, progress)
+	})
+
+	t.Run("given a snapshot that fails, it should return an error", func(t *testing.T) {
+		api := mockRDSClient{
+			mockDescribeDBClusterSnapshots: func(ctx context.Context, params *rds.DescribeDBClusterSnapshotsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBClusterSnapshotsOutput, error) {
+				return &rds.DescribeDBClusterSnapshotsOutput{DBClusterSnapshots: []types.DBClusterSnapshot{
+					{DBClusterSnapshotIdentifier: aws.String("snap"), Status: aws.String("failed")},
+				}}, nil
+			},
+		}
+
+		poller := SnapshotPoller{API: api, Interval: time.Millisecond}
+
+		_, err := poller.WaitForAvailable(context.TODO(), clusterTarget, "snap", time.Minute)
+
+		assert.EqualError(t, err, "snapshot snap of cool-service-cluster is failed")
+	})
+
+	t.Run("given a snapshot that is not available in time, it should time out", func(t *testing.T) {
+		api := mockRDSClient{
+			mockDescribeDBSnapshots: func(ctx context.Context, params *rds.DescribeDBSnapshotsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBSnapshotsOutput, error) {
+				return &rds.DescribeDBSnapshotsOutput{DBSnapshots: []types.DBSnapshot{
+					{DBSnapshotIdentifier: aws.String("snap"), Status: aws.String("creating")},
+				}}, nil
+			},
+		}
+
+		poller := SnapshotPoller{API: api, Interval: time.Millisecond}
+
+		_, err := poller.WaitForAvailable(context.TODO(), instanceTarget, "snap", 20*time.Millisecond)
+
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Contains(t, err.Error(), "snapshot snap of cool-service-db was not available within 20ms")
+	})
+
+	t.Run("given describing the snapshot fails, it should return the error", func(t *testing.T) {
+		api := mockRDSClient{
+			mockDescribeDBSnapshots: func(ctx context.Context, params *rds.DescribeDBSnapshotsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBSnapshotsOutput, error) {
+				return nil, errors.New("connection reset")
+			},
+		}
+
+		poller := SnapshotPoller{API: api, Interval: time.Millisecond}
+
+		_, err := poller.WaitForAvailable(context.TODO(), instanceTarget, "snap", time.Minute)
+
+		assert.EqualError(t, err, "connection reset")
+	})
+}
+
+func TestListSnapshots(t *testing.T) {
+	pluginTags := []types.Tag{{Key: aws.String("created-by"), Value: aws.String("migrations-runner-buildkite-plugin")}}
+	now := time.Now()
+
+	var inputs []*rds.DescribeDBSnapshotsInput
+
+	api := mockRDSClient{
+		mockDescribeDBSnapshots: func(ctx context.Context, params *rds.DescribeDBSnapshotsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBSnapshotsOutput, error) {
+			inputs = append(inputs, params)
+
+			if params.Marker == nil {
+				return &rds.DescribeDBSnapshotsOutput{
+					Marker: aws.String("page-2"),
+					DBSnapshots: []types.DBSnapshot{
+						{DBSnapshotIdentifier: aws.String("oldest"), Status: aws.String("available"), SnapshotCreateTime: aws.Time(now.Add(-2 * time.Hour)), TagList: pluginTags},
+						{DBSnapshotIdentifier: aws.String("manual"), Status: aws.String("available"), SnapshotCreateTime: aws.Time(now.Add(-time.Hour))},
+					},
+				}, nil
+			}
+
+			return &rds.DescribeDBSnapshotsOutput{
+				DBSnapshots: []types.DBSnapshot{
+					{DBSnapshotIdentifier: aws.String("newest"), Status: aws.String("available"), SnapshotCreateTime: aws.Time(now), TagList: pluginTags},
+				},
+			}, nil
+		},
+	}
+
+	snapshots, err := ListSnapshots(context.TODO(), api, instanceTarget)
+
+	require.NoError(t, err)
+	require.Len(t, inputs, 2)
+	assert.Equal(t, "cool-service-db", *inputs[0].DBInstanceIdentifier)
+	assert.Equal(t, "manual", *inputs[0].SnapshotType)
+
+	var ids []string
+	for _, snapshot := range snapshots {
+		ids = append(ids, snapshot.ID)
+	}
+
+	assert.Equal(t, []string{"newest", "manual", "oldest"}, ids)
+	assert.True(t, snapshots[0].CreatedByPlugin)
+	assert.False(t, snapshots[1].CreatedByPlugin)
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	var deleted string
+
+	api := mockRDSClient{
+		mockDeleteDBClusterSnapshot: func(ctx context.Context, params *rds.DeleteDBClusterSnapshotInput, optFns ...func(*rds.Options)) (*rds.DeleteDBClusterSnapshotOutput, error) {
+			deleted = *params.DBClusterSnapshotIdentifier
+			return &rds.DeleteDBClusterSnapshotOutput{}, nil
+		},
+	}
+
+	err := DeleteSnapshot(context.TODO(), api, clusterTarget, "snap")
+
+	require.NoError(t, err)
+	assert.Equal(t, "snap", deleted)
+}
@@ -0,0 +1,72 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// internal interface for secretsmanager
+type secretsManagerAPI interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// ValidateSecretArn checks that the ARN refers to a secret that ResolveSecrets is able to retrieve: either an SSM
+// parameter or a Secrets Manager secret. The error never includes the ARN, as it could be a secret value given in its
+// place.
+func ValidateSecretArn(secretArn string) error {
+	parsed, err := arn.Parse(secretArn)
+	if err != nil {
+		return errors.New("not an ARN")
+	}
+
+	if parsed.Service != "ssm" && parsed.Service != "secretsmanager" {
+		return errors.New("not an SSM parameter or Secrets Manager secret ARN")
+	}
+
+	return nil
+}
+
+// ResolveSecrets retrieves the value of each secret, keyed by the name of the environment variable it is destined for.
+// Secrets are ARNs of either SSM parameters (which are decrypted) or Secrets Manager secrets.
+func ResolveSecrets(ctx context.Context, ssmAPI ssmAPI, secretsManagerAPI secretsManagerAPI, secrets map[string]string) (map[string]string, error) {
+	values := make(map[string]string, len(secrets))
+
+	for name, secretArn := range secrets {
+		err := ValidateSecretArn(secretArn)
+		if err != nil {
+			return nil, fmt.Errorf("secret %s is %w", name, err)
+		}
+
+		parsed, _ := arn.Parse(secretArn)
+
+		switch parsed.Service {
+		case "ssm":
+			res, err := ssmAPI.GetParameter(ctx, &ssm.GetParameterInput{
+				Name:           aws.String(secretArn),
+				WithDecryption: aws.Bool(true),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("secret %s: %w", name, classifyError("ssm:GetParameter", err))
+			}
+
+			values[name] = aws.ToString(res.Parameter.Value)
+		case "secretsmanager":
+			res, err := secretsManagerAPI.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+				SecretId: aws.String(secretArn),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("secret %s: %w", name, classifyError("secretsmanager:GetSecretValue", err))
+			}
+
+			values[name] = aws.ToString(res.SecretString)
+		}
+	}
+
+	return values, nil
+}
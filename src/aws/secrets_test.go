@@ -0,0 +1,105 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockGetSecretValue func(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+
+func (m mockGetSecretValue) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	return m(ctx, params, optFns...)
+}
+
+func TestValidateSecretArn(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		valid bool
+	}{
+		{
+			name:  "given an SSM parameter ARN, it should be valid",
+			input: "arn:aws:ssm:us-west-2:123456789012:parameter/cool-service/database-password",
+			valid: true,
+		},
+		{
+			name:  "given a Secrets Manager secret ARN, it should be valid",
+			input: "arn:aws:secretsmanager:us-west-2:123456789012:secret:cool-service/database-password-AbCdEf",
+			valid: true,
+		},
+		{
+			name:  "given an ARN for another service, it should be invalid",
+			input: "arn:aws:s3:::cool-bucket/database-password",
+			valid: false,
+		},
+		{
+			name:  "given a plain value, it should be invalid",
+			input: "hunter2",
+			valid: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateSecretArn(tc.input)
+			if tc.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.NotContains(t, err.Error(), tc.input, "errors should never contain the value, which could be a secret")
+			}
+		})
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	ssmArn := "arn:aws:ssm:us-west-2:123456789012:parameter/cool-service/database-password"
+	secretArn := "arn:aws:secretsmanager:us-west-2:123456789012:secret:cool-service/api-key-AbCdEf"
+
+	ssmClient := mockGetParameter(func(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+		if !aws.ToBool(params.WithDecryption) {
+			return nil, errors.New("parameter must be decrypted")
+		}
+
+		return &ssm.GetParameterOutput{
+			Parameter: &types.Parameter{
+				Value: aws.String("hunter2"),
+			},
+		}, nil
+	})
+	secretsManagerClient := mockGetSecretValue(func(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+		return &secretsmanager.GetSecretValueOutput{
+			SecretString: aws.String("correct-horse-battery-staple"),
+		}, nil
+	})
+
+	t.Run("given SSM and Secrets Manager ARNs, it should resolve each to its value", func(t *testing.T) {
+		result, err := ResolveSecrets(context.TODO(), ssmClient, secretsManagerClient, map[string]string{
+			"DATABASE_PASSWORD": ssmArn,
+			"API_KEY":           secretArn,
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"DATABASE_PASSWORD": "hunter2",
+			"API_KEY":           "correct-horse-battery-staple",
+		}, result)
+	})
+
+	t.Run("when a secret cannot be retrieved, it should return an error naming the secret", func(t *testing.T) {
+		failingClient := mockGetSecretValue(func(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+			return nil, errors.New("secret not found")
+		})
+
+		_, err := ResolveSecrets(context.TODO(), ssmClient, failingClient, map[string]string{"API_KEY": secretArn})
+		require.EqualError(t, err, "secret API_KEY: secret not found")
+	})
+}
@@ -3,7 +3,10 @@ package aws
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"sort"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 )
 
@@ -12,13 +15,64 @@ type ssmAPI interface {
 	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
 }
 
+// internal interface for listing ssm parameters under a path
+type ssmPathAPI interface {
+	GetParametersByPath(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error)
+}
+
 // TaskRunnerConfiguration is ECS Task Configuration
 type TaskRunnerConfiguration struct {
-	Cluster           string   `json:"cluster"`
-	Command           []string `json:"command"           required:"false"`
-	SecurityGroupIds  []string `json:"securityGroupIds"`
-	SubnetIds         []string `json:"subnetIds"`
-	TaskDefinitionArn string   `json:"taskDefinitionArn"`
+	Cluster           string            `json:"cluster"`
+	Command           []string          `json:"command"           required:"false"`
+	Environment       map[string]string `json:"environment"`
+	Secrets           map[string]string `json:"secrets"`
+	SecurityGroupIds  []string          `json:"securityGroupIds"`
+	SubnetIds         []string          `json:"subnetIds"`
+	TaskDefinitionArn string            `json:"taskDefinitionArn"`
+
+	// LaunchType and CapacityProviderStrategy are alternatives, when neither is given the task is run on Fargate
+	LaunchType               string                         `json:"launchType"`
+	CapacityProviderStrategy []CapacityProviderStrategyItem `json:"capacityProviderStrategy"`
+	PlatformVersion          string                         `json:"platformVersion"`
+	AssignPublicIp           bool                           `json:"assignPublicIp"`
+	PlacementConstraints     []PlacementConstraint          `json:"placementConstraints"`
+	PlacementStrategy        []PlacementStrategy            `json:"placementStrategy"`
+
+	// Cpu and Memory override the task definition's task-level resources, in CPU units and MiB or as e.g. "1 vCPU"
+	// and "2 GB". ContainerCpu and ContainerMemory override those of the migrations-runner container.
+	Cpu              string `json:"cpu"`
+	Memory           string `json:"memory"`
+	EphemeralStorage int32  `json:"ephemeralStorage"`
+	TaskRoleArn      string `json:"taskRoleArn"`
+	ExecutionRoleArn string `json:"executionRoleArn"`
+	ContainerCpu     int32  `json:"containerCpu"`
+	ContainerMemory  int32  `json:"containerMemory"`
+
+	// SecretValues are the resolved values of Secrets. They are passed to the container but never serialized.
+	SecretValues map[string]string `json:"-"`
+
+	// ClientToken makes repeated requests to run the task return the task already started rather than starting
+	// another. It is derived from the job running the plugin and never serialized.
+	ClientToken string `json:"-"`
+}
+
+// CapacityProviderStrategyItem is a capacity provider to run the task on, and its share of the tasks run
+type CapacityProviderStrategyItem struct {
+	CapacityProvider string `json:"capacityProvider"`
+	Weight           int32  `json:"weight"`
+	Base             int32  `json:"base"`
+}
+
+// PlacementConstraint restricts the container instances the task can be placed on, for the EC2 launch type
+type PlacementConstraint struct {
+	Type       string `json:"type"`
+	Expression string `json:"expression"`
+}
+
+// PlacementStrategy decides which container instance the task is placed on, for the EC2 launch type
+type PlacementStrategy struct {
+	Type  string `json:"type"`
+	Field string `json:"field"`
 }
 
 // RetrieveConfiguration retrieves the configuration from the SSM parameter store
@@ -27,15 +81,60 @@ func RetrieveConfiguration(ctx context.Context, ssmAPI ssmAPI, parameterName str
 		Name: &parameterName,
 	})
 	if err != nil {
-		return nil, err
+		return nil, classifyError("ssm:GetParameter", err)
+	}
+
+	return parseConfiguration(*res.Parameter.Value)
+}
+
+// NamedConfiguration is a task configuration along with the name of the parameter it was retrieved from
+type NamedConfiguration struct {
+	ParameterName string
+	Configuration *TaskRunnerConfiguration
+}
+
+// RetrieveConfigurationsByPath retrieves the configuration from each parameter directly under the path, ordered by
+// parameter name
+func RetrieveConfigurationsByPath(ctx context.Context, ssmAPI ssmPathAPI, path string) ([]NamedConfiguration, error) {
+	var configurations []NamedConfiguration
+
+	paginator := ssm.NewGetParametersByPathPaginator(ssmAPI, &ssm.GetParametersByPathInput{
+		Path: aws.String(path),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, classifyError("ssm:GetParametersByPath", err)
+		}
+
+		for _, parameter := range page.Parameters {
+			configuration, err := parseConfiguration(aws.ToString(parameter.Value))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", aws.ToString(parameter.Name), err)
+			}
+
+			configurations = append(configurations, NamedConfiguration{
+				ParameterName: aws.ToString(parameter.Name),
+				Configuration: configuration,
+			})
+		}
 	}
 
-	value := &TaskRunnerConfiguration{}
+	sort.Slice(configurations, func(i, j int) bool {
+		return configurations[i].ParameterName < configurations[j].ParameterName
+	})
+
+	return configurations, nil
+}
+
+func parseConfiguration(value string) (*TaskRunnerConfiguration, error) {
+	configuration := &TaskRunnerConfiguration{}
 
-	err = json.Unmarshal([]byte(*res.Parameter.Value), value)
+	err := json.Unmarshal([]byte(value), configuration)
 	if err != nil {
 		return nil, err
 	}
 
-	return value, nil
+	return configuration, nil
 }
@@ -79,3 +79,66 @@ func TestRetrieveConfiguration(t *testing.T) {
 		})
 	}
 }
+
+type mockGetParametersByPath func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error)
+
+func (m mockGetParametersByPath) GetParametersByPath(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+	return m(ctx, params, optFns...)
+}
+
+func TestRetrieveConfigurationsByPath(t *testing.T) {
+	pages := map[string]*ssm.GetParametersByPathOutput{
+		"": {
+			Parameters: []types.Parameter{
+				{
+					Name:  aws.String("/cool-service/migrations/shard-2"),
+					Value: aws.String(`{"cluster": "shard-2-cluster","taskDefinitionArn": "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task-2"}`),
+				},
+			},
+			NextToken: aws.String("page-2"),
+		},
+		"page-2": {
+			Parameters: []types.Parameter{
+				{
+					Name:  aws.String("/cool-service/migrations/shard-1"),
+					Value: aws.String(`{"cluster": "shard-1-cluster","taskDefinitionArn": "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task-1"}`),
+				},
+			},
+		},
+	}
+
+	t.Run("given a path, it should return the configuration of each parameter under it ordered by name", func(t *testing.T) {
+		client := mockGetParametersByPath(func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+			assert.Equal(t, "/cool-service/migrations/", *params.Path)
+			return pages[aws.ToString(params.NextToken)], nil
+		})
+
+		result, err := RetrieveConfigurationsByPath(context.TODO(), client, "/cool-service/migrations/")
+
+		require.NoError(t, err)
+		assert.Equal(t, []NamedConfiguration{
+			{
+				ParameterName: "/cool-service/migrations/shard-1",
+				Configuration: &TaskRunnerConfiguration{Cluster: "shard-1-cluster", TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task-1"},
+			},
+			{
+				ParameterName: "/cool-service/migrations/shard-2",
+				Configuration: &TaskRunnerConfiguration{Cluster: "shard-2-cluster", TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task-2"},
+			},
+		}, result)
+	})
+
+	t.Run("given a parameter that isn't a valid configuration, it should return an error naming it", func(t *testing.T) {
+		client := mockGetParametersByPath(func(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+			return &ssm.GetParametersByPathOutput{
+				Parameters: []types.Parameter{
+					{Name: aws.String("/cool-service/migrations/shard-1"), Value: aws.String("not json")},
+				},
+			}, nil
+		})
+
+		_, err := RetrieveConfigurationsByPath(context.TODO(), client, "/cool-service/migrations/")
+
+		require.ErrorContains(t, err, "/cool-service/migrations/shard-1: invalid character")
+	})
+}
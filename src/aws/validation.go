@@ -0,0 +1,443 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// Limits on the items of a capacity provider strategy, from the ecs:RunTask API reference
+const (
+	maxCapacityProviderWeight = 1000
+	maxCapacityProviderBase   = 100000
+)
+
+// Limits on the ephemeral storage of a Fargate task, in GiB
+const (
+	minEphemeralStorage = 21
+	maxEphemeralStorage = 200
+)
+
+// cpuUnitsPerVCPU and mebibytesPerGB convert the "1 vCPU" and "2 GB" forms of the task resources to CPU units and MiB
+const (
+	cpuUnitsPerVCPU = 1024
+	mebibytesPerGB  = 1024
+)
+
+// fargateMemory is the memory, in MiB, that can be used with each amount of CPU, in CPU units, on Fargate
+var fargateMemory = map[int][]int{
+	256:   {512, 1024, 2048},
+	512:   memoryRange(1024, 4096, 1024),
+	1024:  memoryRange(2048, 8192, 1024),
+	2048:  memoryRange(4096, 16384, 1024),
+	4096:  memoryRange(8192, 30720, 1024),
+	8192:  memoryRange(16384, 61440, 4096),
+	16384: memoryRange(32768, 122880, 8192),
+}
+
+var (
+	subnetIDPattern            = regexp.MustCompile(`^subnet-([0-9a-f]{8}|[0-9a-f]{17})$`)
+	securityGroupIDPattern     = regexp.MustCompile(`^sg-([0-9a-f]{8}|[0-9a-f]{17})$`)
+	clusterNamePattern         = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,255}$`)
+	taskDefinitionPattern      = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,255}(:[0-9]+)?$`)
+	environmentVariablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// ValidateConfiguration checks that the task configuration is complete and well-formed, without calling AWS. Every
+// problem found is reported in the returned error, rather than only the first.
+func ValidateConfiguration(config *TaskRunnerConfiguration) error {
+	var problems []error
+
+	if config.Cluster == "" {
+		problems = append(problems, errors.New("cluster is required"))
+	} else if !isValidResource(config.Cluster, "cluster/", clusterNamePattern) {
+		problems = append(problems, fmt.Errorf("cluster %q is not a cluster name or ARN", config.Cluster))
+	}
+
+	if config.TaskDefinitionArn == "" {
+		problems = append(problems, errors.New("taskDefinitionArn is required"))
+	} else if !isValidResource(config.TaskDefinitionArn, "task-definition/", taskDefinitionPattern) {
+		problems = append(problems, fmt.Errorf("taskDefinitionArn %q is not a task definition ARN", config.TaskDefinitionArn))
+	}
+
+	// Fargate tasks use the awsvpc network mode, which needs subnets. Other tasks need them only when their task
+	// definition uses it, which is checked along with the task definition's other resources.
+	if len(config.SubnetIds) == 0 {
+		if runsOnFargate(config) {
+			problems = append(problems, errors.New("subnetIds must contain at least one subnet for tasks run on Fargate"))
+		} else if len(config.SecurityGroupIds) > 0 {
+			problems = append(problems, errors.New("securityGroupIds can only be given with subnetIds"))
+		}
+	}
+
+	for _, subnetID := range config.SubnetIds {
+		if !subnetIDPattern.MatchString(subnetID) {
+			problems = append(problems, fmt.Errorf("subnetIds: %q is not a subnet ID", subnetID))
+		}
+	}
+
+	for _, securityGroupID := range config.SecurityGroupIds {
+		if !securityGroupIDPattern.MatchString(securityGroupID) {
+			problems = append(problems, fmt.Errorf("securityGroupIds: %q is not a security group ID", securityGroupID))
+		}
+	}
+
+	// Variables are checked in order of name, so the problems are listed the same way every time
+	for _, name := range slices.Sorted(maps.Keys(config.Environment)) {
+		if !environmentVariablePattern.MatchString(name) {
+			problems = append(problems, fmt.Errorf("environment: %q is not a valid variable name", name))
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(config.Secrets)) {
+		err := ValidateSecretArn(config.Secrets[name])
+		if err != nil {
+			problems = append(problems, fmt.Errorf("secret %s is %w", name, err))
+		}
+	}
+
+	problems = append(problems, validateCapacity(config)...)
+	problems = append(problems, validatePlacement(config)...)
+	problems = append(problems, validateResources(config)...)
+
+	return errors.Join(problems...)
+}
+
+// validateCapacity checks the launch type or capacity provider strategy, and the options that only apply to some of
+// them
+func validateCapacity(config *TaskRunnerConfiguration) []error {
+	var problems []error
+
+	if config.LaunchType != "" && len(config.CapacityProviderStrategy) > 0 {
+		problems = append(problems, errors.New("launchType and capacityProviderStrategy cannot both be given"))
+	}
+
+	switch types.LaunchType(config.LaunchType) {
+	case "", types.LaunchTypeFargate, types.LaunchTypeEc2, types.LaunchTypeExternal:
+	default:
+		problems = append(problems, fmt.Errorf("launchType %q is not one of FARGATE, EC2 or EXTERNAL", config.LaunchType))
+	}
+
+	withBase := 0
+	withWeight := 0
+	fargateProviders := 0
+
+	for _, item := range config.CapacityProviderStrategy {
+		if item.CapacityProvider == "" {
+			problems = append(problems, errors.New("capacityProviderStrategy: capacityProvider is required"))
+			continue
+		}
+
+		if item.Weight < 0 || item.Weight > maxCapacityProviderWeight {
+			problems = append(problems, fmt.Errorf("capacityProviderStrategy: %s: weight must be between 0 and %d", item.CapacityProvider, maxCapacityProviderWeight))
+		}
+
+		if item.Base < 0 || item.Base > maxCapacityProviderBase {
+			problems = append(problems, fmt.Errorf("capacityProviderStrategy: %s: base must be between 0 and %d", item.CapacityProvider, maxCapacityProviderBase))
+		}
+
+		if item.Base > 0 {
+			withBase++
+		}
+
+		if item.Weight > 0 {
+			withWeight++
+		}
+
+		if isFargateCapacityProvider(item.CapacityProvider) {
+			fargateProviders++
+		}
+	}
+
+	if withBase > 1 {
+		problems = append(problems, errors.New("capacityProviderStrategy: only one capacity provider can have a base"))
+	}
+
+	if len(config.CapacityProviderStrategy) > 0 && withWeight == 0 {
+		problems = append(problems, errors.New("capacityProviderStrategy: at least one capacity provider must have a weight greater than 0"))
+	}
+
+	if fargateProviders > 0 && fargateProviders < len(config.CapacityProviderStrategy) {
+		problems = append(problems, errors.New("capacityProviderStrategy cannot mix Fargate and EC2 capacity providers"))
+	}
+
+	if !runsOnFargate(config) && len(config.CapacityProviderStrategy) == 0 {
+		if config.PlatformVersion != "" {
+			problems = append(problems, fmt.Errorf("platformVersion can only be given for the FARGATE launch type, not %s", config.LaunchType))
+		}
+
+		if config.AssignPublicIp {
+			problems = append(problems, fmt.Errorf("assignPublicIp can only be used with the FARGATE launch type, not %s", config.LaunchType))
+		}
+	}
+
+	return problems
+}
+
+// validatePlacement checks the placement constraints and strategy, which Fargate does not support
+func validatePlacement(config *TaskRunnerConfiguration) []error {
+	var problems []error
+
+	if runsOnFargate(config) {
+		if len(config.PlacementConstraints) > 0 {
+			problems = append(problems, errors.New("placementConstraints cannot be used with Fargate"))
+		}
+
+		if len(config.PlacementStrategy) > 0 {
+			problems = append(problems, errors.New("placementStrategy cannot be used with Fargate"))
+		}
+	}
+
+	for _, constraint := range config.PlacementConstraints {
+		switch types.PlacementConstraintType(constraint.Type) {
+		case types.PlacementConstraintTypeDistinctInstance:
+		case types.PlacementConstraintTypeMemberOf:
+			if constraint.Expression == "" {
+				problems = append(problems, errors.New("placementConstraints: memberOf requires an expression"))
+			}
+		default:
+			problems = append(problems, fmt.Errorf("placementConstraints: %q is not one of distinctInstance or memberOf", constraint.Type))
+		}
+	}
+
+	for _, strategy := range config.PlacementStrategy {
+		switch types.PlacementStrategyType(strategy.Type) {
+		case types.PlacementStrategyTypeRandom:
+		case types.PlacementStrategyTypeSpread, types.PlacementStrategyTypeBinpack:
+			if strategy.Field == "" {
+				problems = append(problems, fmt.Errorf("placementStrategy: %s requires a field", strategy.Type))
+			}
+		default:
+			problems = append(problems, fmt.Errorf("placementStrategy: %q is not one of random, spread or binpack", strategy.Type))
+		}
+	}
+
+	return problems
+}
+
+// validateResources checks the resource and role overrides, including that the CPU and memory are a combination
+// Fargate supports when the task runs on Fargate
+func validateResources(config *TaskRunnerConfiguration) []error {
+	var problems []error
+
+	cpu, err := parseResource(config.Cpu, "vCPU", cpuUnitsPerVCPU)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("cpu: %w", err))
+	}
+
+	memory, err := parseResource(config.Memory, "GB", mebibytesPerGB)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("memory: %w", err))
+	}
+
+	if runsOnFargate(config) && cpu > 0 && memory > 0 {
+		if err := validateFargateResources(cpu, memory); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if config.EphemeralStorage != 0 {
+		if !runsOnFargate(config) {
+			problems = append(problems, errors.New("ephemeralStorage can only be given for tasks run on Fargate"))
+		} else if config.EphemeralStorage < minEphemeralStorage || config.EphemeralStorage > maxEphemeralStorage {
+			problems = append(problems, fmt.Errorf("ephemeralStorage must be between %d and %d GiB", minEphemeralStorage, maxEphemeralStorage))
+		}
+	}
+
+	if config.ContainerCpu < 0 || (cpu > 0 && int(config.ContainerCpu) > cpu) {
+		problems = append(problems, fmt.Errorf("containerCpu %d must be between 0 and the task's cpu", config.ContainerCpu))
+	}
+
+	if config.ContainerMemory < 0 || (memory > 0 && int(config.ContainerMemory) > memory) {
+		problems = append(problems, fmt.Errorf("containerMemory %d must be between 0 and the task's memory", config.ContainerMemory))
+	}
+
+	if config.TaskRoleArn != "" && !isRoleArn(config.TaskRoleArn) {
+		problems = append(problems, fmt.Errorf("taskRoleArn %q is not an IAM role ARN", config.TaskRoleArn))
+	}
+
+	if config.ExecutionRoleArn != "" && !isRoleArn(config.ExecutionRoleArn) {
+		problems = append(problems, fmt.Errorf("executionRoleArn %q is not an IAM role ARN", config.ExecutionRoleArn))
+	}
+
+	return problems
+}
+
+// parseResource reads a task's CPU or memory, given either as a whole number of units or as a number of the larger
+// unit, e.g. "0.5 vCPU" or "2 GB". An empty value is zero.
+func parseResource(value string, largerUnit string, unitsPerLarger float64) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	if units, err := strconv.Atoi(value); err == nil && units > 0 {
+		return units, nil
+	}
+
+	number, found := strings.CutSuffix(strings.TrimSpace(value), largerUnit)
+	if found {
+		larger, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+		if err == nil && larger > 0 {
+			return int(larger * unitsPerLarger), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%q is not a positive whole number or a number of %s", value, largerUnit)
+}
+
+// validateFargateResources checks that the memory can be used with the CPU on Fargate
+func validateFargateResources(cpu int, memory int) error {
+	allowed, ok := fargateMemory[cpu]
+	if !ok {
+		return fmt.Errorf("cpu %d is not supported on Fargate, use one of 256, 512, 1024, 2048, 4096, 8192 or 16384", cpu)
+	}
+
+	if !slices.Contains(allowed, memory) {
+		return fmt.Errorf("memory %d is not supported with cpu %d on Fargate, use %s", memory, cpu, describeMemory(allowed))
+	}
+
+	return nil
+}
+
+// VerifyResourceOverrides checks that the CPU or memory of a task run on Fargate is a combination Fargate supports
+// with the other of the two from the task definition, when only one of them is overridden
+func VerifyResourceOverrides(ctx context.Context, ecsAPI EcsClientAPI, config *TaskRunnerConfiguration) error {
+	if !runsOnFargate(config) || (config.Cpu == "") == (config.Memory == "") {
+		return nil
+	}
+
+	definition, err := DescribeTaskDefinition(ctx, ecsAPI, config.TaskDefinitionArn)
+	if err != nil {
+		return fmt.Errorf("failed to describe task definition %s to check the resources: %w", config.TaskDefinitionArn, err)
+	}
+
+	cpu, memory, fromDefinition := config.Cpu, config.Memory, "memory"
+	if cpu == "" {
+		cpu, fromDefinition = aws.ToString(definition.Cpu), "cpu"
+	} else {
+		memory = aws.ToString(definition.Memory)
+	}
+
+	cpuUnits, cpuErr := parseResource(cpu, "vCPU", cpuUnitsPerVCPU)
+	memoryMiB, memoryErr := parseResource(memory, "GB", mebibytesPerGB)
+
+	// Unreadable overrides are reported by ValidateConfiguration, and ECS reports a task definition without its own
+	if cpuErr != nil || memoryErr != nil || cpuUnits == 0 || memoryMiB == 0 {
+		return nil
+	}
+
+	err = validateFargateResources(cpuUnits, memoryMiB)
+	if err != nil {
+		return fmt.Errorf("with the %s of task definition %s, %w", fromDefinition, config.TaskDefinitionArn, err)
+	}
+
+	return nil
+}
+
+// describeMemory lists the amounts of memory, as a range when they are in regular increments
+func describeMemory(allowed []int) string {
+	step := allowed[1] - allowed[0]
+	if allowed[len(allowed)-1]-allowed[0] == step*(len(allowed)-1) {
+		return fmt.Sprintf("%d to %d in increments of %d", allowed[0], allowed[len(allowed)-1], step)
+	}
+
+	return "one of " + strings.Trim(fmt.Sprint(allowed), "[]")
+}
+
+// memoryRange returns the amounts of memory from first to last in steps of step
+func memoryRange(first int, last int, step int) []int {
+	var values []int
+	for value := first; value <= last; value += step {
+		values = append(values, value)
+	}
+
+	return values
+}
+
+func isRoleArn(value string) bool {
+	parsed, err := arn.Parse(value)
+
+	return err == nil && parsed.Service == "iam" && strings.HasPrefix(parsed.Resource, "role/")
+}
+
+// runsOnFargate reports whether the task is run on Fargate, either by its launch type or its capacity providers
+func runsOnFargate(config *TaskRunnerConfiguration) bool {
+	if len(config.CapacityProviderStrategy) == 0 {
+		return launchTypeForConfig(config) == string(types.LaunchTypeFargate)
+	}
+
+	for _, item := range config.CapacityProviderStrategy {
+		if !isFargateCapacityProvider(item.CapacityProvider) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isFargateCapacityProvider(name string) bool {
+	return name == "FARGATE" || name == "FARGATE_SPOT"
+}
+
+// isValidResource reports whether value is either an ECS ARN of the given resource type, or a name matching pattern
+func isValidResource(value string, resourcePrefix string, pattern *regexp.Regexp) bool {
+	if !arn.IsARN(value) {
+		return pattern.MatchString(value)
+	}
+
+	parsed, err := arn.Parse(value)
+	if err != nil {
+		return false
+	}
+
+	return parsed.Service == "ecs" && strings.HasPrefix(parsed.Resource, resourcePrefix) && pattern.MatchString(strings.TrimPrefix(parsed.Resource, resourcePrefix))
+}
+
+// VerifyConfigurationResources checks that the cluster and task definition in the configuration exist, that the task
+// definition has a migrations-runner container, and that subnets are given if it uses the awsvpc network mode. Every
+// problem found is reported in the returned error.
+func VerifyConfigurationResources(ctx context.Context, ecsAPI EcsClientAPI, config *TaskRunnerConfiguration) error {
+	var problems []error
+
+	clusters, err := ecsAPI.DescribeClusters(ctx, &ecs.DescribeClustersInput{
+		Clusters: []string{config.Cluster},
+	})
+	if err != nil {
+		problems = append(problems, fmt.Errorf("failed to describe cluster %s: %w", config.Cluster, classifyError("ecs:DescribeClusters", err)))
+	} else {
+		for _, failure := range clusters.Failures {
+			problems = append(problems, fmt.Errorf("cluster %s: %s", config.Cluster, aws.ToString(failure.Reason)))
+		}
+
+		for _, cluster := range clusters.Clusters {
+			if aws.ToString(cluster.Status) != "ACTIVE" {
+				problems = append(problems, fmt.Errorf("cluster %s is %s", config.Cluster, aws.ToString(cluster.Status)))
+			}
+		}
+	}
+
+	definition, err := DescribeTaskDefinition(ctx, ecsAPI, config.TaskDefinitionArn)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("failed to describe task definition %s: %w", config.TaskDefinitionArn, err))
+	} else {
+		if _, ok := findContainerDefinition(definition.ContainerDefinitions, MigrationsRunnerContainerName); !ok {
+			problems = append(problems, fmt.Errorf("task definition %s has no %s container", config.TaskDefinitionArn, MigrationsRunnerContainerName))
+		}
+
+		if definition.NetworkMode == types.NetworkModeAwsvpc && len(config.SubnetIds) == 0 {
+			problems = append(problems, fmt.Errorf("task definition %s uses the awsvpc network mode, which requires subnetIds", config.TaskDefinitionArn))
+		}
+	}
+
+	return errors.Join(problems...)
+}
@@ -0,0 +1,384 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateConfiguration(t *testing.T) {
+	valid := func() *TaskRunnerConfiguration {
+		return &TaskRunnerConfiguration{
+			Cluster:           "test-cluster",
+			SecurityGroupIds:  []string{"sg-0123456789abcdef0"},
+			SubnetIds:         []string{"subnet-0123456789abcdef0", "subnet-01234567"},
+			TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task:1",
+		}
+	}
+
+	tests := []struct {
+		name        string
+		input       func() *TaskRunnerConfiguration
+		expectedErr string
+	}{
+		{
+			name:  "given a complete configuration, it should be valid",
+			input: valid,
+		},
+		{
+			name: "given a cluster ARN and task definition family, it should be valid",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.Cluster = "arn:aws:ecs:us-west-2:123456789012:cluster/test-cluster"
+				config.TaskDefinitionArn = "test-task"
+
+				return config
+			},
+		},
+		{
+			name: "given a configuration missing its cluster and subnets, it should report both problems",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.Cluster = ""
+				config.SubnetIds = []string{}
+
+				return config
+			},
+			expectedErr: "cluster is required\nsubnetIds must contain at least one subnet for tasks run on Fargate",
+		},
+		{
+			name: "given malformed ARNs and IDs, it should report every one",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.TaskDefinitionArn = "arn:aws:ecs:us-west-2:123456789012:cluster/test-task"
+				config.SubnetIds = []string{"subnet-123456"}
+				config.SecurityGroupIds = []string{"sg-0123456789abcdef0", "vpc-0123456789abcdef0"}
+				config.Secrets = map[string]string{
+					"DATABASE_PASSWORD": "hunter2",
+					"API_KEY":           "arn:aws:s3:::cool-bucket/api-key",
+				}
+
+				return config
+			},
+			expectedErr: `taskDefinitionArn "arn:aws:ecs:us-west-2:123456789012:cluster/test-task" is not a task definition ARN` + "\n" +
+				`subnetIds: "subnet-123456" is not a subnet ID` + "\n" +
+				`securityGroupIds: "vpc-0123456789abcdef0" is not a security group ID` + "\n" +
+				`secret API_KEY is not an SSM parameter or Secrets Manager secret ARN` + "\n" +
+				`secret DATABASE_PASSWORD is not an ARN`,
+		},
+		{
+			name: "given the EC2 launch type with placement, it should be valid",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.LaunchType = "EC2"
+				config.PlacementConstraints = []PlacementConstraint{{Type: "memberOf", Expression: "attribute:ecs.instance-type =~ t3.*"}}
+				config.PlacementStrategy = []PlacementStrategy{{Type: "binpack", Field: "memory"}}
+
+				return config
+			},
+		},
+		{
+			name: "given the EC2 launch type without subnets, it should be valid",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.LaunchType = "EC2"
+				config.SubnetIds = nil
+				config.SecurityGroupIds = nil
+
+				return config
+			},
+		},
+		{
+			name: "given security groups without subnets on EC2, it should report them",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.CapacityProviderStrategy = []CapacityProviderStrategyItem{{CapacityProvider: "ec2-provider", Weight: 1}}
+				config.SubnetIds = nil
+
+				return config
+			},
+			expectedErr: "securityGroupIds can only be given with subnetIds",
+		},
+		{
+			name: "given a capacity provider strategy without a weight, it should report it",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.CapacityProviderStrategy = []CapacityProviderStrategyItem{{CapacityProvider: "FARGATE", Base: 1}, {CapacityProvider: "FARGATE_SPOT"}}
+
+				return config
+			},
+			expectedErr: "capacityProviderStrategy: at least one capacity provider must have a weight greater than 0",
+		},
+		{
+			name: "given a Fargate Spot capacity provider strategy, it should be valid",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.CapacityProviderStrategy = []CapacityProviderStrategyItem{{CapacityProvider: "FARGATE", Base: 1, Weight: 1}, {CapacityProvider: "FARGATE_SPOT", Weight: 4}}
+				config.PlatformVersion = "1.4.0"
+
+				return config
+			},
+		},
+		{
+			name: "given invalid capacity options, it should report every one",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.LaunchType = "LAMBDA"
+				config.CapacityProviderStrategy = []CapacityProviderStrategyItem{{CapacityProvider: "FARGATE", Base: 1}, {CapacityProvider: "ec2-provider", Base: 2, Weight: 1001}}
+
+				return config
+			},
+			expectedErr: "launchType and capacityProviderStrategy cannot both be given\n" +
+				`launchType "LAMBDA" is not one of FARGATE, EC2 or EXTERNAL` + "\n" +
+				"capacityProviderStrategy: ec2-provider: weight must be between 0 and 1000\n" +
+				"capacityProviderStrategy: only one capacity provider can have a base\n" +
+				"capacityProviderStrategy cannot mix Fargate and EC2 capacity providers",
+		},
+		{
+			name: "given Fargate options with the EC2 launch type, it should report them",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.LaunchType = "EC2"
+				config.PlatformVersion = "LATEST"
+				config.AssignPublicIp = true
+
+				return config
+			},
+			expectedErr: "platformVersion can only be given for the FARGATE launch type, not EC2\n" +
+				"assignPublicIp can only be used with the FARGATE launch type, not EC2",
+		},
+		{
+			name: "given placement on Fargate, it should report it",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.PlacementConstraints = []PlacementConstraint{{Type: "memberOf"}}
+				config.PlacementStrategy = []PlacementStrategy{{Type: "spread"}}
+
+				return config
+			},
+			expectedErr: "placementConstraints cannot be used with Fargate\n" +
+				"placementStrategy cannot be used with Fargate\n" +
+				"placementConstraints: memberOf requires an expression\n" +
+				"placementStrategy: spread requires a field",
+		},
+		{
+			name: "given resources Fargate supports, it should be valid",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.Cpu = "1 vCPU"
+				config.Memory = "6144"
+				config.EphemeralStorage = 100
+				config.ContainerMemory = 4096
+				config.TaskRoleArn = "arn:aws:iam::123456789012:role/cool-service-migrations"
+
+				return config
+			},
+		},
+		{
+			name: "given resources Fargate does not support, it should report every one",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.Cpu = "256"
+				config.Memory = "1.5 GB"
+				config.EphemeralStorage = 500
+				config.ContainerMemory = 4096
+				config.ExecutionRoleArn = "arn:aws:iam::123456789012:user/deploy"
+
+				return config
+			},
+			expectedErr: "memory 1536 is not supported with cpu 256 on Fargate, use one of 512 1024 2048\n" +
+				"ephemeralStorage must be between 21 and 200 GiB\n" +
+				"containerMemory 4096 must be between 0 and the task's memory\n" +
+				`executionRoleArn "arn:aws:iam::123456789012:user/deploy" is not an IAM role ARN`,
+		},
+		{
+			name: "given unreadable resources and an unsupported cpu, it should report them",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.Cpu = "3072"
+				config.Memory = "lots"
+
+				return config
+			},
+			expectedErr: `memory: "lots" is not a positive whole number or a number of GB`,
+		},
+		{
+			name: "given an unsupported cpu and memory on Fargate, it should report the cpu",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.Cpu = "3 vCPU"
+				config.Memory = "8 GB"
+
+				return config
+			},
+			expectedErr: "cpu 3072 is not supported on Fargate, use one of 256, 512, 1024, 2048, 4096, 8192 or 16384",
+		},
+		{
+			name: "given any cpu and memory on EC2, it should be valid",
+			input: func() *TaskRunnerConfiguration {
+				config := valid()
+				config.LaunchType = "EC2"
+				config.Cpu = "3072"
+				config.Memory = "5000"
+
+				return config
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateConfiguration(tc.input())
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
+
+func TestVerifyConfigurationResources(t *testing.T) {
+	config := &TaskRunnerConfiguration{
+		Cluster:           "test-cluster",
+		TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task:1",
+	}
+
+	activeCluster := func(ctx context.Context, params *ecs.DescribeClustersInput, optFns ...func(*ecs.Options)) (*ecs.DescribeClustersOutput, error) {
+		return &ecs.DescribeClustersOutput{
+			Clusters: []types.Cluster{{ClusterName: aws.String("test-cluster"), Status: aws.String("ACTIVE")}},
+		}, nil
+	}
+	missingCluster := func(ctx context.Context, params *ecs.DescribeClustersInput, optFns ...func(*ecs.Options)) (*ecs.DescribeClustersOutput, error) {
+		return &ecs.DescribeClustersOutput{
+			Failures: []types.Failure{{Arn: aws.String("test-cluster"), Reason: aws.String("MISSING")}},
+		}, nil
+	}
+	runnerDefinition := func(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+		return &ecs.DescribeTaskDefinitionOutput{
+			TaskDefinition: &types.TaskDefinition{
+				ContainerDefinitions: []types.ContainerDefinition{{Name: aws.String("migrations-runner")}},
+			},
+		}, nil
+	}
+	sidecarOnlyDefinition := func(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+		return &ecs.DescribeTaskDefinitionOutput{
+			TaskDefinition: &types.TaskDefinition{
+				ContainerDefinitions: []types.ContainerDefinition{{Name: aws.String("datadog-agent")}},
+			},
+		}, nil
+	}
+	awsvpcDefinition := func(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+		return &ecs.DescribeTaskDefinitionOutput{
+			TaskDefinition: &types.TaskDefinition{
+				ContainerDefinitions: []types.ContainerDefinition{{Name: aws.String("migrations-runner")}},
+				NetworkMode:          types.NetworkModeAwsvpc,
+			},
+		}, nil
+	}
+	missingDefinition := func(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+		return nil, errors.New("Unable to describe task definition.")
+	}
+
+	tests := []struct {
+		name        string
+		client      mockECSClient
+		expectedErr string
+	}{
+		{
+			name:   "given an active cluster and a task definition with a migrations-runner container, it should pass",
+			client: mockECSClient{mockDescribeClusters: activeCluster, mockDescribeTaskDefinition: runnerDefinition},
+		},
+		{
+			name:        "given a task definition without a migrations-runner container, it should fail",
+			client:      mockECSClient{mockDescribeClusters: activeCluster, mockDescribeTaskDefinition: sidecarOnlyDefinition},
+			expectedErr: "task definition arn:aws:ecs:us-west-2:123456789012:task-definition/test-task:1 has no migrations-runner container",
+		},
+		{
+			name:        "given a task definition using the awsvpc network mode without subnets, it should fail",
+			client:      mockECSClient{mockDescribeClusters: activeCluster, mockDescribeTaskDefinition: awsvpcDefinition},
+			expectedErr: "task definition arn:aws:ecs:us-west-2:123456789012:task-definition/test-task:1 uses the awsvpc network mode, which requires subnetIds",
+		},
+		{
+			name:   "given a missing cluster and task definition, it should report both problems",
+			client: mockECSClient{mockDescribeClusters: missingCluster, mockDescribeTaskDefinition: missingDefinition},
+			expectedErr: "cluster test-cluster: MISSING\n" +
+				"failed to describe task definition arn:aws:ecs:us-west-2:123456789012:task-definition/test-task:1: Unable to describe task definition.",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := VerifyConfigurationResources(context.TODO(), tc.client, config)
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
+
+func TestVerifyResourceOverrides(t *testing.T) {
+	taskDefinitionArn := "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task:1"
+
+	client := mockECSClient{
+		mockDescribeTaskDefinition: func(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+			return &ecs.DescribeTaskDefinitionOutput{
+				TaskDefinition: &types.TaskDefinition{Cpu: aws.String("1024"), Memory: aws.String("2048")},
+			}, nil
+		},
+	}
+
+	tests := []struct {
+		name        string
+		launchType  string
+		cpu         string
+		memory      string
+		expectedErr string
+	}{
+		{
+			name:   "given memory Fargate supports with the task definition's cpu, it should pass",
+			memory: "4 GB",
+		},
+		{
+			name:        "given memory Fargate does not support with the task definition's cpu, it should fail",
+			memory:      "512",
+			expectedErr: "with the cpu of task definition " + taskDefinitionArn + ", memory 512 is not supported with cpu 1024 on Fargate, use 2048 to 8192 in increments of 1024",
+		},
+		{
+			name:        "given cpu Fargate does not support with the task definition's memory, it should fail",
+			cpu:         "4096",
+			expectedErr: "with the memory of task definition " + taskDefinitionArn + ", memory 2048 is not supported with cpu 4096 on Fargate, use 8192 to 30720 in increments of 1024",
+		},
+		{
+			name:   "given both cpu and memory, it should leave them to ValidateConfiguration",
+			cpu:    "4096",
+			memory: "512",
+		},
+		{
+			name:       "given cpu on EC2, it should pass",
+			launchType: "EC2",
+			cpu:        "4096",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &TaskRunnerConfiguration{TaskDefinitionArn: taskDefinitionArn, LaunchType: tc.launchType, Cpu: tc.cpu, Memory: tc.memory}
+
+			err := VerifyResourceOverrides(context.TODO(), client, config)
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
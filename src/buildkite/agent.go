@@ -3,6 +3,7 @@ package buildkite
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"strings"
@@ -13,6 +14,11 @@ import (
 
 type AgentAPI interface {
 	Annotate(ctx context.Context, message string, style string, annotationContext string) error
+	Redact(ctx context.Context, value string) error
+	SetMetaData(ctx context.Context, key string, value string) error
+	GetMetaData(ctx context.Context, key string) (string, error)
+	UploadArtifact(ctx context.Context, path string) error
+	UploadPipeline(ctx context.Context, pipeline string) error
 }
 
 type Agent struct {
@@ -22,8 +28,44 @@ func (a Agent) Annotate(ctx context.Context, message string, style string, annot
 	return execCmd(ctx, "buildkite-agent", &message, "annotate", "--style", style, "--context", annotationContext)
 }
 
+// Redact prevents the value from appearing in the job log, should it be printed by a later command or step
+func (a Agent) Redact(ctx context.Context, value string) error {
+	return execCmd(ctx, "buildkite-agent", &value, "redactor", "add")
+}
+
+// SetMetaData stores a value against the build, where it is visible to every job in the build and its retries
+func (a Agent) SetMetaData(ctx context.Context, key string, value string) error {
+	return execCmd(ctx, "buildkite-agent", &value, "meta-data", "set", key)
+}
+
+// GetMetaData retrieves a value stored against the build, or an empty string if the key has not been set
+func (a Agent) GetMetaData(ctx context.Context, key string) (string, error) {
+	var value strings.Builder
+
+	err := runCmd(ctx, "buildkite-agent", nil, &value, "meta-data", "get", key, "--default", "")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(value.String()), nil
+}
+
+// UploadArtifact uploads the file at path, relative to the working directory, as an artifact of the job
+func (a Agent) UploadArtifact(ctx context.Context, path string) error {
+	return execCmd(ctx, "buildkite-agent", nil, "artifact", "upload", path)
+}
+
+// UploadPipeline adds the steps in the pipeline YAML to the build, after the current step
+func (a Agent) UploadPipeline(ctx context.Context, pipeline string) error {
+	return execCmd(ctx, "buildkite-agent", &pipeline, "pipeline", "upload")
+}
+
 func execCmd(ctx context.Context, executableName string, stdin *string, args ...string) error {
-	Logf("Executing: %s %s\n", executableName, strings.Join(args, " "))
+	return runCmd(ctx, executableName, stdin, LoggerFrom(ctx), args...)
+}
+
+func runCmd(ctx context.Context, executableName string, stdin *string, stdout io.Writer, args ...string) error {
+	LoggerFrom(ctx).Logf("Executing: %s %s\n", executableName, strings.Join(args, " "))
 
 	cmd := osexec.CommandContext(ctx, executableName, args...)
 
@@ -31,7 +73,7 @@ func execCmd(ctx context.Context, executableName string, stdin *string, args ...
 		cmd.Stdin = strings.NewReader(*stdin)
 	}
 
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = stdout
 	cmd.Stderr = os.Stderr
 
 	// Relay incoming signals to the executing command.
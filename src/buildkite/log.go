@@ -1,31 +1,94 @@
 package buildkite
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"sync"
 )
 
+// Logger writes to the job log. Output for work that runs alongside other work can be written to its own Logger and
+// added to the job log once complete, so that it isn't interleaved with other output.
+type Logger struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+type loggerContextKey struct{}
+
+var stdout = NewLogger(os.Stdout)
+
+func NewLogger(out io.Writer) *Logger {
+	return &Logger{out: out}
+}
+
+// WithLogger returns a context whose logging is written to the logger
+func WithLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// LoggerFrom returns the logger for the context, which writes straight to the job log unless another was given
+func LoggerFrom(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*Logger); ok {
+		return logger
+	}
+
+	return stdout
+}
+
+func (l *Logger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.out.Write(p)
+}
+
+func (l *Logger) LogGroup(message string) {
+	_, _ = fmt.Fprintf(l, "--- %s\n", message)
+}
+
+func (l *Logger) LogGroupf(format string, a ...any) {
+	l.LogGroup(fmt.Sprintf(format, a...))
+}
+
+func (l *Logger) LogGroupClosed(message string) {
+	_, _ = fmt.Fprintf(l, "+++ %s\n", message)
+}
+
+func (l *Logger) Log(message string) {
+	_, _ = fmt.Fprintln(l, message)
+}
+
+func (l *Logger) Logf(format string, a ...any) {
+	_, _ = fmt.Fprintf(l, format, a...)
+}
+
+func (l *Logger) LogFailuref(format string, a ...any) {
+	// make sure the current group is expanded
+	_, _ = fmt.Fprintf(l, "^^^ +++\n"+format, a...)
+}
+
 func LogGroup(message string) {
-	fmt.Printf("--- %s\n", message)
+	stdout.LogGroup(message)
 }
 
 func LogGroupf(format string, a ...any) {
-	LogGroup(fmt.Sprintf(format, a...))
+	stdout.LogGroupf(format, a...)
 }
 
 func LogGroupClosed(message string) {
-	fmt.Printf("+++ %s\n", message)
+	stdout.LogGroupClosed(message)
 }
 
 func Log(message string) {
-	fmt.Println(message)
+	stdout.Log(message)
 }
 
 func Logf(format string, a ...any) {
-	fmt.Printf(format, a...)
+	stdout.Logf(format, a...)
 }
 
 func LogFailuref(format string, a ...any) {
-	// make sure the current group is expanded
-	fmt.Println("^^^ +++")
-	fmt.Printf(format, a...)
+	stdout.LogFailuref(format, a...)
 }
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
 	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
@@ -10,13 +12,18 @@ import (
 )
 
 func main() {
-	ctx := context.Background()
+	// The agent sends SIGTERM when the job is cancelled. Cancelling the context stops the plugin waiting on the task,
+	// allowing it to clean up according to the on-cancel option before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
 	fetcher := plugin.EnvironmentConfigFetcher{}
 	taskRunnerPlugin := plugin.TaskRunnerPlugin{}
 
 	err := taskRunnerPlugin.Run(ctx, fetcher, awsinternal.WaitForCompletion)
+
+	stop()
+
 	if err != nil {
 		buildkite.LogFailuref("plugin execution failed: %s\n", err.Error())
-		os.Exit(1)
+		os.Exit(plugin.ExitCode(err))
 	}
 }
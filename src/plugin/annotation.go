@@ -0,0 +1,214 @@
+package plugin
+
+import (
+	_ "embed"
+	"html"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// TaskOutput is what was seen of the task's output while it ran, for the summary of the task
+type TaskOutput struct {
+	// LogsURL links to the task's log stream, and is empty when the task's logs could not be found
+	LogsURL string
+	// LastLines are the last lines of the task's output, up to annotation-log-lines of them
+	LastLines []string
+	// ArtifactPaths are the artifacts the complete output was uploaded to, when upload-logs is set
+	ArtifactPaths []string
+}
+
+//go:embed templates/task-summary.md.tmpl
+var taskSummaryTemplateText string
+
+var taskSummaryTemplate = template.Must(template.New("task-summary").Funcs(template.FuncMap{
+	"join":  strings.Join,
+	"base":  filepath.Base,
+	"text":  markdownText,
+	"code":  markdownCode,
+	"fence": markdownFence,
+}).Parse(taskSummaryTemplateText))
+
+// minFenceLength is the fewest backticks a fenced code block can be delimited by
+const minFenceLength = 3
+
+// markdownText escapes text from the task, e.g. a stop reason, so it can't add HTML to the annotation or break out
+// of the table cell it is in
+func markdownText(value string) string {
+	return tableCellEscaper.Replace(html.EscapeString(value))
+}
+
+var tableCellEscaper = strings.NewReplacer("|", `\|`, "\r\n", "<br>", "\n", "<br>")
+
+// markdownCode renders the value as a code span that can be put in a table cell, delimited by more backticks than
+// any run of them in the value
+func markdownCode(value string) string {
+	value = codeSpanEscaper.Replace(value)
+	delimiter := strings.Repeat("`", longestBacktickRun(value)+1)
+
+	// a space keeps a backtick at either end of the value from being read as part of the delimiter
+	if strings.HasPrefix(value, "`") || strings.HasSuffix(value, "`") {
+		value = " " + value + " "
+	}
+
+	return delimiter + value + delimiter
+}
+
+var codeSpanEscaper = strings.NewReplacer("|", `\|`, "\r\n", " ", "\n", " ")
+
+// markdownFence returns the backticks to delimit a fenced code block of the lines with, more than any run of them in
+// the lines so that the output can't end the block early
+func markdownFence(lines []string) string {
+	longest := 0
+	for _, line := range lines {
+		longest = max(longest, longestBacktickRun(line))
+	}
+
+	return strings.Repeat("`", max(minFenceLength, longest+1))
+}
+
+func longestBacktickRun(value string) int {
+	longest, run := 0, 0
+
+	for _, r := range value {
+		if r != '`' {
+			run = 0
+			continue
+		}
+
+		run++
+		longest = max(longest, run)
+	}
+
+	return longest
+}
+
+// taskSummary is the data the task summary template is rendered with
+type taskSummary struct {
+	ParameterName  string
+	Stage          string
+	Rollback       bool
+	Plan           bool
+	Failure        error
+	Result         awsinternal.TaskResult
+	Runner         *awsinternal.ContainerResult
+	TaskID         string
+	TaskURL        string
+	TaskDefinition string
+	Duration       time.Duration
+	ExitCode       string
+	Containers     []containerSummary
+	LogsURL        string
+	LastLines      []string
+	ArtifactPaths  []string
+}
+
+type containerSummary struct {
+	Name      string
+	Essential bool
+	ExitCode  string
+	Reason    string
+}
+
+// renderTaskSummary describes the task and how it exited in Markdown, for an annotation
+func renderTaskSummary(config Config, result awsinternal.TaskResult, output TaskOutput, failure error) (string, error) {
+	summary := taskSummary{
+		ParameterName:  config.ParameterName,
+		Stage:          config.Stage,
+		Rollback:       config.Rollback,
+		Plan:           config.Plan,
+		Failure:        failure,
+		Result:         result,
+		TaskID:         awsinternal.TaskIDFromArn(result.TaskArn),
+		TaskURL:        awsinternal.TaskConsoleURL(result.TaskArn),
+		TaskDefinition: taskDefinitionRevision(result.TaskDefinitionArn),
+		Duration:       result.Duration().Round(time.Second),
+		ExitCode:       "none",
+		LogsURL:        output.LogsURL,
+		LastLines:      output.LastLines,
+		ArtifactPaths:  output.ArtifactPaths,
+	}
+
+	if runner, ok := result.Runner(); ok {
+		summary.Runner = &runner
+		summary.ExitCode = exitCodeLabel(runner)
+	}
+
+	for _, container := range result.Containers {
+		summary.Containers = append(summary.Containers, containerSummary{
+			Name:      container.Name,
+			Essential: container.Essential,
+			ExitCode:  exitCodeLabel(container),
+			Reason:    container.Reason,
+		})
+	}
+
+	var message strings.Builder
+
+	err := taskSummaryTemplate.Execute(&message, summary)
+
+	return message.String(), err
+}
+
+// taskDefinitionRevision returns the family and revision of a task definition ARN, e.g. "cool-service:12"
+func taskDefinitionRevision(taskDefinitionArn string) string {
+	if taskDefinitionArn == "" {
+		return ""
+	}
+
+	parsed, err := arn.Parse(taskDefinitionArn)
+	if err != nil {
+		return taskDefinitionArn
+	}
+
+	return strings.TrimPrefix(parsed.Resource, "task-definition/")
+}
+
+// taskAnnotationContext keeps the annotations for each task separate when tasks are run for several targets or stages
+func taskAnnotationContext(config Config) string {
+	annotationContext := "migrations-runner-task-" + config.ParameterName
+	if config.Stage != "" {
+		annotationContext += "-" + config.Stage
+	}
+
+	return annotationContext
+}
+
+// logTail keeps the last lines of the task's output
+type logTail struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+}
+
+func newLogTail(maxLines int) *logTail {
+	return &logTail{max: maxLines}
+}
+
+func (t *logTail) add(timestamp time.Time, message string) {
+	if t.max <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lines = append(t.lines, timestamp.Format(time.RFC3339)+" "+message)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+// Lines returns the lines kept, oldest first
+func (t *logTail) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]string(nil), t.lines...)
+}
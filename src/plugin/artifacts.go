@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+)
+
+// logArtifactDir is where the task's output is written, relative to the working directory of the job, before it is
+// uploaded. The artifacts keep this path.
+const logArtifactDir = "migrations-runner-logs"
+
+// artifactNameUnsafe matches the characters that are replaced to make a parameter name usable in a file name
+var artifactNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// logEntry is a line of the task's output in the JSON Lines artifact
+type logEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Message   string    `json:"message"`
+}
+
+// UploadLogArtifacts writes the complete output of the task to a plain text file and a JSON Lines file, and uploads
+// both as artifacts of the job. The paths of the artifacts that were uploaded are returned, so they can be linked to.
+// Failures are logged rather than returned, as the output was already shown in the job log.
+func (trp TaskRunnerPlugin) UploadLogArtifacts(ctx context.Context, bkAgent buildkite.AgentAPI, config Config, taskArn string, events []cloudwatchtypes.OutputLogEvent) []string {
+	log := buildkite.LoggerFrom(ctx)
+
+	paths, err := writeLogArtifacts(logArtifactBaseName(config, taskArn), events)
+	if err != nil {
+		log.LogFailuref("failed to write task output for upload, continuing... %v\n", err)
+		return nil
+	}
+
+	var uploaded []string
+
+	for _, path := range paths {
+		err := bkAgent.UploadArtifact(ctx, path)
+		if err != nil {
+			log.LogFailuref("failed to upload %s, continuing... %v\n", path, err)
+			continue
+		}
+
+		uploaded = append(uploaded, path)
+	}
+
+	return uploaded
+}
+
+// logArtifactBaseName names the artifacts for the target, stage and task, so the artifacts of each task a job runs
+// are kept apart
+func logArtifactBaseName(config Config, taskArn string) string {
+	name := strings.Trim(artifactNameUnsafe.ReplaceAllString(config.ParameterName, "-"), "-")
+	if config.Stage != "" {
+		name += "-" + artifactNameUnsafe.ReplaceAllString(config.Stage, "-")
+	}
+
+	return filepath.Join(logArtifactDir, name+"-"+awsinternal.TaskIDFromArn(taskArn))
+}
+
+// writeLogArtifacts writes the events as "<base>.log", in the same form as the job log, and "<base>.jsonl"
+func writeLogArtifacts(base string, events []cloudwatchtypes.OutputLogEvent) ([]string, error) {
+	err := os.MkdirAll(filepath.Dir(base), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	textPath := base + ".log"
+	jsonPath := base + ".jsonl"
+
+	err = writeLines(textPath, events, func(event cloudwatchtypes.OutputLogEvent) (string, error) {
+		return fmt.Sprintf("%s %s", eventTime(event).Format(time.RFC3339), aws.ToString(event.Message)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeLines(jsonPath, events, func(event cloudwatchtypes.OutputLogEvent) (string, error) {
+		line, err := json.Marshal(logEntry{Timestamp: eventTime(event), Message: aws.ToString(event.Message)})
+		return string(line), err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{textPath, jsonPath}, nil
+}
+
+func writeLines(path string, events []cloudwatchtypes.OutputLogEvent, format func(cloudwatchtypes.OutputLogEvent) (string, error)) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+
+	for _, event := range events {
+		line, err := format(event)
+		if err != nil {
+			return fmt.Errorf("failed to format log event for %s: %w", path, err)
+		}
+
+		_, err = writer.WriteString(line + "\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+func eventTime(event cloudwatchtypes.OutputLogEvent) time.Time {
+	return time.UnixMilli(aws.ToInt64(event.Timestamp)).UTC()
+}
@@ -0,0 +1,70 @@
+package plugin_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingUploadAgent fails to upload any artifact
+type failingUploadAgent struct {
+	RecordingBuildKiteAgent
+}
+
+func (m *failingUploadAgent) UploadArtifact(ctx context.Context, path string) error {
+	return errors.New("artifact upload failed")
+}
+
+func TestUploadLogArtifacts(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"
+	startedAt := time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+
+	events := []cloudwatchtypes.OutputLogEvent{
+		{Timestamp: aws.Int64(startedAt.UnixMilli()), Message: aws.String("== 20261017 AddWidgets: migrating")},
+		{Timestamp: aws.Int64(startedAt.Add(90 * time.Second).UnixMilli()), Message: aws.String(`say "done"`)},
+	}
+
+	t.Run("given the output of a task, it should upload it as text and JSON Lines", func(t *testing.T) {
+		t.Chdir(t.TempDir())
+
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		paths := trp.UploadLogArtifacts(context.TODO(), bkAgent, plugin.Config{ParameterName: "/cool-service/migrations", Stage: "backfill"}, taskArn, events)
+
+		expected := []string{
+			"migrations-runner-logs/cool-service-migrations-backfill-07cc583696bd44e0be450bff7314ddaf.log",
+			"migrations-runner-logs/cool-service-migrations-backfill-07cc583696bd44e0be450bff7314ddaf.jsonl",
+		}
+		assert.Equal(t, expected, paths)
+		assert.Equal(t, expected, bkAgent.artifacts)
+
+		text, err := os.ReadFile(expected[0])
+		require.NoError(t, err)
+		assert.Equal(t, "2026-10-17T03:00:00Z == 20261017 AddWidgets: migrating\n2026-10-17T03:01:30Z say \"done\"\n", string(text))
+
+		jsonLines, err := os.ReadFile(expected[1])
+		require.NoError(t, err)
+		assert.Equal(t, `{"timestamp":"2026-10-17T03:00:00Z","message":"== 20261017 AddWidgets: migrating"}`+"\n"+
+			`{"timestamp":"2026-10-17T03:01:30Z","message":"say \"done\""}`+"\n", string(jsonLines))
+	})
+
+	t.Run("given the upload fails, it should not return the artifacts", func(t *testing.T) {
+		t.Chdir(t.TempDir())
+
+		trp := plugin.TaskRunnerPlugin{}
+
+		paths := trp.UploadLogArtifacts(context.TODO(), &failingUploadAgent{}, plugin.Config{ParameterName: "test-parameter"}, taskArn, events)
+
+		assert.Empty(t, paths)
+	})
+}
@@ -1,13 +1,172 @@
 package plugin
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+
 	"github.com/kelseyhightower/envconfig"
 )
 
+// TaskAction is what the plugin does with a task that it has stopped waiting on
+type TaskAction string
+
+const (
+	// TaskActionStop stops the task straight away
+	TaskActionStop TaskAction = "stop"
+	// TaskActionLeaveRunning leaves the task to run to completion unobserved
+	TaskActionLeaveRunning TaskAction = "leave-running"
+	// TaskActionStopAfterGracePeriod gives the task the grace period to finish on its own before stopping it
+	TaskActionStopAfterGracePeriod TaskAction = "stop-after-grace-period"
+)
+
 type Config struct {
-	ParameterName string `required:"true"  split_words:"true"`
-	Command       string `required:"false" split_words:"true"`
-	TimeOut       int    `default:"2700"   split_words:"true"`
+	ParameterName         string     `required:"false"            split_words:"true"`
+	Command               string     `required:"false"            split_words:"true"`
+	TimeOut               int        `default:"2700"              split_words:"true"`
+	MaxLogLines           int        `default:"0"                 split_words:"true"`
+	OnTimeout             TaskAction `default:"leave-running"     split_words:"true"`
+	OnCancel              TaskAction `default:"leave-running"     split_words:"true"`
+	GracePeriod           int        `default:"60"                split_words:"true"`
+	DryRun                bool       `default:"false"             split_words:"true"`
+	VerifyResources       bool       `default:"false"             split_words:"true"`
+	ForceNewTask          bool       `default:"false"             split_words:"true"`
+	LockTable             string     `required:"false"            split_words:"true"`
+	LockWaitTimeout       int        `default:"600"               split_words:"true"`
+	MaxConcurrency        int        `default:"1"                 split_words:"true"`
+	LaunchType            string     `required:"false"            split_words:"true"`
+	PlatformVersion       string     `required:"false"            split_words:"true"`
+	AssignPublicIp        *bool      `required:"false"            split_words:"true"`
+	RunTaskRetryTimeout   int        `default:"300"               split_words:"true"`
+	PollInterval          int        `default:"5"                 split_words:"true"`
+	PendingTimeout        int        `default:"600"               split_words:"true"`
+	Cpu                   string     `required:"false"            split_words:"true"`
+	Memory                string     `required:"false"            split_words:"true"`
+	EphemeralStorage      int32      `required:"false"            split_words:"true"`
+	TaskRoleArn           string     `required:"false"            split_words:"true"`
+	ExecutionRoleArn      string     `required:"false"            split_words:"true"`
+	ContainerCpu          int32      `required:"false"            split_words:"true"`
+	ContainerMemory       int32      `required:"false"            split_words:"true"`
+	AnnotationLogLines    int        `default:"20"                split_words:"true"`
+	UploadLogs            bool       `default:"false"             split_words:"true"`
+	MetaDataPrefix        string     `default:"migrations-runner" split_words:"true"`
+	OnSuccessPipeline     string     `required:"false"            split_words:"true"`
+	OnFailurePipeline     string     `required:"false"            split_words:"true"`
+	RollbackCommand       string     `required:"false"            split_words:"true"`
+	RollbackOnFailure     bool       `default:"false"             split_words:"true"`
+	PlanCommand           string     `required:"false"            split_words:"true"`
+	RequireApproval       bool       `default:"false"             split_words:"true"`
+	AllowPlaintextSecrets bool       `default:"false"             split_words:"true"`
+
+	// ParameterNames are the parameters, or path prefixes, to run the task for, whether given as a string or a list
+	ParameterNames []string `ignored:"true"`
+
+	// CommandArgs is the command split into its arguments, whether it was given as a string or a list
+	CommandArgs []string `ignored:"true"`
+
+	// RollbackCommandArgs and PlanCommandArgs are the rollback and plan commands split into their arguments, as for
+	// CommandArgs
+	RollbackCommandArgs []string `ignored:"true"`
+	PlanCommandArgs     []string `ignored:"true"`
+
+	// Environment and Secrets are given as lists, or Environment as an object, which envconfig can't read from the
+	// variables Buildkite provides
+	Environment map[string]string `ignored:"true"`
+	Secrets     map[string]string `ignored:"true"`
+
+	// CapacityProviderStrategy and placement are given as lists of objects, which envconfig can't read
+	CapacityProviderStrategy []awsinternal.CapacityProviderStrategyItem `ignored:"true"`
+	PlacementConstraints     []awsinternal.PlacementConstraint          `ignored:"true"`
+	PlacementStrategy        []awsinternal.PlacementStrategy            `ignored:"true"`
+
+	// Stages are run in order, each as its own task. Stage is set to the name of the stage while it runs.
+	Stages []Stage `ignored:"true"`
+	Stage  string  `ignored:"true"`
+
+	// Rollback and Plan are set while the rollback or plan command runs, which each do as a stage of their own
+	Rollback bool `ignored:"true"`
+	Plan     bool `ignored:"true"`
+
+	// Snapshot is given as an object, whose fields envconfig reads as variables prefixed by SNAPSHOT
+	Snapshot SnapshotConfig `split_words:"true"`
+
+	// Build describes the job the plugin is running in, from the variables Buildkite sets for every job
+	Build BuildEnvironment `ignored:"true"`
+}
+
+// Stage is one step of a migration that is run as its own task, such as a schema change followed by a backfill
+type Stage struct {
+	Name        string
+	CommandArgs []string
+	TimeOut     int
+	// ContinueOnFailure allows the stages after this one to run, and the step to pass, when this stage fails
+	ContinueOnFailure bool
+}
+
+// SnapshotConfig is the snapshot of the database taken before the migrations are run, of either a DB instance or an
+// Aurora DB cluster. Name is a template for the snapshot identifier, given the values of snapshotNameData. Retain is
+// the number of snapshots taken by the plugin to keep, including the new one, where zero keeps them all.
+type SnapshotConfig struct {
+	DBInstanceIdentifier string `envconfig:"DB_INSTANCE_IDENTIFIER"`
+	DBClusterIdentifier  string `envconfig:"DB_CLUSTER_IDENTIFIER"`
+	Name                 string `envconfig:"NAME"                   default:"migrations-runner-{{ .Identifier }}-{{ .Timestamp }}"`
+	TimeOut              int    `envconfig:"TIMEOUT"                default:"3600"`
+	Retain               int    `envconfig:"RETAIN"                 default:"0"`
+}
+
+// Enabled is whether a snapshot is to be taken
+func (c SnapshotConfig) Enabled() bool {
+	return c.DBInstanceIdentifier != "" || c.DBClusterIdentifier != ""
+}
+
+// Target is the database to snapshot
+func (c SnapshotConfig) Target() awsinternal.SnapshotTarget {
+	return awsinternal.SnapshotTarget{DBInstanceIdentifier: c.DBInstanceIdentifier, DBClusterIdentifier: c.DBClusterIdentifier}
+}
+
+// BuildEnvironment is the subset of the Buildkite job environment the plugin uses
+type BuildEnvironment struct {
+	// StepID is shared by every attempt of the step, including retries
+	StepID   string `envconfig:"BUILDKITE_STEP_ID"`
+	BuildURL string `envconfig:"BUILDKITE_BUILD_URL"`
+	// BuildNumber is given to the name of a snapshot taken before the migrations
+	BuildNumber string `envconfig:"BUILDKITE_BUILD_NUMBER"`
+	// Label, Plugins, AgentQueue and Timeout describe the step, so it can be uploaded again once the migrations are
+	// approved
+	Label      string `envconfig:"BUILDKITE_LABEL"`
+	Plugins    string `envconfig:"BUILDKITE_PLUGINS"`
+	AgentQueue string `envconfig:"BUILDKITE_AGENT_META_DATA_QUEUE"`
+	Timeout    string `envconfig:"BUILDKITE_TIMEOUT"`
+	// BuildID, JobID and RetryCount identify this attempt of the step
+	BuildID    string `envconfig:"BUILDKITE_BUILD_ID"`
+	JobID      string `envconfig:"BUILDKITE_JOB_ID"`
+	RetryCount int    `envconfig:"BUILDKITE_RETRY_COUNT"`
+	// CancelGracePeriod is how long the agent waits for the plugin to exit once the job is cancelled, before killing it
+	CancelGracePeriod int `envconfig:"BUILDKITE_CANCEL_GRACE_PERIOD"`
+}
+
+const (
+	// defaultCancelGracePeriod is the agent's cancel-grace-period, used when the job doesn't give it
+	defaultCancelGracePeriod = 10
+	// cancelStopAllowance is the part of the agent's cancel grace period kept for stopping the task once the grace
+	// period given to it has passed
+	cancelStopAllowance = 5
+)
+
+// CancelGracePeriod is the grace period given to the task when the job is cancelled. It is capped to end well within
+// the agent's cancel grace period, as the agent kills the plugin once that has passed, before it could stop the task.
+func (c Config) CancelGracePeriod() int {
+	agentGracePeriod := c.Build.CancelGracePeriod
+	if agentGracePeriod <= 0 {
+		agentGracePeriod = defaultCancelGracePeriod
+	}
+
+	return max(min(c.GracePeriod, agentGracePeriod-cancelStopAllowance), 0)
 }
 
 type EnvironmentConfigFetcher struct {
@@ -15,6 +174,406 @@ type EnvironmentConfigFetcher struct {
 
 const pluginEnvironmentPrefix = "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER"
 
+var environmentNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 func (f EnvironmentConfigFetcher) Fetch(config *Config) error {
-	return envconfig.Process(pluginEnvironmentPrefix, config)
+	err := envconfig.Process(pluginEnvironmentPrefix, config)
+	if err != nil {
+		return err
+	}
+
+	config.ParameterNames = listFromEnvironment("PARAMETER_NAME")
+	if len(config.ParameterNames) == 0 {
+		if config.ParameterName == "" {
+			// matches the error envconfig gives for a missing required option, as parameter-name can also be a list
+			return fmt.Errorf("required key %s_PARAMETER_NAME missing value", pluginEnvironmentPrefix)
+		}
+
+		config.ParameterNames = []string{config.ParameterName}
+	}
+
+	if config.MaxConcurrency < 1 {
+		return fmt.Errorf("invalid value for max-concurrency: %d, expected at least 1", config.MaxConcurrency)
+	}
+
+	if config.MetaDataPrefix == "" {
+		return errors.New("meta-data-prefix cannot be empty")
+	}
+
+	if config.PollInterval < 1 {
+		return fmt.Errorf("invalid value for poll-interval: %d, expected at least 1", config.PollInterval)
+	}
+
+	err = envconfig.Process("", &config.Build)
+	if err != nil {
+		return err
+	}
+
+	// Every attempt of the step holds the lock under the step's ID, which would be shared by everyone without it
+	if config.LockTable != "" && config.Build.StepID == "" {
+		return errors.New("lock-table requires BUILDKITE_STEP_ID to identify the holder of the lock")
+	}
+
+	err = validateTaskAction("on-timeout", config.OnTimeout)
+	if err != nil {
+		return err
+	}
+
+	err = validateTaskAction("on-cancel", config.OnCancel)
+	if err != nil {
+		return err
+	}
+
+	config.CommandArgs, err = commandArgs(config.Command, listFromEnvironment("COMMAND"))
+	if err != nil {
+		return err
+	}
+
+	config.Environment, err = parseEnvironment(listFromEnvironment("ENVIRONMENT"))
+	if err != nil {
+		return err
+	}
+
+	for name, value := range mapFromEnvironment("ENVIRONMENT") {
+		config.Environment[name] = value
+	}
+
+	config.Secrets, err = parseSecrets(listFromEnvironment("SECRETS"))
+	if err != nil {
+		return err
+	}
+
+	for name := range config.Secrets {
+		if _, exists := config.Environment[name]; exists {
+			return fmt.Errorf("%s is configured as both an environment variable and a secret", name)
+		}
+	}
+
+	config.CapacityProviderStrategy, err = parseCapacityProviderStrategy(objectsFromEnvironment("CAPACITY_PROVIDER_STRATEGY", "CAPACITY_PROVIDER", "WEIGHT", "BASE"))
+	if err != nil {
+		return err
+	}
+
+	for _, constraint := range objectsFromEnvironment("PLACEMENT_CONSTRAINTS", "TYPE", "EXPRESSION") {
+		config.PlacementConstraints = append(config.PlacementConstraints, awsinternal.PlacementConstraint{Type: constraint["TYPE"], Expression: constraint["EXPRESSION"]})
+	}
+
+	for _, strategy := range objectsFromEnvironment("PLACEMENT_STRATEGY", "TYPE", "FIELD") {
+		config.PlacementStrategy = append(config.PlacementStrategy, awsinternal.PlacementStrategy{Type: strategy["TYPE"], Field: strategy["FIELD"]})
+	}
+
+	config.Stages, err = parseStages(config.TimeOut)
+	if err != nil {
+		return err
+	}
+
+	if len(config.Stages) > 0 && len(config.CommandArgs) > 0 {
+		return errors.New("command cannot be used with stages, give each stage its own command")
+	}
+
+	config.RollbackCommandArgs, err = commandArgs(config.RollbackCommand, listFromEnvironment("ROLLBACK_COMMAND"))
+	if err != nil {
+		return fmt.Errorf("invalid value for rollback-command: %w", err)
+	}
+
+	if config.RollbackOnFailure && len(config.RollbackCommandArgs) == 0 {
+		return errors.New("rollback-on-failure requires a rollback-command to run")
+	}
+
+	if len(config.Stages) > 0 && len(config.RollbackCommandArgs) > 0 {
+		return errors.New("rollback-command cannot be used with stages")
+	}
+
+	config.PlanCommandArgs, err = commandArgs(config.PlanCommand, listFromEnvironment("PLAN_COMMAND"))
+	if err != nil {
+		return fmt.Errorf("invalid value for plan-command: %w", err)
+	}
+
+	for _, stage := range config.Stages {
+		if stage.Name == planStageName && len(config.PlanCommandArgs) > 0 {
+			return fmt.Errorf("stage name %q is used by plan-command", planStageName)
+		}
+	}
+
+	// The step is uploaded again from its plugins to run the migrations once approved
+	if config.RequireApproval && config.Build.Plugins == "" {
+		return errors.New("require-approval can only be used in a Buildkite job")
+	}
+
+	for _, option := range []string{"APPROVAL_AGENTS", "APPROVAL_ENV"} {
+		if !config.RequireApproval && len(mapFromEnvironment(option)) > 0 {
+			return fmt.Errorf("%s can only be used with require-approval", strings.ToLower(strings.ReplaceAll(option, "_", "-")))
+		}
+	}
+
+	if config.Snapshot.Enabled() {
+		err := validateSnapshot(config.Snapshot)
+		if err != nil {
+			return fmt.Errorf("invalid value for snapshot: %w", err)
+		}
+	}
+
+	// The pipelines are uploaded once the task has run, but a missing file or unknown variable is found before running
+	// anything
+	pipelines := []struct{ option, path string }{
+		{"on-success-pipeline", config.OnSuccessPipeline},
+		{"on-failure-pipeline", config.OnFailurePipeline},
+	}
+
+	for _, pipeline := range pipelines {
+		if pipeline.path == "" {
+			continue
+		}
+
+		err := validatePipeline(pipeline.path)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", pipeline.option, err)
+		}
+	}
+
+	return nil
+}
+
+func validateSnapshot(snapshot SnapshotConfig) error {
+	if snapshot.DBInstanceIdentifier != "" && snapshot.DBClusterIdentifier != "" {
+		return errors.New("give either a db-instance-identifier or a db-cluster-identifier, not both")
+	}
+
+	if snapshot.TimeOut < 1 {
+		return fmt.Errorf("invalid timeout: %d, expected at least 1", snapshot.TimeOut)
+	}
+
+	if snapshot.Retain < 0 {
+		return fmt.Errorf("invalid retain: %d, expected 0 to keep every snapshot, or the number to keep", snapshot.Retain)
+	}
+
+	// The name is rendered when the snapshot is taken, but a template that fails to render is found before running
+	// anything
+	_, err := snapshotName(snapshot.Name, snapshotNameData{Identifier: "database", BuildNumber: "1", Timestamp: "20060102150405"})
+
+	return err
+}
+
+func validateTaskAction(option string, action TaskAction) error {
+	switch action {
+	case TaskActionStop, TaskActionLeaveRunning, TaskActionStopAfterGracePeriod:
+		return nil
+	default:
+		return fmt.Errorf("invalid value for %s: %q, expected one of %s, %s or %s", option, action, TaskActionStop, TaskActionLeaveRunning, TaskActionStopAfterGracePeriod)
+	}
+}
+
+// listFromEnvironment reads a list option, which Buildkite provides as one variable per element suffixed by its index
+func listFromEnvironment(name string) []string {
+	var values []string
+
+	for i := 0; ; i++ {
+		value, ok := os.LookupEnv(fmt.Sprintf("%s_%s_%d", pluginEnvironmentPrefix, name, i))
+		if !ok {
+			return values
+		}
+
+		values = append(values, value)
+	}
+}
+
+// mapFromEnvironment reads an object option of strings, which Buildkite provides as one variable per key suffixed by
+// the key, upper-cased. Suffixes starting with a digit are the elements of the option given as a list instead.
+func mapFromEnvironment(name string) map[string]string {
+	values := map[string]string{}
+	prefix := fmt.Sprintf("%s_%s_", pluginEnvironmentPrefix, name)
+
+	for _, variable := range os.Environ() {
+		key, value, _ := strings.Cut(variable, "=")
+
+		key, found := strings.CutPrefix(key, prefix)
+		if !found || !environmentNamePattern.MatchString(key) {
+			continue
+		}
+
+		values[key] = value
+	}
+
+	return values
+}
+
+// objectsFromEnvironment reads a list of objects, which Buildkite provides as one variable per field of each element
+// suffixed by its index and the field name. Only the given fields are read; fields that are not set are left out.
+func objectsFromEnvironment(name string, fields ...string) []map[string]string {
+	var objects []map[string]string
+
+	for i := 0; ; i++ {
+		object := map[string]string{}
+
+		for _, field := range fields {
+			value, ok := lookupOption(fmt.Sprintf("%s_%d_%s", name, i, field))
+			if ok {
+				object[field] = value
+			}
+		}
+
+		if len(object) == 0 {
+			return objects
+		}
+
+		objects = append(objects, object)
+	}
+}
+
+// parseCapacityProviderStrategy reads the capacity-provider, weight and base of each capacity provider
+func parseCapacityProviderStrategy(items []map[string]string) ([]awsinternal.CapacityProviderStrategyItem, error) {
+	var strategy []awsinternal.CapacityProviderStrategyItem
+
+	for _, item := range items {
+		strategyItem := awsinternal.CapacityProviderStrategyItem{CapacityProvider: item["CAPACITY_PROVIDER"]}
+
+		for _, field := range []struct {
+			name   string
+			target *int32
+		}{{"WEIGHT", &strategyItem.Weight}, {"BASE", &strategyItem.Base}} {
+			value, ok := item[field.name]
+			if !ok {
+				continue
+			}
+
+			parsed, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s for capacity provider %s: %q", strings.ToLower(field.name), strategyItem.CapacityProvider, value)
+			}
+
+			*field.target = int32(parsed)
+		}
+
+		strategy = append(strategy, strategyItem)
+	}
+
+	return strategy, nil
+}
+
+// commandArgs returns the command given as a list, or otherwise splits the command given as a string using shell
+// quoting rules
+func commandArgs(command string, commandList []string) ([]string, error) {
+	if len(commandList) > 0 {
+		return commandList, nil
+	}
+
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, fmt.Errorf("invalid command %q: %w", command, err)
+	}
+
+	return args, nil
+}
+
+// parseEnvironment reads `KEY=value` entries, and passes through the value of entries that are only `KEY` from the
+// job's environment. Variables to pass through that are not set in the job are left out.
+func parseEnvironment(entries []string) (map[string]string, error) {
+	environment := map[string]string{}
+
+	for _, entry := range entries {
+		name, value, hasValue := strings.Cut(entry, "=")
+		if !environmentNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid environment entry %q: %q is not a valid variable name", entry, name)
+		}
+
+		if !hasValue {
+			value, hasValue = os.LookupEnv(name)
+			if !hasValue {
+				continue
+			}
+		}
+
+		environment[name] = value
+	}
+
+	return environment, nil
+}
+
+// parseStages reads the stages, which Buildkite provides as variables for each field of each stage suffixed by its
+// index. Stages without a timeout use the default timeout.
+func parseStages(defaultTimeOut int) ([]Stage, error) {
+	var stages []Stage
+
+	names := map[string]bool{}
+
+	for i := 0; ; i++ {
+		prefix := fmt.Sprintf("STAGES_%d", i)
+
+		name, hasName := lookupOption(prefix + "_NAME")
+		command, hasCommand := lookupOption(prefix + "_COMMAND")
+		commandList := listFromEnvironment(prefix + "_COMMAND")
+		timeOut, hasTimeOut := lookupOption(prefix + "_TIMEOUT")
+		continueOnFailure, hasContinueOnFailure := lookupOption(prefix + "_CONTINUE_ON_FAILURE")
+
+		if !hasName && !hasCommand && len(commandList) == 0 && !hasTimeOut && !hasContinueOnFailure {
+			return stages, nil
+		}
+
+		if name == "" {
+			return nil, fmt.Errorf("stage %d has no name", i+1)
+		}
+
+		if names[name] {
+			return nil, fmt.Errorf("stage name %q is used more than once", name)
+		}
+
+		names[name] = true
+
+		stage := Stage{Name: name, TimeOut: defaultTimeOut}
+
+		args, err := commandArgs(command, commandList)
+		if err != nil {
+			return nil, fmt.Errorf("stage %s: %w", name, err)
+		}
+
+		if len(args) == 0 {
+			return nil, fmt.Errorf("stage %s has no command", name)
+		}
+
+		stage.CommandArgs = args
+
+		if hasTimeOut {
+			stage.TimeOut, err = strconv.Atoi(timeOut)
+			if err != nil || stage.TimeOut < 1 {
+				return nil, fmt.Errorf("stage %s: invalid timeout %q, expected a number of seconds", name, timeOut)
+			}
+		}
+
+		if hasContinueOnFailure {
+			stage.ContinueOnFailure, err = strconv.ParseBool(continueOnFailure)
+			if err != nil {
+				return nil, fmt.Errorf("stage %s: invalid value for continue-on-failure %q, expected true or false", name, continueOnFailure)
+			}
+		}
+
+		stages = append(stages, stage)
+	}
+}
+
+// lookupOption reads a single plugin option that envconfig can't, such as a field of an element of a list
+func lookupOption(name string) (string, bool) {
+	return os.LookupEnv(fmt.Sprintf("%s_%s", pluginEnvironmentPrefix, name))
+}
+
+// parseSecrets reads `KEY=arn` entries. Only ARNs are accepted so that secret values never appear in the pipeline
+// definition or the job log.
+func parseSecrets(entries []string) (map[string]string, error) {
+	secrets := map[string]string{}
+
+	for _, entry := range entries {
+		name, secretArn, _ := strings.Cut(entry, "=")
+		if !environmentNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid secret entry for %q: not a valid variable name", name)
+		}
+
+		err := awsinternal.ValidateSecretArn(secretArn)
+		if err != nil {
+			// the error could contain the secret if a value was given in place of the ARN, so don't include it
+			return nil, fmt.Errorf("invalid secret entry for %s: expected the ARN of an SSM parameter or Secrets Manager secret", name)
+		}
+
+		secrets[name] = secretArn
+	}
+
+	return secrets, nil
 }
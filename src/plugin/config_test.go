@@ -4,6 +4,7 @@ import (
 	"os"
 	"testing"
 
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
 	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
 
 	"github.com/stretchr/testify/assert"
@@ -61,6 +62,82 @@ func TestFailOnMissingRequiredEnvironment(t *testing.T) {
 	}
 }
 
+func TestFailOnInvalidTaskAction(t *testing.T) {
+	var config plugin.Config
+
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	tests := []struct {
+		name        string
+		key         string
+		expectedErr string
+	}{
+		{
+			name:        "variable ON_TIMEOUT set to an unknown action",
+			key:         "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ON_TIMEOUT",
+			expectedErr: `invalid value for on-timeout: "explode", expected one of stop, leave-running or stop-after-grace-period`,
+		},
+		{
+			name:        "variable ON_CANCEL set to an unknown action",
+			key:         "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ON_CANCEL",
+			expectedErr: `invalid value for on-cancel: "explode", expected one of stop, leave-running or stop-after-grace-period`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			unsetEnv(t, "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ON_TIMEOUT")
+			unsetEnv(t, "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ON_CANCEL")
+			t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+			t.Setenv(tc.key, "explode")
+
+			err := fetcher.Fetch(&config)
+			assert.EqualError(t, err, tc.expectedErr, "fetch should error on an invalid task action")
+		})
+	}
+}
+
+func TestCancelGracePeriod(t *testing.T) {
+	tests := []struct {
+		name              string
+		gracePeriod       int
+		cancelGracePeriod int
+		expected          int
+	}{
+		{
+			name:        "given the agent's default cancel grace period, it should leave time to stop the task",
+			gracePeriod: 60,
+			expected:    5,
+		},
+		{
+			name:              "given a longer cancel grace period, it should allow for it",
+			gracePeriod:       60,
+			cancelGracePeriod: 30,
+			expected:          25,
+		},
+		{
+			name:              "given a grace period within the cancel grace period, it should use it",
+			gracePeriod:       15,
+			cancelGracePeriod: 30,
+			expected:          15,
+		},
+		{
+			name:              "given a cancel grace period too short to wait at all, it should stop the task straight away",
+			gracePeriod:       60,
+			cancelGracePeriod: 3,
+			expected:          0,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := plugin.Config{GracePeriod: tc.gracePeriod, Build: plugin.BuildEnvironment{CancelGracePeriod: tc.cancelGracePeriod}}
+
+			assert.Equal(t, tc.expected, config.CancelGracePeriod())
+		})
+	}
+}
+
 func TestSucceedOnMissingOptionalEnvironment(t *testing.T) {
 	var config plugin.Config
 
@@ -118,6 +195,7 @@ func TestFetchConfigFromEnvironment(t *testing.T) {
 	require.NoError(t, err, "fetch should not error")
 	assert.Equal(t, "test-parameter", config.ParameterName, "fetched message should match environment")
 	assert.Equal(t, "hello-world", config.Command, "fetched script should match environment")
+	assert.Equal(t, []string{"hello-world"}, config.CommandArgs, "fetched script should be split into arguments")
 	assert.Equal(t, 600, config.TimeOut, "fetched timeout should match environment")
 
 	// test default value
@@ -126,6 +204,527 @@ func TestFetchConfigFromEnvironment(t *testing.T) {
 	err = fetcher.Fetch(&config)
 	require.NoError(t, err, "fetch should not error")
 	assert.Equal(t, 2700, config.TimeOut, "fetched timeout should match environment")
+	assert.Equal(t, plugin.TaskActionLeaveRunning, config.OnTimeout, "on-timeout should default to leaving the task running")
+	assert.Equal(t, plugin.TaskActionLeaveRunning, config.OnCancel, "on-cancel should default to leaving the task running")
+	assert.Equal(t, "migrations-runner", config.MetaDataPrefix, "meta-data-prefix should default to the plugin's name")
+
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_META_DATA_PREFIX", "")
+
+	err = fetcher.Fetch(&config)
+	assert.EqualError(t, err, "meta-data-prefix cannot be empty")
+}
+
+func TestFetchCommandFromEnvironment(t *testing.T) {
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	tests := []struct {
+		name           string
+		enabledEnvVars map[string]string
+		expected       []string
+	}{
+		{
+			name: "command given as a string with quoted arguments",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_COMMAND": "rake db:migrate VERSION='1 2'",
+			},
+			expected: []string{"rake", "db:migrate", "VERSION=1 2"},
+		},
+		{
+			name: "command given as a list",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_COMMAND_0": "rake",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_COMMAND_1": "db:migrate",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_COMMAND_2": "VERSION=1 2",
+			},
+			expected: []string{"rake", "db:migrate", "VERSION=1 2"},
+		},
+		{
+			name:           "command not given",
+			enabledEnvVars: map[string]string{},
+			expected:       nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			unsetEnv(t, "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_COMMAND")
+			unsetEnv(t, "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_COMMAND_0")
+			t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+
+			for key, value := range tc.enabledEnvVars {
+				t.Setenv(key, value)
+			}
+
+			var config plugin.Config
+
+			err := fetcher.Fetch(&config)
+			require.NoError(t, err, "fetch should not error")
+			assert.Equal(t, tc.expected, config.CommandArgs)
+		})
+	}
+
+	t.Run("command given as a string with unbalanced quotes", func(t *testing.T) {
+		unsetEnv(t, "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_COMMAND_0")
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_COMMAND", "rake db:migrate VERSION='1 2")
+
+		var config plugin.Config
+
+		err := fetcher.Fetch(&config)
+		assert.EqualError(t, err, `invalid command "rake db:migrate VERSION='1 2": command has an unterminated single quote`)
+	})
+}
+
+func TestFetchEnvironmentAndSecretsFromEnvironment(t *testing.T) {
+	var config plugin.Config
+
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ENVIRONMENT_0", "DRY_RUN=true")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ENVIRONMENT_1", "BUILDKITE_BUILD_NUMBER")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ENVIRONMENT_2", "NOT_SET_IN_THE_JOB")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SECRETS_0", "DATABASE_PASSWORD=arn:aws:ssm:us-west-2:123456789012:parameter/cool-service/database-password")
+	t.Setenv("BUILDKITE_BUILD_NUMBER", "1234")
+	unsetEnv(t, "NOT_SET_IN_THE_JOB")
+
+	err := fetcher.Fetch(&config)
+
+	require.NoError(t, err, "fetch should not error")
+	assert.Equal(t, map[string]string{"DRY_RUN": "true", "BUILDKITE_BUILD_NUMBER": "1234"}, config.Environment, "environment should include values and passed through variables")
+	assert.Equal(t, map[string]string{"DATABASE_PASSWORD": "arn:aws:ssm:us-west-2:123456789012:parameter/cool-service/database-password"}, config.Secrets, "secrets should be keyed by variable name")
+}
+
+func TestFetchEnvironmentMapFromEnvironment(t *testing.T) {
+	var config plugin.Config
+
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ENVIRONMENT_DRY_RUN", "true")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ENVIRONMENT_RAILS_ENV", "production")
+
+	err := fetcher.Fetch(&config)
+
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"DRY_RUN": "true", "RAILS_ENV": "production"}, config.Environment)
+}
+
+func TestFetchParameterNamesFromEnvironment(t *testing.T) {
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	t.Run("parameter name given as a string", func(t *testing.T) {
+		var config plugin.Config
+
+		unsetEnv(t, "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME_0")
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "/cool-service/migrations/")
+
+		err := fetcher.Fetch(&config)
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/cool-service/migrations/"}, config.ParameterNames)
+		assert.Equal(t, 1, config.MaxConcurrency, "targets should be run one at a time by default")
+	})
+
+	t.Run("parameter names given as a list", func(t *testing.T) {
+		var config plugin.Config
+
+		unsetEnv(t, "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME")
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME_0", "/cool-service/shard-1/migrations")
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME_1", "/cool-service/shard-2/migrations")
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_MAX_CONCURRENCY", "2")
+
+		err := fetcher.Fetch(&config)
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/cool-service/shard-1/migrations", "/cool-service/shard-2/migrations"}, config.ParameterNames)
+		assert.Equal(t, 2, config.MaxConcurrency)
+	})
+
+	t.Run("max concurrency below one", func(t *testing.T) {
+		var config plugin.Config
+
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "/cool-service/migrations/")
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_MAX_CONCURRENCY", "0")
+
+		err := fetcher.Fetch(&config)
+		assert.EqualError(t, err, "invalid value for max-concurrency: 0, expected at least 1")
+	})
+}
+
+func TestFetchStagesFromEnvironment(t *testing.T) {
+	var config plugin.Config
+
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	unsetEnv(t, "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_COMMAND")
+	unsetEnv(t, "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_TIME_OUT")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_NAME", "schema")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_COMMAND", "bin/rails db:migrate")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_1_NAME", "backfill")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_1_COMMAND_0", "bin/backfill")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_1_COMMAND_1", "--all")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_1_TIMEOUT", "7200")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_1_CONTINUE_ON_FAILURE", "true")
+
+	err := fetcher.Fetch(&config)
+
+	require.NoError(t, err)
+	assert.Equal(t, []plugin.Stage{
+		{Name: "schema", CommandArgs: []string{"bin/rails", "db:migrate"}, TimeOut: 2700},
+		{Name: "backfill", CommandArgs: []string{"bin/backfill", "--all"}, TimeOut: 7200, ContinueOnFailure: true},
+	}, config.Stages)
+}
+
+func TestFetchLaunchOptionsFromEnvironment(t *testing.T) {
+	var config plugin.Config
+
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_CAPACITY_PROVIDER_STRATEGY_0_CAPACITY_PROVIDER", "FARGATE")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_CAPACITY_PROVIDER_STRATEGY_0_BASE", "1")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_CAPACITY_PROVIDER_STRATEGY_1_CAPACITY_PROVIDER", "FARGATE_SPOT")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_CAPACITY_PROVIDER_STRATEGY_1_WEIGHT", "3")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PLATFORM_VERSION", "1.4.0")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ASSIGN_PUBLIC_IP", "false")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PLACEMENT_CONSTRAINTS_0_TYPE", "memberOf")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PLACEMENT_CONSTRAINTS_0_EXPRESSION", "attribute:ecs.instance-type =~ t3.*")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PLACEMENT_STRATEGY_0_TYPE", "spread")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PLACEMENT_STRATEGY_0_FIELD", "attribute:ecs.availability-zone")
+
+	err := fetcher.Fetch(&config)
+
+	require.NoError(t, err)
+	assert.Empty(t, config.LaunchType)
+	assert.Equal(t, []awsinternal.CapacityProviderStrategyItem{
+		{CapacityProvider: "FARGATE", Base: 1},
+		{CapacityProvider: "FARGATE_SPOT", Weight: 3},
+	}, config.CapacityProviderStrategy)
+	assert.Equal(t, "1.4.0", config.PlatformVersion)
+	require.NotNil(t, config.AssignPublicIp)
+	assert.False(t, *config.AssignPublicIp)
+	assert.Equal(t, []awsinternal.PlacementConstraint{{Type: "memberOf", Expression: "attribute:ecs.instance-type =~ t3.*"}}, config.PlacementConstraints)
+	assert.Equal(t, []awsinternal.PlacementStrategy{{Type: "spread", Field: "attribute:ecs.availability-zone"}}, config.PlacementStrategy)
+}
+
+func TestFetchResourcesFromEnvironment(t *testing.T) {
+	var config plugin.Config
+
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_CPU", "2 vCPU")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_MEMORY", "16384")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_EPHEMERAL_STORAGE", "100")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_TASK_ROLE_ARN", "arn:aws:iam::123456789012:role/backfill")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_EXECUTION_ROLE_ARN", "arn:aws:iam::123456789012:role/backfill-execution")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_CONTAINER_CPU", "1536")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_CONTAINER_MEMORY", "12288")
+
+	err := fetcher.Fetch(&config)
+
+	require.NoError(t, err)
+	assert.Equal(t, "2 vCPU", config.Cpu)
+	assert.Equal(t, "16384", config.Memory)
+	assert.Equal(t, int32(100), config.EphemeralStorage)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/backfill", config.TaskRoleArn)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/backfill-execution", config.ExecutionRoleArn)
+	assert.Equal(t, int32(1536), config.ContainerCpu)
+	assert.Equal(t, int32(12288), config.ContainerMemory)
+}
+
+func TestFailOnInvalidCapacityProviderWeight(t *testing.T) {
+	var config plugin.Config
+
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_CAPACITY_PROVIDER_STRATEGY_0_CAPACITY_PROVIDER", "FARGATE_SPOT")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_CAPACITY_PROVIDER_STRATEGY_0_WEIGHT", "lots")
+
+	err := fetcher.Fetch(&config)
+
+	require.EqualError(t, err, `invalid weight for capacity provider FARGATE_SPOT: "lots"`)
+}
+
+func TestFailOnLockTableWithoutStep(t *testing.T) {
+	var config plugin.Config
+
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	unsetEnv(t, "BUILDKITE_STEP_ID")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_LOCK_TABLE", "migrations-locks")
+
+	err := fetcher.Fetch(&config)
+
+	require.EqualError(t, err, "lock-table requires BUILDKITE_STEP_ID to identify the holder of the lock")
+}
+
+func TestFailOnInvalidStages(t *testing.T) {
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	tests := []struct {
+		name           string
+		enabledEnvVars map[string]string
+		expectedErr    string
+	}{
+		{
+			name: "a stage without a name",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_COMMAND": "bin/rails db:migrate",
+			},
+			expectedErr: "stage 1 has no name",
+		},
+		{
+			name: "a stage without a command",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_NAME": "schema",
+			},
+			expectedErr: "stage schema has no command",
+		},
+		{
+			name: "two stages with the same name",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_NAME":    "schema",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_COMMAND": "bin/rails db:migrate",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_1_NAME":    "schema",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_1_COMMAND": "bin/verify",
+			},
+			expectedErr: `stage name "schema" is used more than once`,
+		},
+		{
+			name: "a stage with an invalid timeout",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_NAME":    "schema",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_COMMAND": "bin/rails db:migrate",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_TIMEOUT": "soon",
+			},
+			expectedErr: `stage schema: invalid timeout "soon", expected a number of seconds`,
+		},
+		{
+			name: "stages alongside a command",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_COMMAND":          "bin/rails db:migrate",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_NAME":    "schema",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_COMMAND": "bin/rails db:migrate",
+			},
+			expectedErr: "command cannot be used with stages, give each stage its own command",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var config plugin.Config
+
+			unsetEnv(t, "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_COMMAND")
+			t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+
+			for key, value := range tc.enabledEnvVars {
+				t.Setenv(key, value)
+			}
+
+			err := fetcher.Fetch(&config)
+			assert.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestFetchRollbackFromEnvironment(t *testing.T) {
+	var config plugin.Config
+
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ROLLBACK_COMMAND", "bin/rails db:rollback STEP=1")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ROLLBACK_ON_FAILURE", "true")
+
+	err := fetcher.Fetch(&config)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bin/rails", "db:rollback", "STEP=1"}, config.RollbackCommandArgs)
+	assert.True(t, config.RollbackOnFailure)
+}
+
+func TestFailOnInvalidRollback(t *testing.T) {
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	tests := []struct {
+		name           string
+		enabledEnvVars map[string]string
+		expectedErr    string
+	}{
+		{
+			name: "rollback on failure without a rollback command",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ROLLBACK_ON_FAILURE": "true",
+			},
+			expectedErr: "rollback-on-failure requires a rollback-command to run",
+		},
+		{
+			name: "a rollback command with unbalanced quotes",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ROLLBACK_COMMAND": "bin/rails 'db:rollback",
+			},
+			expectedErr: `invalid value for rollback-command: invalid command "bin/rails 'db:rollback": command has an unterminated single quote`,
+		},
+		{
+			name: "a rollback command alongside stages",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ROLLBACK_COMMAND": "bin/rails db:rollback",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_NAME":    "schema",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_COMMAND": "bin/rails db:migrate",
+			},
+			expectedErr: "rollback-command cannot be used with stages",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var config plugin.Config
+
+			t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+
+			for key, value := range tc.enabledEnvVars {
+				t.Setenv(key, value)
+			}
+
+			err := fetcher.Fetch(&config)
+			assert.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestFetchSnapshotFromEnvironment(t *testing.T) {
+	var config plugin.Config
+
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SNAPSHOT_DB_CLUSTER_IDENTIFIER", "cool-service-cluster")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SNAPSHOT_RETAIN", "5")
+	t.Setenv("BUILDKITE_BUILD_NUMBER", "42")
+
+	err := fetcher.Fetch(&config)
+
+	require.NoError(t, err)
+	assert.True(t, config.Snapshot.Enabled())
+	assert.Equal(t, "cool-service-cluster", config.Snapshot.DBClusterIdentifier)
+	assert.Equal(t, "migrations-runner-{{ .Identifier }}-{{ .Timestamp }}", config.Snapshot.Name)
+	assert.Equal(t, 3600, config.Snapshot.TimeOut)
+	assert.Equal(t, 5, config.Snapshot.Retain)
+	assert.Equal(t, "42", config.Build.BuildNumber)
+}
+
+func TestFailOnInvalidSnapshot(t *testing.T) {
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	tests := []struct {
+		name           string
+		enabledEnvVars map[string]string
+		expectedErr    string
+	}{
+		{
+			name: "both a DB instance and a cluster",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SNAPSHOT_DB_INSTANCE_IDENTIFIER": "cool-service-db",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SNAPSHOT_DB_CLUSTER_IDENTIFIER":  "cool-service-cluster",
+			},
+			expectedErr: "invalid value for snapshot: give either a db-instance-identifier or a db-cluster-identifier, not both",
+		},
+		{
+			name: "a negative number of snapshots to retain",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SNAPSHOT_DB_INSTANCE_IDENTIFIER": "cool-service-db",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SNAPSHOT_RETAIN":                 "-1",
+			},
+			expectedErr: "invalid value for snapshot: invalid retain: -1, expected 0 to keep every snapshot, or the number to keep",
+		},
+		{
+			name: "a name template with an unknown value",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SNAPSHOT_DB_INSTANCE_IDENTIFIER": "cool-service-db",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SNAPSHOT_NAME":                   "{{ .Branch }}",
+			},
+			expectedErr: `invalid value for snapshot: invalid name template: template: snapshot:1:3: executing "snapshot" at <.Branch>: can't evaluate field Branch in type plugin.snapshotNameData`,
+		},
+		{
+			name: "a name template without a valid character",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SNAPSHOT_DB_INSTANCE_IDENTIFIER": "cool-service-db",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SNAPSHOT_NAME":                   "__",
+			},
+			expectedErr: `invalid value for snapshot: name template "__" does not give a valid snapshot identifier`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var config plugin.Config
+
+			t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+
+			for key, value := range tc.enabledEnvVars {
+				t.Setenv(key, value)
+			}
+
+			err := fetcher.Fetch(&config)
+			assert.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestFailOnInvalidEnvironmentAndSecrets(t *testing.T) {
+	var config plugin.Config
+
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	tests := []struct {
+		name           string
+		enabledEnvVars map[string]string
+		expectedErr    string
+	}{
+		{
+			name: "an environment variable with an invalid name",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ENVIRONMENT_0": "NOT-VALID=true",
+			},
+			expectedErr: `invalid environment entry "NOT-VALID=true": "NOT-VALID" is not a valid variable name`,
+		},
+		{
+			name: "a secret given as a value rather than an ARN",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SECRETS_0": "DATABASE_PASSWORD=hunter2",
+			},
+			expectedErr: "invalid secret entry for DATABASE_PASSWORD: expected the ARN of an SSM parameter or Secrets Manager secret",
+		},
+		{
+			name: "a variable configured as both an environment variable and a secret",
+			enabledEnvVars: map[string]string{
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ENVIRONMENT_0": "DATABASE_PASSWORD=hunter2",
+				"BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SECRETS_0":     "DATABASE_PASSWORD=arn:aws:ssm:us-west-2:123456789012:parameter/cool-service/database-password",
+			},
+			expectedErr: "DATABASE_PASSWORD is configured as both an environment variable and a secret",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			unsetEnv(t, "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ENVIRONMENT_0")
+			unsetEnv(t, "BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_SECRETS_0")
+			t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+
+			for key, value := range tc.enabledEnvVars {
+				t.Setenv(key, value)
+			}
+
+			err := fetcher.Fetch(&config)
+			assert.EqualError(t, err, tc.expectedErr)
+			assert.NotContains(t, err.Error(), "hunter2", "errors should never contain secret values")
+		})
+	}
 }
 
 func unsetEnv(t *testing.T, key string) {
@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// redactedSecretFormat stands in for the value of a secret wherever the task that would be run is shown
+const redactedSecretFormat = "[secret from %s]"
+
+// DryRun shows the task that would be run for the configuration, along with the details of its task definition,
+// without submitting it. It fails if the task definition cannot be used by the plugin.
+func (trp TaskRunnerPlugin) DryRun(ctx context.Context, ecsClient awsinternal.EcsClientAPI, bkAgent buildkite.AgentAPI, configuration *awsinternal.TaskRunnerConfiguration, annotationContext string) error {
+	log := buildkite.LoggerFrom(ctx)
+
+	definition, err := awsinternal.DescribeTaskDefinition(ctx, ecsClient, configuration.TaskDefinitionArn)
+	if err != nil {
+		return fmt.Errorf("failed to describe task definition: %w", err)
+	}
+
+	input, err := json.MarshalIndent(awsinternal.RunTaskInputForConfig(redactSecrets(configuration)), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to render task input: %w", err)
+	}
+
+	log.LogGroup(":mag: Dry run: the task that would be run")
+	log.Log(string(input))
+
+	summary, problem := summarizeTaskDefinition(definition)
+	log.Log(summary)
+
+	style := "info"
+	if problem != nil {
+		style = "error"
+	}
+
+	message := fmt.Sprintf("**Dry run**: no task was submitted.\n\n%s\n<details><summary>ecs:RunTask input</summary>\n\n```json\n%s\n```\n\n</details>\n", summary, input)
+
+	err = bkAgent.Annotate(ctx, message, style, annotationContext)
+	if err != nil {
+		return fmt.Errorf("failed to annotate buildkite with dry run: %w", err)
+	}
+
+	if problem != nil {
+		return &ConfigInvalidError{Err: problem}
+	}
+
+	log.Log("Dry run complete, no task was submitted")
+
+	return nil
+}
+
+// redactSecrets returns a copy of the configuration with the values of its secrets replaced by where they come from
+func redactSecrets(configuration *awsinternal.TaskRunnerConfiguration) *awsinternal.TaskRunnerConfiguration {
+	redacted := *configuration
+	redacted.SecretValues = make(map[string]string, len(configuration.Secrets))
+
+	for name, secretArn := range configuration.Secrets {
+		redacted.SecretValues[name] = fmt.Sprintf(redactedSecretFormat, secretArn)
+	}
+
+	return &redacted
+}
+
+// summarizeTaskDefinition describes the containers of the task definition in Markdown, returning an error alongside
+// the summary if the definition has no migrations-runner container for the plugin to run
+func summarizeTaskDefinition(definition *types.TaskDefinition) (string, error) {
+	var (
+		summary strings.Builder
+		problem error
+	)
+
+	fmt.Fprintf(&summary, "Task definition: `%s:%d`\n\n", aws.ToString(definition.Family), definition.Revision)
+	summary.WriteString("| Container | Image | Essential | Log group | Log stream prefix |\n")
+	summary.WriteString("| --- | --- | --- | --- | --- |\n")
+
+	hasRunner := false
+
+	for _, container := range definition.ContainerDefinitions {
+		var logGroup, streamPrefix string
+		if container.LogConfiguration != nil {
+			logGroup = container.LogConfiguration.Options["awslogs-group"]
+			streamPrefix = container.LogConfiguration.Options["awslogs-stream-prefix"]
+		}
+
+		// containers are essential unless the task definition says otherwise
+		essential := container.Essential == nil || *container.Essential
+
+		fmt.Fprintf(&summary, "| %s | %s | %t | %s | %s |\n", aws.ToString(container.Name), aws.ToString(container.Image), essential, logGroup, streamPrefix)
+
+		if aws.ToString(container.Name) == awsinternal.MigrationsRunnerContainerName {
+			hasRunner = true
+
+			if logGroup == "" || streamPrefix == "" {
+				summary.WriteString("\n:warning: The migrations-runner container does not have `awslogs` logging configured, so its output will not be shown.\n")
+			}
+		}
+	}
+
+	if !hasRunner {
+		problem = fmt.Errorf("task definition %s has no %s container", aws.ToString(definition.TaskDefinitionArn), awsinternal.MigrationsRunnerContainerName)
+		fmt.Fprintf(&summary, "\n:x: %s\n", problem)
+	}
+
+	return summary.String(), problem
+}
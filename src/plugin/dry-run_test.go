@@ -0,0 +1,82 @@
+package plugin_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRun(t *testing.T) {
+	configuration := &awsinternal.TaskRunnerConfiguration{
+		Cluster:           "test-cluster",
+		Command:           []string{"bin/migrate"},
+		Secrets:           map[string]string{"DATABASE_PASSWORD": "arn:aws:ssm:us-west-2:123456789012:parameter/cool-service/database-password"},
+		SecretValues:      map[string]string{"DATABASE_PASSWORD": "hunter2"},
+		SecurityGroupIds:  []string{"sg-123456"},
+		SubnetIds:         []string{"subnet-123456"},
+		TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task:1",
+	}
+
+	runnerContainer := types.ContainerDefinition{
+		Name:  aws.String("migrations-runner"),
+		Image: aws.String("123456789012.dkr.ecr.us-west-2.amazonaws.com/cool-service:abc123"),
+		LogConfiguration: &types.LogConfiguration{
+			Options: map[string]string{
+				"awslogs-group":         "test-group",
+				"awslogs-stream-prefix": "test-stream",
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		containers  []types.ContainerDefinition
+		expectedErr string
+	}{
+		{
+			name:       "given a task definition with a migrations-runner container, it should describe the task without error",
+			containers: []types.ContainerDefinition{runnerContainer},
+		},
+		{
+			name: "given a task definition without a migrations-runner container, it should fail as a configuration error",
+			containers: []types.ContainerDefinition{
+				{Name: aws.String("gateway"), Image: aws.String("nginx")},
+			},
+			expectedErr: "task definition arn:aws:ecs:us-west-2:123456789012:task-definition/test-task:1 has no migrations-runner container",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ecsClient := &MockECSClient{
+				taskDefinition: &types.TaskDefinition{
+					TaskDefinitionArn:    aws.String(configuration.TaskDefinitionArn),
+					Family:               aws.String("test-task"),
+					Revision:             1,
+					ContainerDefinitions: tc.containers,
+				},
+			}
+			bkAgent := &RecordingBuildKiteAgent{}
+			plugin := plugin.TaskRunnerPlugin{}
+
+			err := plugin.DryRun(context.TODO(), ecsClient, bkAgent, configuration, "migrations-runner")
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedErr)
+			}
+
+			require.Len(t, bkAgent.annotations, 1)
+			assert.Contains(t, bkAgent.annotations[0], "test-task:1")
+			assert.Contains(t, bkAgent.annotations[0], `"bin/migrate"`)
+			assert.Contains(t, bkAgent.annotations[0], "[secret from arn:aws:ssm:us-west-2:123456789012:parameter/cool-service/database-password]")
+			assert.NotContains(t, bkAgent.annotations[0], "hunter2", "secret values should never be shown")
+		})
+	}
+}
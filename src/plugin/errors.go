@@ -0,0 +1,119 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+)
+
+// Exit codes for each class of failure, allowing pipelines to react to them differently with `soft_fail`. 2 is not
+// used, as the hook exits with it when the plugin can't be downloaded for the agent's architecture.
+const (
+	ExitCodeFailure             = 1
+	ExitCodePermissionDenied    = 3
+	ExitCodeCapacityUnavailable = 4
+	ExitCodeTaskFailedToStart   = 5
+	ExitCodeNonZeroExit         = 6
+	ExitCodeTimeout             = 7
+	ExitCodeLockUnavailable     = 8
+	ExitCodeConfigInvalid       = 9
+)
+
+// ConfigInvalidError is returned when the plugin or task configuration cannot be used to run a task
+type ConfigInvalidError struct {
+	Err error
+}
+
+func (e *ConfigInvalidError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConfigInvalidError) Unwrap() error {
+	return e.Err
+}
+
+// LockUnavailableError is returned when another build held the migration lock for longer than the plugin would wait
+type LockUnavailableError struct {
+	Key         string
+	Holder      string
+	WaitTimeout time.Duration
+}
+
+func (e *LockUnavailableError) Error() string {
+	return fmt.Sprintf("lock for %s is held by %s, gave up waiting after %s", e.Key, e.Holder, e.WaitTimeout)
+}
+
+// TaskLeftRunningError is returned when the plugin stopped waiting for a task that is still running, either because it
+// was configured to leave it running or because it could not be stopped
+type TaskLeftRunningError struct {
+	TaskArn string
+	// RunFor is how much longer the task is allowed to run, for the lock to be kept until it has finished
+	RunFor time.Duration
+	Err    error
+}
+
+// taskLeftRunning is the error for a task left running. It is allowed another timeout and grace period from now, the
+// longest the plugin would have let it run had it been started now.
+func taskLeftRunning(taskArn string, config Config, err error) *TaskLeftRunningError {
+	return &TaskLeftRunningError{
+		TaskArn: taskArn,
+		RunFor:  time.Duration(config.TimeOut+config.GracePeriod) * time.Second,
+		Err:     err,
+	}
+}
+
+func (e *TaskLeftRunningError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TaskLeftRunningError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the process exit code for the class of error that caused the plugin to fail
+func ExitCode(err error) int {
+	var (
+		configInvalid       *ConfigInvalidError
+		permissionDenied    *awsinternal.PermissionDeniedError
+		capacityUnavailable *awsinternal.CapacityUnavailableError
+		taskFailedToStart   *awsinternal.TaskFailedToStartError
+		stuckPending        *awsinternal.StuckPendingError
+		nonZeroExit         *awsinternal.NonZeroExitError
+		timeout             *awsinternal.TimeoutError
+		lockUnavailable     *LockUnavailableError
+	)
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &configInvalid):
+		return ExitCodeConfigInvalid
+	case errors.As(err, &permissionDenied):
+		return ExitCodePermissionDenied
+	case errors.As(err, &capacityUnavailable):
+		return ExitCodeCapacityUnavailable
+	case errors.As(err, &taskFailedToStart), errors.As(err, &stuckPending):
+		return ExitCodeTaskFailedToStart
+	case errors.As(err, &nonZeroExit):
+		return ExitCodeNonZeroExit
+	case errors.As(err, &timeout):
+		return ExitCodeTimeout
+	case errors.As(err, &lockUnavailable):
+		return ExitCodeLockUnavailable
+	default:
+		return ExitCodeFailure
+	}
+}
+
+// isMalformedConfiguration reports whether the task configuration could not be parsed
+func isMalformedConfiguration(err error) bool {
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
@@ -0,0 +1,76 @@
+package plugin_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    error
+		expected int
+	}{
+		{
+			name:     "given no error, it should exit successfully",
+			input:    nil,
+			expected: 0,
+		},
+		{
+			name:     "given an unclassified error, it should exit with the generic failure code",
+			input:    errors.New("generic error"),
+			expected: plugin.ExitCodeFailure,
+		},
+		{
+			name:     "given a wrapped ConfigInvalidError, it should exit with the config invalid code",
+			input:    fmt.Errorf("wrapped: %w", &plugin.ConfigInvalidError{Err: errors.New("required key missing")}),
+			expected: plugin.ExitCodeConfigInvalid,
+		},
+		{
+			name:     "given a wrapped PermissionDeniedError, it should exit with the permission denied code",
+			input:    fmt.Errorf("wrapped: %w", &awsinternal.PermissionDeniedError{Operation: "ecs:RunTask", Err: errors.New("denied")}),
+			expected: plugin.ExitCodePermissionDenied,
+		},
+		{
+			name:     "given a CapacityUnavailableError, it should exit with the capacity unavailable code",
+			input:    &awsinternal.CapacityUnavailableError{Reason: "RESOURCE:ENI"},
+			expected: plugin.ExitCodeCapacityUnavailable,
+		},
+		{
+			name:     "given a TaskFailedToStartError, it should exit with the failed to start code",
+			input:    &awsinternal.TaskFailedToStartError{Reason: "CannotPullContainerError"},
+			expected: plugin.ExitCodeTaskFailedToStart,
+		},
+		{
+			name:     "given a StuckPendingError, it should exit with the failed to start code",
+			input:    fmt.Errorf("task did not start: %w", &awsinternal.StuckPendingError{Status: "PENDING"}),
+			expected: plugin.ExitCodeTaskFailedToStart,
+		},
+		{
+			name:     "given a NonZeroExitError, it should exit with the non-zero exit code",
+			input:    fmt.Errorf("wrapped: %w", &awsinternal.NonZeroExitError{Container: "migrations-runner", ExitCode: 1}),
+			expected: plugin.ExitCodeNonZeroExit,
+		},
+		{
+			name:     "given a TimeoutError, it should exit with the timeout code",
+			input:    fmt.Errorf("wrapped: %w", &awsinternal.TimeoutError{TaskArn: "test-task-arn"}),
+			expected: plugin.ExitCodeTimeout,
+		},
+		{
+			name:     "given a LockUnavailableError, it should exit with the lock unavailable code",
+			input:    &plugin.LockUnavailableError{Key: "/cool-service/migrations", Holder: "step step-2"},
+			expected: plugin.ExitCodeLockUnavailable,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, plugin.ExitCode(tc.input))
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// targetsAnnotationContext keeps the summary of the targets separate from the annotations for each of their tasks
+const targetsAnnotationContext = "migrations-runner-targets"
+
+// TargetResult is the outcome of running the task for one of the targets of a fan-out
+type TargetResult struct {
+	ParameterName string
+	Err           error
+	Duration      time.Duration
+}
+
+// runTargets runs the task for each target, with up to max-concurrency of them at a time
+func (trp TaskRunnerPlugin) runTargets(ctx context.Context, cfg aws.Config, waiter WaitForCompletion, config Config, targets []awsinternal.NamedConfiguration, snapshot *StepSnapshot) error {
+	return trp.RunTargets(ctx, buildkite.Agent{}, config.MaxConcurrency, targets, func(ctx context.Context, target awsinternal.NamedConfiguration) error {
+		_, err := trp.runTarget(ctx, cfg, waiter, config, target, snapshot)
+		return err
+	})
+}
+
+// RunTargets runs each target with up to maxConcurrency of them at a time, then reports their results. The output of
+// each target is added to the job log in its own group, in the order of the targets. The first target that hasn't
+// finished streams its output to the job log as it runs, while the targets running alongside it are buffered until
+// it finishes, so their output isn't interleaved. Every target is run even if others fail.
+func (trp TaskRunnerPlugin) RunTargets(ctx context.Context, bkAgent buildkite.AgentAPI, maxConcurrency int, targets []awsinternal.NamedConfiguration, run func(context.Context, awsinternal.NamedConfiguration) error) error {
+	log := buildkite.LoggerFrom(ctx)
+	log.Logf("Running tasks for %d targets, up to %d at a time\n", len(targets), maxConcurrency)
+
+	var wg sync.WaitGroup
+
+	results := make([]TargetResult, len(targets))
+	slots := make(chan struct{}, maxConcurrency)
+	logs := newTargetLogs(log, targets)
+
+	for i, target := range targets {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+
+		// Targets that haven't started when the job is cancelled are not run at all
+		if ctx.Err() != nil {
+			results[i] = TargetResult{ParameterName: target.ParameterName, Err: fmt.Errorf("not run, job cancelled: %w", ctx.Err())}
+			logs.skip(i)
+
+			continue
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			targetLog := buildkite.NewLogger(logs.outputs[i])
+
+			started := time.Now()
+			err := run(buildkite.WithLogger(ctx, targetLog), target)
+			results[i] = TargetResult{ParameterName: target.ParameterName, Err: err, Duration: time.Since(started)}
+
+			if err != nil {
+				targetLog.LogFailuref("task for %s failed: %v\n", target.ParameterName, err)
+			}
+
+			logs.finish(i)
+		}()
+	}
+
+	wg.Wait()
+
+	return trp.ReportTargetResults(ctx, bkAgent, results)
+}
+
+// targetLogs puts the output of the targets in the job log in order, streaming the output of the first target that
+// hasn't finished
+type targetLogs struct {
+	mu      sync.Mutex
+	log     *buildkite.Logger
+	outputs []*targetOutput
+	// next is the first target that hasn't finished, whose output is streamed
+	next int
+}
+
+func newTargetLogs(log *buildkite.Logger, targets []awsinternal.NamedConfiguration) *targetLogs {
+	logs := &targetLogs{log: log, outputs: make([]*targetOutput, len(targets))}
+
+	for i, target := range targets {
+		logs.outputs[i] = &targetOutput{parameterName: target.ParameterName}
+	}
+
+	logs.advance()
+
+	return logs
+}
+
+// finish marks the target as finished, streaming the output of the targets after it in turn
+func (l *targetLogs) finish(i int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.outputs[i].finished = true
+	l.advance()
+}
+
+// skip marks a target that was not run, which has no output
+func (l *targetLogs) skip(i int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.outputs[i].skipped = true
+	l.outputs[i].finished = true
+	l.advance()
+}
+
+// advance moves past the targets that have finished, adding their output to the job log, then streams the output of
+// the next target. It is called with the lock held.
+func (l *targetLogs) advance() {
+	for l.next < len(l.outputs) {
+		output := l.outputs[l.next]
+		if !output.skipped {
+			output.stream(l.log)
+		}
+
+		if !output.finished {
+			return
+		}
+
+		l.next++
+	}
+}
+
+// targetOutput is the output of a target, buffered until it is streamed to the job log
+type targetOutput struct {
+	mu            sync.Mutex
+	parameterName string
+	buffer        bytes.Buffer
+	// log is set once the output is streamed
+	log      *buildkite.Logger
+	finished bool
+	skipped  bool
+}
+
+func (o *targetOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.log != nil {
+		return o.log.Write(p)
+	}
+
+	return o.buffer.Write(p)
+}
+
+// stream opens the target's group in the job log with the output buffered so far, then streams the rest of its output
+func (o *targetOutput) stream(log *buildkite.Logger) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.log != nil {
+		return
+	}
+
+	log.LogGroupf(":database: %s", o.parameterName)
+	_, _ = log.Write(o.buffer.Bytes())
+
+	o.buffer.Reset()
+	o.log = log
+}
+
+// ReportTargetResults annotates the build with a summary of the result of each target, and returns an error listing
+// the targets that failed, if any
+func (trp TaskRunnerPlugin) ReportTargetResults(ctx context.Context, bkAgent buildkite.AgentAPI, results []TargetResult) error {
+	var (
+		message  strings.Builder
+		failures []error
+	)
+
+	message.WriteString("| Target | Result | Duration |\n")
+	message.WriteString("| --- | --- | --- |\n")
+
+	for _, result := range results {
+		outcome := ":white_check_mark: succeeded"
+		if result.Err != nil {
+			outcome = ":x: " + markdownText(result.Err.Error())
+			failures = append(failures, fmt.Errorf("%s: %w", result.ParameterName, result.Err))
+		}
+
+		fmt.Fprintf(&message, "| %s | %s | %s |\n", markdownCode(result.ParameterName), outcome, result.Duration.Round(time.Second))
+	}
+
+	style := "success"
+	if len(failures) > 0 {
+		style = "error"
+	}
+
+	err := errors.Join(failures...)
+	if err != nil {
+		err = fmt.Errorf("tasks failed for %d of %d targets:\n%w", len(failures), len(results), err)
+	}
+
+	bkerr := bkAgent.Annotate(ctx, message.String(), style, targetsAnnotationContext)
+	if bkerr != nil {
+		return errors.Join(err, fmt.Errorf("failed to annotate buildkite with target results: %w", bkerr))
+	}
+
+	return err
+}
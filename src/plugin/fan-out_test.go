@@ -0,0 +1,180 @@
+package plugin_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportTargetResults(t *testing.T) {
+	t.Run("given every target succeeded, it should annotate a summary and not return an error", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		err := trp.ReportTargetResults(context.TODO(), bkAgent, []plugin.TargetResult{
+			{ParameterName: "/cool-service/migrations/shard-1", Duration: 90 * time.Second},
+			{ParameterName: "/cool-service/migrations/shard-2", Duration: 1500 * time.Millisecond},
+		})
+
+		require.NoError(t, err)
+		require.Len(t, bkAgent.annotations, 1)
+		assert.Equal(t, "| Target | Result | Duration |\n"+
+			"| --- | --- | --- |\n"+
+			"| `/cool-service/migrations/shard-1` | :white_check_mark: succeeded | 1m30s |\n"+
+			"| `/cool-service/migrations/shard-2` | :white_check_mark: succeeded | 2s |\n", bkAgent.annotations[0])
+		assert.Equal(t, []string{"migrations-runner-targets"}, bkAgent.annotationContexts)
+	})
+
+	t.Run("given a target failed, it should include the failure in the summary and return it", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+		exitErr := &awsinternal.NonZeroExitError{Container: "migrations-runner", ExitCode: 1}
+
+		err := trp.ReportTargetResults(context.TODO(), bkAgent, []plugin.TargetResult{
+			{ParameterName: "/cool-service/migrations/shard-1", Duration: time.Minute},
+			{ParameterName: "/cool-service/migrations/shard-2", Err: exitErr, Duration: time.Minute},
+		})
+
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, exitErr), "the failure should be returned so its exit code is used")
+		assert.Equal(t, plugin.ExitCodeNonZeroExit, plugin.ExitCode(err))
+		assert.Contains(t, err.Error(), "tasks failed for 1 of 2 targets:\n/cool-service/migrations/shard-2: ")
+		require.Len(t, bkAgent.annotations, 1)
+		assert.Contains(t, bkAgent.annotations[0], "| `/cool-service/migrations/shard-2` | :x: "+exitErr.Error()+" | 1m0s |\n")
+	})
+
+	t.Run("given an error that would break the table, it should escape it", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		_ = trp.ReportTargetResults(context.TODO(), bkAgent, []plugin.TargetResult{
+			{ParameterName: "/cool-service/migrations|`shard`", Err: errors.New("failed: a | b\n`c`"), Duration: time.Minute},
+		})
+
+		require.Len(t, bkAgent.annotations, 1)
+		assert.Contains(t, bkAgent.annotations[0], "| `` /cool-service/migrations\\|`shard` `` | :x: failed: a \\| b<br>`c` | 1m0s |\n")
+	})
+}
+
+func fanOutTargets(parameterNames ...string) []awsinternal.NamedConfiguration {
+	targets := make([]awsinternal.NamedConfiguration, len(parameterNames))
+	for i, parameterName := range parameterNames {
+		targets[i] = awsinternal.NamedConfiguration{ParameterName: parameterName}
+	}
+
+	return targets
+}
+
+func TestRunTargets(t *testing.T) {
+	t.Run("given more targets than the concurrency, it should run no more than that at a time", func(t *testing.T) {
+		var running, most atomic.Int32
+
+		trp := plugin.TaskRunnerPlugin{}
+		ctx := buildkite.WithLogger(context.TODO(), buildkite.NewLogger(io.Discard))
+
+		err := trp.RunTargets(ctx, &RecordingBuildKiteAgent{}, 2, fanOutTargets("shard-1", "shard-2", "shard-3", "shard-4", "shard-5"), func(ctx context.Context, target awsinternal.NamedConfiguration) error {
+			current := running.Add(1)
+			defer running.Add(-1)
+
+			for {
+				previous := most.Load()
+				if current <= previous || most.CompareAndSwap(previous, current) {
+					break
+				}
+			}
+
+			time.Sleep(5 * time.Millisecond)
+
+			return nil
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, int32(2), most.Load())
+	})
+
+	t.Run("given one target at a time, it should stream its output as it runs", func(t *testing.T) {
+		var output bytes.Buffer
+
+		trp := plugin.TaskRunnerPlugin{}
+		ctx := buildkite.WithLogger(context.TODO(), buildkite.NewLogger(&output))
+
+		err := trp.RunTargets(ctx, &RecordingBuildKiteAgent{}, 1, fanOutTargets("shard-1", "shard-2"), func(ctx context.Context, target awsinternal.NamedConfiguration) error {
+			buildkite.LoggerFrom(ctx).Logf("migrating %s\n", target.ParameterName)
+
+			assert.True(t, strings.HasSuffix(output.String(), "--- :database: "+target.ParameterName+"\nmigrating "+target.ParameterName+"\n"), "the output should be in the job log before the target finishes")
+
+			return nil
+		})
+
+		require.NoError(t, err)
+	})
+
+	t.Run("given targets running alongside each other, it should add their output in order", func(t *testing.T) {
+		var output bytes.Buffer
+
+		trp := plugin.TaskRunnerPlugin{}
+		ctx := buildkite.WithLogger(context.TODO(), buildkite.NewLogger(&output))
+		secondFinished := make(chan struct{})
+
+		err := trp.RunTargets(ctx, &RecordingBuildKiteAgent{}, 2, fanOutTargets("shard-1", "shard-2"), func(ctx context.Context, target awsinternal.NamedConfiguration) error {
+			log := buildkite.LoggerFrom(ctx)
+
+			if target.ParameterName == "shard-1" {
+				log.Log("shard-1 started")
+				<-secondFinished
+				log.Log("shard-1 finished")
+
+				return errors.New("shard-1 failed")
+			}
+
+			log.Log("shard-2 started")
+			log.Log("shard-2 finished")
+			close(secondFinished)
+
+			return nil
+		})
+
+		require.Error(t, err)
+		assert.Equal(t, "Running tasks for 2 targets, up to 2 at a time\n"+
+			"--- :database: shard-1\n"+
+			"shard-1 started\n"+
+			"shard-1 finished\n"+
+			"^^^ +++\ntask for shard-1 failed: shard-1 failed\n"+
+			"--- :database: shard-2\n"+
+			"shard-2 started\n"+
+			"shard-2 finished\n", output.String())
+	})
+
+	t.Run("given the job is cancelled, it should not run the targets that haven't started", func(t *testing.T) {
+		var ran []string
+
+		trp := plugin.TaskRunnerPlugin{}
+		bkAgent := &RecordingBuildKiteAgent{}
+		ctx, cancel := context.WithCancel(buildkite.WithLogger(context.TODO(), buildkite.NewLogger(io.Discard)))
+		defer cancel()
+
+		err := trp.RunTargets(ctx, bkAgent, 1, fanOutTargets("shard-1", "shard-2", "shard-3"), func(ctx context.Context, target awsinternal.NamedConfiguration) error {
+			ran = append(ran, target.ParameterName)
+			cancel()
+
+			return nil
+		})
+
+		require.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, []string{"shard-1"}, ran)
+		assert.Contains(t, err.Error(), "tasks failed for 2 of 3 targets")
+		require.Len(t, bkAgent.annotations, 1)
+		assert.Contains(t, bkAgent.annotations[0], "| `shard-3` | :x: not run, job cancelled: context canceled |")
+	})
+}
@@ -0,0 +1,163 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+)
+
+// MigrationLock prevents migrations from running concurrently against the same database
+type MigrationLock interface {
+	// TryAcquire takes the lock, or renews it if it is already held by the holder, for the duration of the lease.
+	// When the lock is held by someone else, they are returned as the current holder.
+	TryAcquire(ctx context.Context, key string, holder awsinternal.LockHolder, lease time.Duration) (awsinternal.LockHolder, bool, error)
+	// Release frees the lock, provided it is still held by the holder
+	Release(ctx context.Context, key string, holder awsinternal.LockHolder) error
+}
+
+const (
+	// lockLeaseDuration is how long the lock is held without being renewed. It is renewed well within this time while
+	// the task runs, so it only lapses if the agent running the plugin is lost.
+	lockLeaseDuration = time.Minute
+	// lockPollInterval is how often a lock held by another build is checked while waiting for it
+	lockPollInterval = 10 * time.Second
+	// lockAnnotationContext keeps the lock's annotation separate from the annotation reporting on the task
+	lockAnnotationContext = "migrations-runner-lock"
+)
+
+// AcquireLock waits up to waitTimeout for the lock, annotating the build with the build holding it while it waits.
+// Once acquired, the lease is renewed in the background until the returned function is called. It releases the lock
+// when keepFor is zero, otherwise the lease is extended to keepFor, so a task left running keeps the lock once the
+// plugin has exited.
+func (trp TaskRunnerPlugin) AcquireLock(ctx context.Context, lock MigrationLock, bkAgent buildkite.AgentAPI, key string, holder awsinternal.LockHolder, waitTimeout time.Duration, pollInterval time.Duration) (func(keepFor time.Duration), error) {
+	log := buildkite.LoggerFrom(ctx)
+
+	deadline := time.Now().Add(waitTimeout)
+	waited := false
+
+	for {
+		current, acquired, err := lock.TryAcquire(ctx, key, holder, lockLeaseDuration)
+		if err != nil {
+			return nil, fmt.Errorf("failed to acquire lock for %s: %w", key, err)
+		}
+
+		if acquired {
+			break
+		}
+
+		if !time.Now().Before(deadline) {
+			lockErr := &LockUnavailableError{Key: key, Holder: lockHolderLabel(current), WaitTimeout: waitTimeout}
+
+			bkerr := bkAgent.Annotate(ctx, fmt.Sprintf("Migrations for `%s` were not run: %s", key, lockErr), "error", lockAnnotationContext)
+			if bkerr != nil {
+				return nil, fmt.Errorf("failed to annotate buildkite with lock failure: %w, annotation error: %w", lockErr, bkerr)
+			}
+
+			return nil, lockErr
+		}
+
+		if !waited {
+			bkerr := bkAgent.Annotate(ctx, fmt.Sprintf("Waiting for migrations for `%s` running in %s to finish", key, lockHolderLabel(current)), "warning", lockAnnotationContext)
+			if bkerr != nil {
+				log.LogFailuref("failed to annotate buildkite while waiting for lock, continuing... %v\n", bkerr)
+			}
+
+			waited = true
+		}
+
+		log.Logf("Lock for %s is held by %s, waiting...\n", key, lockHolderLabel(current))
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("job cancelled while waiting for lock: %w", ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+
+	log.Logf("Acquired lock for %s\n", key)
+
+	if waited {
+		bkerr := bkAgent.Annotate(ctx, fmt.Sprintf("Migrations for `%s` ran once the previous run finished", key), "info", lockAnnotationContext)
+		if bkerr != nil {
+			log.LogFailuref("failed to annotate buildkite with lock acquisition, continuing... %v\n", bkerr)
+		}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		renewLock(ctx, lock, key, holder, stop)
+	}()
+
+	return func(keepFor time.Duration) {
+		close(stop)
+		<-stopped
+
+		// The lock is released or kept even if the job was cancelled, as the task may still be running
+		releaseCtx := context.WithoutCancel(ctx)
+
+		if keepFor > 0 {
+			current, held, err := lock.TryAcquire(releaseCtx, key, holder, keepFor)
+			if err != nil {
+				log.LogFailuref("failed to keep lock for %s, it will be released when its lease expires... %v\n", key, err)
+				return
+			}
+
+			if !held {
+				log.LogFailuref("lock for %s has been taken by %s, it can't be kept for the task left running\n", key, lockHolderLabel(current))
+				return
+			}
+
+			log.Logf("Keeping lock for %s for %s, while the task may still be running\n", key, keepFor)
+
+			return
+		}
+
+		err := lock.Release(releaseCtx, key, holder)
+		if err != nil {
+			log.LogFailuref("failed to release lock for %s, it will be released when its lease expires... %v\n", key, err)
+			return
+		}
+
+		log.Logf("Released lock for %s\n", key)
+	}, nil
+}
+
+// renewLock extends the lease on the lock until stop is closed. Failures are logged, the lock may still be renewed by
+// a later attempt before the lease expires.
+func renewLock(ctx context.Context, lock MigrationLock, key string, holder awsinternal.LockHolder, stop <-chan struct{}) {
+	log := buildkite.LoggerFrom(ctx)
+
+	//nolint:mnd // renewing at a third of the lease allows a renewal to fail without the lease expiring
+	ticker := time.NewTicker(lockLeaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current, held, err := lock.TryAcquire(ctx, key, holder, lockLeaseDuration)
+			if err != nil {
+				log.LogFailuref("failed to renew lock for %s, continuing... %v\n", key, err)
+			} else if !held {
+				log.LogFailuref("lock for %s has been taken by %s, continuing...\n", key, lockHolderLabel(current))
+			}
+		}
+	}
+}
+
+func lockHolderLabel(holder awsinternal.LockHolder) string {
+	if holder.BuildURL != "" {
+		return "build " + holder.BuildURL
+	}
+
+	return "step " + holder.ID
+}
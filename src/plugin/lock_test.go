@@ -0,0 +1,138 @@
+package plugin_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryLock is a MigrationLock held in memory. When freeAfterAttempts is set, locks held by others are released
+// once that many attempts have been made to acquire them.
+type memoryLock struct {
+	mu                sync.Mutex
+	holders           map[string]awsinternal.LockHolder
+	expiries          map[string]time.Time
+	attempts          int
+	freeAfterAttempts int
+}
+
+func (m *memoryLock) TryAcquire(ctx context.Context, key string, holder awsinternal.LockHolder, lease time.Duration) (awsinternal.LockHolder, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.attempts++
+	if m.freeAfterAttempts > 0 && m.attempts > m.freeAfterAttempts {
+		delete(m.holders, key)
+	}
+
+	current, held := m.holders[key]
+	if held && current.ID != holder.ID {
+		return current, false, nil
+	}
+
+	m.holders[key] = holder
+
+	if m.expiries == nil {
+		m.expiries = map[string]time.Time{}
+	}
+
+	m.expiries[key] = time.Now().Add(lease)
+
+	return holder, true, nil
+}
+
+func (m *memoryLock) Release(ctx context.Context, key string, holder awsinternal.LockHolder) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.holders[key].ID != holder.ID {
+		return fmt.Errorf("lock %s is not held by %s", key, holder.ID)
+	}
+
+	delete(m.holders, key)
+
+	return nil
+}
+
+func TestAcquireLock(t *testing.T) {
+	key := "/cool-service/migrations"
+	holder := awsinternal.LockHolder{ID: "step-1", BuildURL: "https://buildkite.com/culture-amp/cool-service/builds/1"}
+	otherHolder := awsinternal.LockHolder{ID: "step-2", BuildURL: "https://buildkite.com/culture-amp/cool-service/builds/2"}
+
+	tests := []struct {
+		name                string
+		holders             map[string]awsinternal.LockHolder
+		freeAfterAttempts   int
+		expectedAnnotations []string
+	}{
+		{
+			name:    "given a free lock, it should acquire it without annotating",
+			holders: map[string]awsinternal.LockHolder{},
+		},
+		{
+			name:    "given a lock held by a previous attempt of the step, it should take it over",
+			holders: map[string]awsinternal.LockHolder{key: holder},
+		},
+		{
+			name:              "given a lock released while waiting, it should acquire it once released",
+			holders:           map[string]awsinternal.LockHolder{key: otherHolder},
+			freeAfterAttempts: 2,
+			expectedAnnotations: []string{
+				"Waiting for migrations for `/cool-service/migrations` running in build https://buildkite.com/culture-amp/cool-service/builds/2 to finish",
+				"Migrations for `/cool-service/migrations` ran once the previous run finished",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lock := &memoryLock{holders: tc.holders, freeAfterAttempts: tc.freeAfterAttempts}
+			bkAgent := &RecordingBuildKiteAgent{}
+			trp := plugin.TaskRunnerPlugin{}
+
+			release, err := trp.AcquireLock(context.TODO(), lock, bkAgent, key, holder, time.Second, time.Millisecond)
+			require.NoError(t, err)
+			assert.Equal(t, holder, lock.holders[key])
+			assert.Equal(t, tc.expectedAnnotations, bkAgent.annotations)
+
+			release(0)
+			assert.NotContains(t, lock.holders, key)
+		})
+	}
+
+	t.Run("given a task left running, it should keep the lock for longer than the task may run", func(t *testing.T) {
+		lock := &memoryLock{holders: map[string]awsinternal.LockHolder{}}
+		trp := plugin.TaskRunnerPlugin{}
+		leftRunning := &plugin.TaskLeftRunningError{TaskArn: "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/abc123", RunFor: 46 * time.Minute}
+
+		release, err := trp.AcquireLock(context.TODO(), lock, &RecordingBuildKiteAgent{}, key, holder, time.Second, time.Millisecond)
+		require.NoError(t, err)
+
+		taskDeadline := time.Now().Add(leftRunning.RunFor)
+		release(leftRunning.RunFor)
+
+		assert.Equal(t, holder, lock.holders[key])
+		assert.False(t, lock.expiries[key].Before(taskDeadline), "the lease should outlive the task")
+	})
+
+	t.Run("given a lock held for longer than the wait timeout, it should annotate the holder and return a LockUnavailableError", func(t *testing.T) {
+		lock := &memoryLock{holders: map[string]awsinternal.LockHolder{key: otherHolder}}
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		_, err := trp.AcquireLock(context.TODO(), lock, bkAgent, key, holder, 10*time.Millisecond, time.Millisecond)
+
+		var lockUnavailable *plugin.LockUnavailableError
+		require.ErrorAs(t, err, &lockUnavailable)
+		assert.Equal(t, otherHolder, lock.holders[key])
+		require.Len(t, bkAgent.annotations, 2)
+		assert.Equal(t, "Migrations for `/cool-service/migrations` were not run: lock for /cool-service/migrations is held by build https://buildkite.com/culture-amp/cool-service/builds/2, gave up waiting after 10ms", bkAgent.annotations[1])
+	})
+}
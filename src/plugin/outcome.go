@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"context"
+	"strconv"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+)
+
+// The outcome of the step, and of each task it runs, is published as build meta-data under meta-data-prefix, so later
+// steps of the build can act on it, e.g. "migrations-runner:status". The keys of each task are also published
+// qualified by its parameter and stage, e.g. "migrations-runner:/cool-service/migrations:backfill:task-arn", as a
+// step can run several tasks.
+const (
+	outcomePassed = "passed"
+	outcomeFailed = "failed"
+)
+
+// PublishStepOutcome publishes whether every task the step ran passed. Failing to publish is logged rather than
+// returned, as the migrations have run by this point.
+func (trp TaskRunnerPlugin) PublishStepOutcome(ctx context.Context, bkAgent buildkite.AgentAPI, config Config, err error) {
+	status := outcomePassed
+	if err != nil {
+		status = outcomeFailed
+	}
+
+	publishOutcome(ctx, bkAgent, config, config.MetaDataPrefix+":status", status)
+}
+
+// PublishTaskOutcome publishes the task that ran and how it exited. The unqualified keys are of the last task to
+// finish, which is the only task unless the step has several targets or stages. A plan or rollback is only published
+// qualified, by its stage.
+func (trp TaskRunnerPlugin) PublishTaskOutcome(ctx context.Context, bkAgent buildkite.AgentAPI, config Config, result awsinternal.TaskResult, failure error) {
+	for _, field := range taskOutcome(result, failure) {
+		// The unqualified status is of the step as a whole, published once it has finished, and the unqualified keys
+		// are only those of the migrations, not of their plan or rollback
+		if field.name != "status" && !config.Rollback && !config.Plan {
+			publishOutcome(ctx, bkAgent, config, config.MetaDataPrefix+":"+field.name, field.value)
+		}
+
+		publishOutcome(ctx, bkAgent, config, taskOutcomePrefix(config)+":"+field.name, field.value)
+	}
+}
+
+type outcomeField struct {
+	name  string
+	value string
+}
+
+// taskOutcome describes the task and how it exited, leaving empty what isn't known of a task that did not stop
+func taskOutcome(result awsinternal.TaskResult, failure error) []outcomeField {
+	status := outcomePassed
+	if failure != nil {
+		status = outcomeFailed
+	}
+
+	exitCode := ""
+	if runner, ok := result.Runner(); ok && runner.ExitCode != nil {
+		exitCode = strconv.Itoa(int(*runner.ExitCode))
+	}
+
+	duration := ""
+	if !result.StoppedAt.IsZero() {
+		duration = strconv.Itoa(int(result.Duration().Seconds()))
+	}
+
+	return []outcomeField{
+		{"task-arn", result.TaskArn},
+		{"task-definition-arn", result.TaskDefinitionArn},
+		{"exit-code", exitCode},
+		{"duration", duration},
+		{"status", status},
+	}
+}
+
+// taskOutcomePrefix qualifies the keys of a task by its parameter and stage
+func taskOutcomePrefix(config Config) string {
+	prefix := config.MetaDataPrefix + ":" + config.ParameterName
+	if config.Stage != "" {
+		prefix += ":" + config.Stage
+	}
+
+	return prefix
+}
+
+// publishOutcome sets the key, unless there is nothing to set it to. Buildkite does not accept empty meta-data values.
+func publishOutcome(ctx context.Context, bkAgent buildkite.AgentAPI, config Config, key string, value string) {
+	// Outside of Buildkite there is no build to publish to
+	if config.Build.StepID == "" || value == "" {
+		return
+	}
+
+	err := bkAgent.SetMetaData(ctx, key, value)
+	if err != nil {
+		buildkite.LoggerFrom(ctx).LogFailuref("failed to publish %s to build meta-data, continuing... %v\n", key, err)
+	}
+}
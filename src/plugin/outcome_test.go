@@ -0,0 +1,95 @@
+package plugin_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishTaskOutcome(t *testing.T) {
+	startedAt := time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+
+	result := awsinternal.TaskResult{
+		TaskArn:           "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/abc123",
+		TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/cool-service:12",
+		StartedAt:         startedAt,
+		StoppedAt:         startedAt.Add(95 * time.Second),
+		Containers:        []awsinternal.ContainerResult{{Name: "migrations-runner", Essential: true, ExitCode: aws.Int32(1)}},
+	}
+
+	t.Run("given a task that failed, it should publish it under the prefix and qualified by parameter and stage", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+		config := plugin.Config{ParameterName: "/cool-service/migrations", Stage: "backfill", MetaDataPrefix: "db", Build: plugin.BuildEnvironment{StepID: "step-1"}}
+
+		trp.PublishTaskOutcome(context.TODO(), bkAgent, config, result, errors.New("task stopped with a non-zero exit code: 1"))
+
+		assert.Equal(t, map[string]string{
+			"db:task-arn":            result.TaskArn,
+			"db:task-definition-arn": result.TaskDefinitionArn,
+			"db:exit-code":           "1",
+			"db:duration":            "95",
+
+			"db:/cool-service/migrations:backfill:task-arn":            result.TaskArn,
+			"db:/cool-service/migrations:backfill:task-definition-arn": result.TaskDefinitionArn,
+			"db:/cool-service/migrations:backfill:exit-code":           "1",
+			"db:/cool-service/migrations:backfill:duration":            "95",
+			"db:/cool-service/migrations:backfill:status":              "failed",
+		}, bkAgent.metaData)
+	})
+
+	t.Run("given a task with no exit code, it should not publish one", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+		config := plugin.Config{ParameterName: "test-parameter", MetaDataPrefix: "migrations-runner", Build: plugin.BuildEnvironment{StepID: "step-1"}}
+
+		noExitCode := result
+		noExitCode.Containers = []awsinternal.ContainerResult{{Name: "migrations-runner", Essential: true}}
+
+		trp.PublishTaskOutcome(context.TODO(), bkAgent, config, noExitCode, nil)
+
+		assert.NotContains(t, bkAgent.metaData, "migrations-runner:exit-code")
+		assert.Equal(t, "passed", bkAgent.metaData["migrations-runner:test-parameter:status"])
+	})
+
+	t.Run("given a rollback, it should only publish it qualified by its stage", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+		config := plugin.Config{ParameterName: "test-parameter", Stage: "rollback", Rollback: true, MetaDataPrefix: "migrations-runner", Build: plugin.BuildEnvironment{StepID: "step-1"}}
+
+		trp.PublishTaskOutcome(context.TODO(), bkAgent, config, result, nil)
+
+		assert.NotContains(t, bkAgent.metaData, "migrations-runner:task-arn")
+		assert.Equal(t, result.TaskArn, bkAgent.metaData["migrations-runner:test-parameter:rollback:task-arn"])
+		assert.Equal(t, "passed", bkAgent.metaData["migrations-runner:test-parameter:rollback:status"])
+	})
+
+	t.Run("given no Buildkite step, it should publish nothing", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		trp.PublishTaskOutcome(context.TODO(), bkAgent, plugin.Config{ParameterName: "test-parameter", MetaDataPrefix: "migrations-runner"}, result, nil)
+
+		assert.Empty(t, bkAgent.metaData)
+	})
+}
+
+func TestPublishStepOutcome(t *testing.T) {
+	config := plugin.Config{ParameterName: "test-parameter", MetaDataPrefix: "migrations-runner", Build: plugin.BuildEnvironment{StepID: "step-1"}}
+	trp := plugin.TaskRunnerPlugin{}
+
+	bkAgent := &RecordingBuildKiteAgent{}
+	trp.PublishStepOutcome(context.TODO(), bkAgent, config, nil)
+	assert.Equal(t, map[string]string{"migrations-runner:status": "passed"}, bkAgent.metaData)
+
+	bkAgent = &RecordingBuildKiteAgent{}
+	trp.PublishStepOutcome(context.TODO(), bkAgent, config, errors.New("task did not complete within the time limit"))
+	assert.Equal(t, map[string]string{"migrations-runner:status": "failed"}, bkAgent.metaData)
+}
@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+)
+
+// outcomeVariablePattern matches the outcome variables in a follow-up pipeline, as $NAME or ${NAME}, and "$$", which
+// escapes a "$" for the agent and is left as it is. Any other variable is left for the agent to interpolate from the
+// environment of the job.
+var outcomeVariablePattern = regexp.MustCompile(`\$\$|\$\{(MIGRATIONS_RUNNER_\w+)\}|\$(MIGRATIONS_RUNNER_\w+)`)
+
+// UploadFollowUpPipeline adds the steps of on-success-pipeline or on-failure-pipeline to the build once the step has
+// finished, depending on whether it failed, with its outcome interpolated into them. The result is of the step's one
+// task, and is empty when the step ran several. Nothing is uploaded when the option for the outcome is not set.
+func (trp TaskRunnerPlugin) UploadFollowUpPipeline(ctx context.Context, bkAgent buildkite.AgentAPI, config Config, result awsinternal.TaskResult, failure error) error {
+	option, path := "on-success-pipeline", config.OnSuccessPipeline
+	if failure != nil {
+		option, path = "on-failure-pipeline", config.OnFailurePipeline
+	}
+
+	if path == "" {
+		return nil
+	}
+
+	buildkite.LoggerFrom(ctx).Logf("Uploading %s from %s\n", option, path)
+
+	pipeline, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", option, err)
+	}
+
+	expanded, err := expandOutcome(string(pipeline), outcomeVariables(config, result, failure))
+	if err != nil {
+		return fmt.Errorf("failed to interpolate %s: %w", option, err)
+	}
+
+	err = bkAgent.UploadPipeline(ctx, expanded)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", option, err)
+	}
+
+	return nil
+}
+
+// validatePipeline checks the follow-up pipeline can be read and only refers to outcome variables that exist
+func validatePipeline(path string) error {
+	pipeline, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = expandOutcome(string(pipeline), outcomeVariables(Config{}, awsinternal.TaskResult{}, nil))
+
+	return err
+}
+
+// outcomeVariables are the variables available to a follow-up pipeline, named for the meta-data published for the
+// step, e.g. MIGRATIONS_RUNNER_TASK_ARN for "task-arn". The parameter name is only given when the step has one target.
+func outcomeVariables(config Config, result awsinternal.TaskResult, failure error) map[string]string {
+	parameterName := ""
+	if len(config.ParameterNames) == 1 {
+		parameterName = config.ParameterNames[0]
+	}
+
+	variables := map[string]string{
+		"MIGRATIONS_RUNNER_PARAMETER_NAME": parameterName,
+	}
+
+	for _, field := range taskOutcome(result, failure) {
+		variables["MIGRATIONS_RUNNER_"+strings.ToUpper(strings.ReplaceAll(field.name, "-", "_"))] = field.value
+	}
+
+	return variables
+}
+
+// expandOutcome interpolates the outcome variables into the pipeline. A variable with the prefix of the outcome
+// variables that isn't one of them is an error, as it is most likely a typo.
+func expandOutcome(pipeline string, variables map[string]string) (string, error) {
+	var unknown []string
+
+	expanded := outcomeVariablePattern.ReplaceAllStringFunc(pipeline, func(match string) string {
+		if match == "$$" {
+			return match
+		}
+
+		name := strings.Trim(match, "${}")
+
+		value, ok := variables[name]
+		if !ok {
+			unknown = append(unknown, name)
+		}
+
+		return value
+	})
+
+	if len(unknown) > 0 {
+		return "", errors.New("unknown variables: " + strings.Join(unknown, ", "))
+	}
+
+	return expanded, nil
+}
@@ -0,0 +1,134 @@
+package plugin_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePipeline(t *testing.T, pipeline string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "pipeline.yml")
+	require.NoError(t, os.WriteFile(path, []byte(pipeline), 0o644))
+
+	return path
+}
+
+func TestUploadFollowUpPipeline(t *testing.T) {
+	startedAt := time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+
+	result := awsinternal.TaskResult{
+		TaskArn:           "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/abc123",
+		TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/cool-service:12",
+		StartedAt:         startedAt,
+		StoppedAt:         startedAt.Add(95 * time.Second),
+		Containers:        []awsinternal.ContainerResult{{Name: "migrations-runner", Essential: true, ExitCode: aws.Int32(1)}},
+	}
+
+	onSuccess := writePipeline(t, "steps:\n  - label: deploy\n    command: ./deploy.sh\n")
+	onFailure := writePipeline(t, `steps:
+  - block: "Roll back $MIGRATIONS_RUNNER_PARAMETER_NAME?"
+    prompt: "Task ${MIGRATIONS_RUNNER_TASK_ARN} exited with $MIGRATIONS_RUNNER_EXIT_CODE after ${MIGRATIONS_RUNNER_DURATION}s"
+  - command: ./rollback.sh --branch $BUILDKITE_BRANCH --cost '$$5'
+    env:
+      STATUS: $MIGRATIONS_RUNNER_STATUS
+`)
+
+	config := plugin.Config{ParameterNames: []string{"/cool-service/migrations"}, OnSuccessPipeline: onSuccess, OnFailurePipeline: onFailure}
+
+	t.Run("given a task that failed, it should upload the failure pipeline with the outcome interpolated", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		err := trp.UploadFollowUpPipeline(context.TODO(), bkAgent, config, result, errors.New("task stopped with a non-zero exit code: 1"))
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{`steps:
+  - block: "Roll back /cool-service/migrations?"
+    prompt: "Task arn:aws:ecs:us-west-2:123456789012:task/test-cluster/abc123 exited with 1 after 95s"
+  - command: ./rollback.sh --branch $BUILDKITE_BRANCH --cost '$$5'
+    env:
+      STATUS: failed
+`}, bkAgent.pipelines)
+	})
+
+	t.Run("given a task that passed, it should upload the success pipeline", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		err := trp.UploadFollowUpPipeline(context.TODO(), bkAgent, config, result, nil)
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"steps:\n  - label: deploy\n    command: ./deploy.sh\n"}, bkAgent.pipelines)
+	})
+
+	t.Run("given no pipeline for the outcome, it should upload nothing", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		err := trp.UploadFollowUpPipeline(context.TODO(), bkAgent, plugin.Config{OnFailurePipeline: onFailure}, result, nil)
+
+		require.NoError(t, err)
+		assert.Empty(t, bkAgent.pipelines)
+	})
+
+	t.Run("given a task that could not be started, it should leave what isn't known empty", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+		failureConfig := plugin.Config{OnFailurePipeline: writePipeline(t, "[$MIGRATIONS_RUNNER_TASK_ARN, $MIGRATIONS_RUNNER_DURATION, $MIGRATIONS_RUNNER_STATUS]")}
+
+		err := trp.UploadFollowUpPipeline(context.TODO(), bkAgent, failureConfig, awsinternal.TaskResult{}, errors.New("capacity is unavailable"))
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"[, , failed]"}, bkAgent.pipelines)
+	})
+
+	t.Run("given several targets, it should leave the parameter name empty", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+		successConfig := plugin.Config{
+			ParameterNames:    []string{"/cool-service/migrations/shard-1", "/cool-service/migrations/shard-2"},
+			OnSuccessPipeline: writePipeline(t, "[$MIGRATIONS_RUNNER_PARAMETER_NAME, $MIGRATIONS_RUNNER_STATUS]"),
+		}
+
+		err := trp.UploadFollowUpPipeline(context.TODO(), bkAgent, successConfig, awsinternal.TaskResult{}, nil)
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"[, passed]"}, bkAgent.pipelines)
+	})
+}
+
+func TestFailOnInvalidFollowUpPipeline(t *testing.T) {
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+
+	t.Run("missing file", func(t *testing.T) {
+		var config plugin.Config
+
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ON_SUCCESS_PIPELINE", filepath.Join(t.TempDir(), "missing.yml"))
+
+		err := fetcher.Fetch(&config)
+		assert.ErrorContains(t, err, "invalid value for on-success-pipeline: open ")
+	})
+
+	t.Run("unknown variable", func(t *testing.T) {
+		var config plugin.Config
+
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_ON_FAILURE_PIPELINE", writePipeline(t, "steps:\n  - block: Roll back $MIGRATIONS_RUNNER_TASK?\n"))
+
+		err := fetcher.Fetch(&config)
+		assert.EqualError(t, err, "invalid value for on-failure-pipeline: unknown variables: MIGRATIONS_RUNNER_TASK")
+	})
+}
@@ -0,0 +1,205 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+)
+
+// planStageName is the stage the plan command runs as, keeping its task, annotation and meta-data apart from those of
+// the migrations
+const planStageName = "plan"
+
+// planOutputLines is the least output of the plan shown in its annotation, as the output is the point of the plan
+const planOutputLines = 500
+
+// pluginName is the name of this plugin, which it is known by in the BUILDKITE_PLUGINS of the step whatever the
+// repository and version it was referenced with
+const pluginName = "migrations-runner"
+
+// approvalOptions are removed from the step uploaded once the migrations are approved, so it runs them directly
+var approvalOptions = []string{"plan-command", "require-approval", "approval-agents", "approval-env"}
+
+// plan runs the plan command as a task of its own before the migrations, showing its output in its annotation. A plan
+// that fails stops the migrations from running.
+func (trp TaskRunnerPlugin) plan(ctx context.Context, cloudwatchClient awsinternal.CloudWatchLogsClientAPI, waiter WaitForCompletion, bkAgent buildkite.AgentAPI, ecsClient awsinternal.EcsClientAPI, config Config, configuration *awsinternal.TaskRunnerConfiguration) error {
+	buildkite.LoggerFrom(ctx).Log("==> Planning migrations\n")
+
+	planConfig, planConfiguration := forPlan(config, configuration)
+
+	_, err := trp.runTaskToCompletion(ctx, cloudwatchClient, waiter, bkAgent, ecsClient, planConfig, planConfiguration)
+	if err != nil {
+		return fmt.Errorf("plan failed, the migrations were not run: %w", err)
+	}
+
+	return nil
+}
+
+// forPlan returns the plugin and task configuration for running the plan command
+func forPlan(config Config, configuration *awsinternal.TaskRunnerConfiguration) (Config, *awsinternal.TaskRunnerConfiguration) {
+	config.Stage = planStageName
+	config.Plan = true
+	config.AnnotationLogLines = max(config.AnnotationLogLines, planOutputLines)
+
+	planConfiguration := *configuration
+	planConfiguration.Command = config.PlanCommandArgs
+
+	return config, &planConfiguration
+}
+
+// UploadApprovalPipeline adds a block step to the build, followed by this step without the options that gate it, so
+// the migrations are run once someone has reviewed the plan and unblocked the build
+func (trp TaskRunnerPlugin) UploadApprovalPipeline(ctx context.Context, bkAgent buildkite.AgentAPI, config Config) error {
+	pipeline, err := approvalPipeline(config)
+	if err != nil {
+		return fmt.Errorf("failed to create the steps to run the migrations once approved: %w", err)
+	}
+
+	buildkite.LoggerFrom(ctx).Log("Uploading a block step for the migrations to be approved\n")
+
+	err = bkAgent.UploadPipeline(ctx, pipeline)
+	if err != nil {
+		return fmt.Errorf("failed to upload the steps to run the migrations once approved: %w", err)
+	}
+
+	return nil
+}
+
+// approvalPipeline is the block step and the step that runs the migrations, as JSON. Every "$" is escaped, as the
+// values were interpolated when this step was uploaded, and must not be interpolated again.
+func approvalPipeline(config Config) (string, error) {
+	plugins, removed, err := approvedPlugins(config.Build.Plugins)
+	if err != nil {
+		return "", err
+	}
+
+	label := config.Build.Label
+	if label == "" {
+		label = ":database: Run migrations"
+	}
+
+	step := map[string]any{
+		"label":   label,
+		"plugins": plugins,
+	}
+
+	// The step's own agents and env are not given to the job, so they are taken from the approval options instead
+	agents := map[string]string{}
+	env := map[string]string{}
+
+	for option, value := range map[string]*map[string]string{"approval-agents": &agents, "approval-env": &env} {
+		if removed[option] == nil {
+			continue
+		}
+
+		err := json.Unmarshal(removed[option], value)
+		if err != nil {
+			return "", fmt.Errorf("invalid value for %s: %w", option, err)
+		}
+	}
+
+	if len(agents) == 0 && config.Build.AgentQueue != "" {
+		agents["queue"] = config.Build.AgentQueue
+	}
+
+	if len(agents) > 0 {
+		step["agents"] = agents
+	}
+
+	if len(env) > 0 {
+		step["env"] = env
+	}
+
+	// BUILDKITE_TIMEOUT is "false" when the step has no timeout
+	timeout, err := strconv.Atoi(config.Build.Timeout)
+	if err == nil && timeout > 0 {
+		step["timeout_in_minutes"] = timeout
+	}
+
+	pipeline := map[string]any{
+		"steps": []any{
+			map[string]string{
+				"block":  fmt.Sprintf(":clipboard: Run migrations for %s?", strings.Join(config.ParameterNames, ", ")),
+				"prompt": "Review the plan in the build's annotations before running the migrations",
+			},
+			step,
+		},
+	}
+
+	encoded, err := json.Marshal(pipeline)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ReplaceAll(string(encoded), "$", "$$"), nil
+}
+
+// approvedPlugins returns the plugins of this step, from BUILDKITE_PLUGINS, with the options that gate the migrations
+// removed from this plugin, along with the removed options. The other plugins, such as one that assumes a role, are
+// kept as they were.
+func approvedPlugins(plugins string) ([]map[string]json.RawMessage, map[string]json.RawMessage, error) {
+	if plugins == "" {
+		return nil, nil, errors.New("BUILDKITE_PLUGINS is not set")
+	}
+
+	var parsed []map[string]json.RawMessage
+
+	err := json.Unmarshal([]byte(plugins), &parsed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse BUILDKITE_PLUGINS: %w", err)
+	}
+
+	found := false
+	removed := map[string]json.RawMessage{}
+
+	for _, plugin := range parsed {
+		for reference, options := range plugin {
+			if !isThisPlugin(reference) {
+				continue
+			}
+
+			var decoded map[string]json.RawMessage
+
+			err := json.Unmarshal(options, &decoded)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse the options of %s: %w", reference, err)
+			}
+
+			for _, option := range approvalOptions {
+				if value, ok := decoded[option]; ok {
+					removed[option] = value
+					delete(decoded, option)
+				}
+			}
+
+			plugin[reference], err = json.Marshal(decoded)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			found = true
+		}
+	}
+
+	if !found {
+		return nil, nil, fmt.Errorf("the %s plugin is not in BUILDKITE_PLUGINS", pluginName)
+	}
+
+	return parsed, removed, nil
+}
+
+// isThisPlugin is whether the plugin reference, e.g. "github.com/cultureamp/migrations-runner-buildkite-plugin#v1.0.0",
+// is to this plugin
+func isThisPlugin(reference string) bool {
+	reference, _, _ = strings.Cut(reference, "#")
+	name := strings.TrimSuffix(strings.TrimSuffix(path.Base(reference), ".git"), "-buildkite-plugin")
+
+	return name == pluginName
+}
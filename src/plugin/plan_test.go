@@ -0,0 +1,158 @@
+package plugin_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadApprovalPipeline(t *testing.T) {
+	plugins := `[
+		{"github.com/cultureamp/aws-assume-role-buildkite-plugin#v0.2.0": {"role": "arn:aws:iam::123456789012:role/deploy-role-cool-service"}},
+		{"github.com/cultureamp/migrations-runner-buildkite-plugin#v1.0.0": {"parameter-name": "/cool-service/migrations", "command": "bin/rails db:migrate PRICE=$$5", "plan-command": "bin/rails db:migrate:status", "require-approval": true}}
+	]`
+
+	t.Run("given a step awaiting approval, it should upload a block step and the step without its approval options", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+		config := plugin.Config{
+			ParameterNames: []string{"/cool-service/migrations"},
+			Build:          plugin.BuildEnvironment{Label: ":database: Migrate", Plugins: plugins, AgentQueue: "deploy"},
+		}
+
+		err := trp.UploadApprovalPipeline(context.TODO(), bkAgent, config)
+
+		require.NoError(t, err)
+		require.Len(t, bkAgent.pipelines, 1)
+		assert.JSONEq(t, `{
+			"steps": [
+				{"block": ":clipboard: Run migrations for /cool-service/migrations?", "prompt": "Review the plan in the build's annotations before running the migrations"},
+				{
+					"label": ":database: Migrate",
+					"agents": {"queue": "deploy"},
+					"plugins": [
+						{"github.com/cultureamp/aws-assume-role-buildkite-plugin#v0.2.0": {"role": "arn:aws:iam::123456789012:role/deploy-role-cool-service"}},
+						{"github.com/cultureamp/migrations-runner-buildkite-plugin#v1.0.0": {"parameter-name": "/cool-service/migrations", "command": "bin/rails db:migrate PRICE=$$$$5"}}
+					]
+				}
+			]
+		}`, bkAgent.pipelines[0])
+	})
+
+	t.Run("given the approval agents, env and a step timeout, it should give them to the step", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+		config := plugin.Config{
+			ParameterNames: []string{"/cool-service/migrations"},
+			Build: plugin.BuildEnvironment{
+				Label:      ":database: Migrate",
+				AgentQueue: "deploy",
+				Timeout:    "30",
+				Plugins: `[{"github.com/cultureamp/migrations-runner-buildkite-plugin#v1.0.0": {
+					"parameter-name": "/cool-service/migrations",
+					"require-approval": true,
+					"approval-agents": {"queue": "deploy", "os-family": "linux"},
+					"approval-env": {"AWS_REGION": "us-west-2"}
+				}}]`,
+			},
+		}
+
+		err := trp.UploadApprovalPipeline(context.TODO(), bkAgent, config)
+
+		require.NoError(t, err)
+		require.Len(t, bkAgent.pipelines, 1)
+		assert.JSONEq(t, `{
+			"steps": [
+				{"block": ":clipboard: Run migrations for /cool-service/migrations?", "prompt": "Review the plan in the build's annotations before running the migrations"},
+				{
+					"label": ":database: Migrate",
+					"agents": {"queue": "deploy", "os-family": "linux"},
+					"env": {"AWS_REGION": "us-west-2"},
+					"timeout_in_minutes": 30,
+					"plugins": [
+						{"github.com/cultureamp/migrations-runner-buildkite-plugin#v1.0.0": {"parameter-name": "/cool-service/migrations"}}
+					]
+				}
+			]
+		}`, bkAgent.pipelines[0])
+	})
+
+	t.Run("given the plugin is not in the step's plugins, it should fail", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+		config := plugin.Config{Build: plugin.BuildEnvironment{Plugins: `[{"github.com/cultureamp/aws-assume-role-buildkite-plugin#v0.2.0": {}}]`}}
+
+		err := trp.UploadApprovalPipeline(context.TODO(), bkAgent, config)
+
+		assert.EqualError(t, err, "failed to create the steps to run the migrations once approved: the migrations-runner plugin is not in BUILDKITE_PLUGINS")
+		assert.Empty(t, bkAgent.pipelines)
+	})
+
+	t.Run("given the pipeline, it should be valid JSON once unescaped", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		err := trp.UploadApprovalPipeline(context.TODO(), bkAgent, plugin.Config{Build: plugin.BuildEnvironment{Plugins: plugins, Timeout: "false"}})
+
+		require.NoError(t, err)
+		assert.True(t, json.Valid([]byte(bkAgent.pipelines[0])))
+		assert.Contains(t, bkAgent.pipelines[0], `"label":":database: Run migrations"`)
+		assert.NotContains(t, bkAgent.pipelines[0], "agents")
+		assert.NotContains(t, bkAgent.pipelines[0], "timeout_in_minutes")
+	})
+}
+
+func TestFetchPlanFromEnvironment(t *testing.T) {
+	fetcher := plugin.EnvironmentConfigFetcher{}
+
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PARAMETER_NAME", "test-parameter")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_PLAN_COMMAND", "bin/rails db:migrate:status")
+	t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_REQUIRE_APPROVAL", "true")
+
+	t.Run("outside a Buildkite job", func(t *testing.T) {
+		var config plugin.Config
+
+		unsetEnv(t, "BUILDKITE_PLUGINS")
+
+		err := fetcher.Fetch(&config)
+		assert.EqualError(t, err, "require-approval can only be used in a Buildkite job")
+	})
+
+	t.Run("in a Buildkite job", func(t *testing.T) {
+		var config plugin.Config
+
+		t.Setenv("BUILDKITE_PLUGINS", `[{"github.com/cultureamp/migrations-runner-buildkite-plugin#v1.0.0": {}}]`)
+
+		err := fetcher.Fetch(&config)
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"bin/rails", "db:migrate:status"}, config.PlanCommandArgs)
+		assert.True(t, config.RequireApproval)
+	})
+
+	t.Run("approval agents without require-approval", func(t *testing.T) {
+		var config plugin.Config
+
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_REQUIRE_APPROVAL", "false")
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_APPROVAL_AGENTS_QUEUE", "deploy")
+
+		err := fetcher.Fetch(&config)
+		assert.EqualError(t, err, "approval-agents can only be used with require-approval")
+	})
+
+	t.Run("a stage with the plan's name", func(t *testing.T) {
+		var config plugin.Config
+
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_REQUIRE_APPROVAL", "false")
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_NAME", "plan")
+		t.Setenv("BUILDKITE_PLUGIN_MIGRATIONS_RUNNER_STAGES_0_COMMAND", "bin/rails db:migrate")
+
+		err := fetcher.Fetch(&config)
+		assert.EqualError(t, err, `stage name "plan" is used by plan-command`)
+	})
+}
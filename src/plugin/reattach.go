@@ -0,0 +1,118 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// The task started for each parameter (and stage) in a step, and the task whose result has been reported for it, are recorded in
+// build meta-data. Meta-data is shared by every attempt of a step, so a retried job can find a task started by an
+// attempt that was lost.
+const (
+	taskArnMetaDataKeyFormat         = "migrations-runner-task-arn-%s-%s"
+	reportedTaskArnMetaDataKeyFormat = "migrations-runner-reported-task-arn-%s-%s"
+)
+
+// InFlightTask returns the ARN of a task started by a previous attempt of the step that has not had its result
+// reported, so that it can be attached to instead of running the migration a second time. This is the case whether
+// the task is still running or has stopped since the previous attempt was lost, unless the plugin stopped it itself.
+// An empty ARN means there is no such task and a new one should be run.
+func (trp TaskRunnerPlugin) InFlightTask(ctx context.Context, ecsClient awsinternal.EcsClientAPI, bkAgent buildkite.AgentAPI, config Config) (string, error) {
+	log := buildkite.LoggerFrom(ctx)
+
+	// Outside of Buildkite there is no step to record the task against
+	if config.Build.StepID == "" {
+		return "", nil
+	}
+
+	taskArn, err := bkAgent.GetMetaData(ctx, metaDataKey(taskArnMetaDataKeyFormat, config))
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve the task started by a previous attempt: %w", err)
+	}
+
+	if taskArn == "" {
+		return "", nil
+	}
+
+	reportedTaskArn, err := bkAgent.GetMetaData(ctx, metaDataKey(reportedTaskArnMetaDataKeyFormat, config))
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve the task reported by a previous attempt: %w", err)
+	}
+
+	if reportedTaskArn == taskArn {
+		log.Logf("Task %s started by a previous attempt has already completed, starting a new task\n", taskArn)
+		return "", nil
+	}
+
+	task, found, err := awsinternal.DescribeTask(ctx, ecsClient, taskArn)
+	if err != nil {
+		return "", fmt.Errorf("failed to describe task %s started by a previous attempt: %w", taskArn, err)
+	}
+
+	if !found {
+		log.Logf("Task %s started by a previous attempt no longer exists, starting a new task\n", taskArn)
+		return "", nil
+	}
+
+	// Normally recorded as reported when stopped, but the attempt may have been lost before it could be recorded
+	if stoppedByPlugin(task) {
+		log.Logf("Task %s started by a previous attempt was stopped: %s, starting a new task\n", taskArn, aws.ToString(task.StoppedReason))
+		return "", nil
+	}
+
+	log.Logf("Attaching to task %s started by a previous attempt, last status: %s\n", taskArn, aws.ToString(task.LastStatus))
+
+	return taskArn, nil
+}
+
+// stoppedByPlugin reports whether the task was stopped by an attempt of the step that stopped waiting on it
+func stoppedByPlugin(task types.Task) bool {
+	if task.StopCode != types.TaskStopCodeUserInitiated {
+		return false
+	}
+
+	switch aws.ToString(task.StoppedReason) {
+	case abandonReasonCancelled, abandonReasonTimedOut, abandonReasonStuckPending:
+		return true
+	default:
+		return false
+	}
+}
+
+// RecordTask records the task started for the step, so that a retry of the job can attach to it. Failing to record
+// the task is logged rather than returned, as the task is already running by this point.
+func (trp TaskRunnerPlugin) RecordTask(ctx context.Context, bkAgent buildkite.AgentAPI, config Config, taskArn string) {
+	recordMetaData(ctx, bkAgent, taskArnMetaDataKeyFormat, config, taskArn)
+}
+
+// RecordTaskReported records that the result of the task has been reported, or that the plugin stopped it, so a retry
+// of the job runs a new task rather than reporting the same result again.
+func (trp TaskRunnerPlugin) RecordTaskReported(ctx context.Context, bkAgent buildkite.AgentAPI, config Config, taskArn string) {
+	recordMetaData(ctx, bkAgent, reportedTaskArnMetaDataKeyFormat, config, taskArn)
+}
+
+func recordMetaData(ctx context.Context, bkAgent buildkite.AgentAPI, keyFormat string, config Config, taskArn string) {
+	if config.Build.StepID == "" {
+		return
+	}
+
+	err := bkAgent.SetMetaData(ctx, metaDataKey(keyFormat, config), taskArn)
+	if err != nil {
+		buildkite.LoggerFrom(ctx).LogFailuref("failed to record task %s in build meta-data, a retry of this job will start a new task... %v\n", taskArn, err)
+	}
+}
+
+func metaDataKey(keyFormat string, config Config) string {
+	key := fmt.Sprintf(keyFormat, config.Build.StepID, config.ParameterName)
+	if config.Stage != "" {
+		key += "-" + config.Stage
+	}
+
+	return key
+}
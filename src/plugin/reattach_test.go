@@ -0,0 +1,116 @@
+package plugin_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInFlightTask(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/abc123"
+	runningTask := types.Task{TaskArn: aws.String(taskArn), LastStatus: aws.String("RUNNING")}
+	stoppedTask := types.Task{TaskArn: aws.String(taskArn), LastStatus: aws.String("STOPPED")}
+	cancelledTask := types.Task{
+		TaskArn:       aws.String(taskArn),
+		LastStatus:    aws.String("STOPPED"),
+		StopCode:      types.TaskStopCodeUserInitiated,
+		StoppedReason: aws.String("Buildkite job was cancelled"),
+	}
+
+	tests := []struct {
+		name     string
+		stepID   string
+		metaData map[string]string
+		tasks    []types.Task
+		expected string
+	}{
+		{
+			name:     "given no step, it should start a new task",
+			metaData: map[string]string{"migrations-runner-task-arn--/cool-service/migrations": taskArn},
+			tasks:    []types.Task{runningTask},
+		},
+		{
+			name:   "given no task was started by a previous attempt, it should start a new task",
+			stepID: "step-1",
+		},
+		{
+			name:     "given a running task started by a previous attempt, it should attach to it",
+			stepID:   "step-1",
+			metaData: map[string]string{"migrations-runner-task-arn-step-1-/cool-service/migrations": taskArn},
+			tasks:    []types.Task{runningTask},
+			expected: taskArn,
+		},
+		{
+			name:     "given a task that stopped without its result being reported, it should attach to it",
+			stepID:   "step-1",
+			metaData: map[string]string{"migrations-runner-task-arn-step-1-/cool-service/migrations": taskArn},
+			tasks:    []types.Task{stoppedTask},
+			expected: taskArn,
+		},
+		{
+			name:   "given a task whose result has been reported, it should start a new task",
+			stepID: "step-1",
+			metaData: map[string]string{
+				"migrations-runner-task-arn-step-1-/cool-service/migrations":          taskArn,
+				"migrations-runner-reported-task-arn-step-1-/cool-service/migrations": taskArn,
+			},
+			tasks: []types.Task{stoppedTask},
+		},
+		{
+			name:     "given a task stopped when a previous attempt was cancelled, it should start a new task",
+			stepID:   "step-1",
+			metaData: map[string]string{"migrations-runner-task-arn-step-1-/cool-service/migrations": taskArn},
+			tasks:    []types.Task{cancelledTask},
+		},
+		{
+			name:     "given a task that no longer exists, it should start a new task",
+			stepID:   "step-1",
+			metaData: map[string]string{"migrations-runner-task-arn-step-1-/cool-service/migrations": taskArn},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bkAgent := &RecordingBuildKiteAgent{metaData: tc.metaData}
+			ecsClient := &MockECSClient{tasks: tc.tasks}
+			trp := plugin.TaskRunnerPlugin{}
+
+			config := plugin.Config{ParameterName: "/cool-service/migrations", Build: plugin.BuildEnvironment{StepID: tc.stepID}}
+
+			inFlightTaskArn, err := trp.InFlightTask(context.TODO(), ecsClient, bkAgent, config)
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, inFlightTaskArn)
+		})
+	}
+}
+
+func TestRecordTask(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/abc123"
+	bkAgent := &RecordingBuildKiteAgent{}
+	ecsClient := &MockECSClient{tasks: []types.Task{{TaskArn: aws.String(taskArn), LastStatus: aws.String("STOPPED")}}}
+	trp := plugin.TaskRunnerPlugin{}
+	config := plugin.Config{ParameterName: "/cool-service/migrations", Build: plugin.BuildEnvironment{StepID: "step-1"}}
+	otherTargetConfig := plugin.Config{ParameterName: "/cool-service/other-migrations", Build: plugin.BuildEnvironment{StepID: "step-1"}}
+
+	trp.RecordTask(context.TODO(), bkAgent, config, taskArn)
+
+	inFlightTaskArn, err := trp.InFlightTask(context.TODO(), ecsClient, bkAgent, otherTargetConfig)
+	require.NoError(t, err)
+	assert.Empty(t, inFlightTaskArn, "tasks should be recorded separately for each parameter")
+
+	inFlightTaskArn, err = trp.InFlightTask(context.TODO(), ecsClient, bkAgent, config)
+	require.NoError(t, err)
+	assert.Equal(t, taskArn, inFlightTaskArn)
+
+	trp.RecordTaskReported(context.TODO(), bkAgent, config, taskArn)
+
+	inFlightTaskArn, err = trp.InFlightTask(context.TODO(), ecsClient, bkAgent, config)
+	require.NoError(t, err)
+	assert.Empty(t, inFlightTaskArn)
+}
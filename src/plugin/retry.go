@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+)
+
+// Backoff is the delay between attempts to run a task that failed for a transient reason
+type Backoff struct {
+	// Base is the delay before the first retry, doubling with each retry after it
+	Base time.Duration
+	// Max caps the delay between retries
+	Max time.Duration
+}
+
+// runTaskBackoff spreads retries out over the first few minutes, which is how long capacity shortages usually last
+var runTaskBackoff = Backoff{Base: 2 * time.Second, Max: 30 * time.Second}
+
+// Delay returns how long to wait before the given retry, counting from zero. The delay is chosen at random up to the
+// exponential backoff ("full jitter"), so concurrent builds that failed together don't retry together.
+func (b Backoff) Delay(retry int) time.Duration {
+	ceiling := b.Base
+	for i := 0; i < retry && ceiling < b.Max; i++ {
+		ceiling *= 2
+	}
+
+	ceiling = min(ceiling, b.Max)
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return rand.N(ceiling)
+}
+
+// SubmitTaskWithRetry runs the task, retrying failures that are likely to be transient, such as a lack of capacity
+// or throttling, until the retry budget is spent. Failures that are not transient, and the last failure once the
+// budget is spent, are annotated with the reason ECS gave.
+//
+// Each attempt sends a client token, so that a request the AWS SDK repeats after losing the response to it returns
+// the task the first request started instead of starting a duplicate migration.
+func (trp TaskRunnerPlugin) SubmitTaskWithRetry(ctx context.Context, ecsClient awsinternal.EcsClientAPI, bkAgent buildkite.AgentAPI, config Config, configuration *awsinternal.TaskRunnerConfiguration, budget time.Duration, backoff Backoff) (string, error) {
+	log := buildkite.LoggerFrom(ctx)
+
+	deadline := time.Now().Add(budget)
+
+	for attempt := 1; ; attempt++ {
+		attemptConfiguration := *configuration
+		attemptConfiguration.ClientToken = clientToken(config, attempt)
+
+		taskArn, repeated, err := awsinternal.SubmitTask(ctx, ecsClient, &attemptConfiguration)
+		if err == nil {
+			if repeated {
+				log.Logf("The request to run the task was repeated, task %s may have been started by an earlier request with the same client token rather than as a new task\n", taskArn)
+			}
+
+			return taskArn, nil
+		}
+
+		delay := backoff.Delay(attempt - 1)
+
+		if !awsinternal.IsTransientRunTaskError(err) || time.Now().Add(delay).After(deadline) {
+			return "", annotateRunTaskFailure(ctx, bkAgent, config, err, attempt)
+		}
+
+		log.LogFailuref("failed to run task on attempt %d, retrying in %s... %v\n", attempt, delay.Round(time.Second), err)
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("job cancelled while retrying task: %w", errors.Join(err, ctx.Err()))
+		case <-time.After(delay):
+		}
+	}
+}
+
+// annotateRunTaskFailure reports why the task could not be run, returning the failure
+func annotateRunTaskFailure(ctx context.Context, bkAgent buildkite.AgentAPI, config Config, err error, attempts int) error {
+	message := fmt.Sprintf("Task could not be started: %v", err)
+	if attempts > 1 {
+		message = fmt.Sprintf("Task could not be started after %d attempts: %v", attempts, err)
+		err = fmt.Errorf("gave up after %d attempts: %w", attempts, err)
+	}
+
+	bkerr := bkAgent.Annotate(ctx, message, "error", taskAnnotationContext(config))
+	if bkerr != nil {
+		return errors.Join(err, fmt.Errorf("failed to annotate buildkite with run task failure: %w", bkerr))
+	}
+
+	return err
+}
+
+// clientToken identifies an attempt to run the task, so that repeating the request to run it returns the same task
+// within ECS's idempotency window. It differs for each retry of the job, and for each target, stage and attempt within
+// the job: a retry is only made after ECS reported that no task was started. Outside of Buildkite there is no job to
+// identify, so no token is used.
+func clientToken(config Config, attempt int) string {
+	if config.Build.JobID == "" {
+		return ""
+	}
+
+	// the hex of a SHA-256 is 64 characters, the most ECS allows in a client token
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		config.Build.BuildID,
+		config.Build.JobID,
+		strconv.Itoa(config.Build.RetryCount),
+		config.ParameterName,
+		config.Stage,
+		strconv.Itoa(attempt),
+	}, "\x00")))
+
+	return hex.EncodeToString(sum[:])
+}
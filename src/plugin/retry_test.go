@@ -0,0 +1,277 @@
+package plugin_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runTaskResponse is one response from ecs:RunTask, either an output or an error
+type runTaskResponse struct {
+	output *ecs.RunTaskOutput
+	err    error
+}
+
+// sequenceECSClient returns each of its responses to ecs:RunTask in turn, repeating the last one
+type sequenceECSClient struct {
+	awsinternal.EcsClientAPI
+
+	responses    []runTaskResponse
+	calls        int
+	clientTokens []string
+}
+
+func (m *sequenceECSClient) RunTask(ctx context.Context, params *ecs.RunTaskInput, optFns ...func(*ecs.Options)) (*ecs.RunTaskOutput, error) {
+	response := m.responses[min(m.calls, len(m.responses)-1)]
+	m.calls++
+	m.clientTokens = append(m.clientTokens, aws.ToString(params.ClientToken))
+
+	return response.output, response.err
+}
+
+func failedToRun(reason string) runTaskResponse {
+	return runTaskResponse{output: &ecs.RunTaskOutput{Failures: []types.Failure{{Reason: aws.String(reason)}}}}
+}
+
+func TestSubmitTaskWithRetry(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"
+	started := runTaskResponse{output: &ecs.RunTaskOutput{Tasks: []types.Task{{TaskArn: aws.String(taskArn)}}}}
+	throttled := runTaskResponse{err: &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}}
+
+	backoff := plugin.Backoff{Base: time.Millisecond, Max: 2 * time.Millisecond}
+
+	tests := []struct {
+		name               string
+		responses          []runTaskResponse
+		budget             time.Duration
+		expectedCalls      int
+		expectedErr        string
+		expectedAnnotation string
+	}{
+		{
+			name:          "given a task that starts, it should return its ARN",
+			responses:     []runTaskResponse{started},
+			budget:        time.Minute,
+			expectedCalls: 1,
+		},
+		{
+			name:          "given transient failures, it should retry until the task starts",
+			responses:     []runTaskResponse{failedToRun("RESOURCE:ENI"), throttled, failedToRun("Capacity is unavailable at this time"), started},
+			budget:        time.Minute,
+			expectedCalls: 4,
+		},
+		{
+			name:               "given a permanent failure, it should not retry",
+			responses:          []runTaskResponse{failedToRun("MISSING"), started},
+			budget:             time.Minute,
+			expectedCalls:      1,
+			expectedErr:        "ecs:RunTask failed to start the task: MISSING",
+			expectedAnnotation: "Task could not be started: ecs:RunTask failed to start the task: MISSING",
+		},
+		{
+			name:               "given transient failures that outlast the budget, it should give up",
+			responses:          []runTaskResponse{failedToRun("RESOURCE:ENI")},
+			budget:             20 * time.Millisecond,
+			expectedErr:        "gave up after",
+			expectedAnnotation: "capacity is unavailable to run the task: RESOURCE:ENI",
+		},
+		{
+			name:               "given no budget, it should not retry",
+			responses:          []runTaskResponse{failedToRun("RESOURCE:ENI"), started},
+			expectedCalls:      1,
+			expectedErr:        "capacity is unavailable to run the task: RESOURCE:ENI",
+			expectedAnnotation: "Task could not be started: capacity is unavailable to run the task: RESOURCE:ENI",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ecsClient := &sequenceECSClient{responses: tc.responses}
+			bkAgent := &RecordingBuildKiteAgent{}
+			trp := plugin.TaskRunnerPlugin{}
+
+			config := plugin.Config{ParameterName: "/cool-service/migrations"}
+
+			result, err := trp.SubmitTaskWithRetry(context.TODO(), ecsClient, bkAgent, config, &awsinternal.TaskRunnerConfiguration{}, tc.budget, backoff)
+
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+				assert.Equal(t, taskArn, result)
+				assert.Empty(t, bkAgent.annotations)
+			} else {
+				require.ErrorContains(t, err, tc.expectedErr)
+				require.Len(t, bkAgent.annotations, 1)
+				assert.Contains(t, bkAgent.annotations[0], tc.expectedAnnotation)
+				assert.Equal(t, []string{"migrations-runner-task-/cool-service/migrations"}, bkAgent.annotationContexts)
+			}
+
+			if tc.expectedCalls > 0 {
+				assert.Equal(t, tc.expectedCalls, ecsClient.calls)
+			}
+		})
+	}
+}
+
+// flakyHTTPClient fails the first of the requests made through it with a server error, which the AWS SDK retries, and
+// answers the others by running the task
+type flakyHTTPClient struct {
+	failFirst bool
+	requests  int
+}
+
+func (c *flakyHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.requests++
+
+	status, body := http.StatusOK, `{"tasks": [{"taskArn": "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/abc123"}], "failures": []}`
+	if c.failFirst && c.requests == 1 {
+		status, body = http.StatusInternalServerError, `{"__type": "ServerException", "message": "internal error"}`
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/x-amz-json-1.1"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestSubmitTaskWithRetryRepeatedRequest(t *testing.T) {
+	config := plugin.Config{
+		ParameterName: "test-parameter",
+		Build:         plugin.BuildEnvironment{BuildID: "build-1", JobID: "job-1"},
+	}
+
+	tests := []struct {
+		name      string
+		failFirst bool
+		logged    bool
+	}{
+		{
+			name:      "given the SDK repeated the request to run the task, it should log that the task may have been started by an earlier request",
+			failFirst: true,
+			logged:    true,
+		},
+		{
+			name:      "given a single request to run the task, it should not log it",
+			failFirst: false,
+			logged:    false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var output bytes.Buffer
+
+			ctx := buildkite.WithLogger(context.TODO(), buildkite.NewLogger(&output))
+			ecsClient := ecs.New(ecs.Options{
+				Region:      "us-west-2",
+				Credentials: aws.AnonymousCredentials{},
+				HTTPClient:  &flakyHTTPClient{failFirst: tc.failFirst},
+				Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+					o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+				}),
+			})
+			trp := plugin.TaskRunnerPlugin{}
+
+			taskArn, err := trp.SubmitTaskWithRetry(ctx, ecsClient, &RecordingBuildKiteAgent{}, config, &awsinternal.TaskRunnerConfiguration{}, time.Minute, plugin.Backoff{})
+
+			require.NoError(t, err)
+			assert.Equal(t, "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/abc123", taskArn)
+
+			if tc.logged {
+				assert.Contains(t, output.String(), "task arn:aws:ecs:us-west-2:123456789012:task/test-cluster/abc123 may have been started by an earlier request with the same client token")
+			} else {
+				assert.NotContains(t, output.String(), "earlier request")
+			}
+		})
+	}
+}
+
+func TestSubmitTaskWithRetryClientToken(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"
+	started := runTaskResponse{output: &ecs.RunTaskOutput{Tasks: []types.Task{{TaskArn: aws.String(taskArn)}}}}
+	backoff := plugin.Backoff{Base: time.Millisecond, Max: 2 * time.Millisecond}
+
+	config := plugin.Config{
+		ParameterName: "test-parameter",
+		Build:         plugin.BuildEnvironment{BuildID: "build-1", JobID: "job-1", RetryCount: 0},
+	}
+
+	submit := func(config plugin.Config, responses ...runTaskResponse) []string {
+		ecsClient := &sequenceECSClient{responses: responses}
+		trp := plugin.TaskRunnerPlugin{}
+
+		_, err := trp.SubmitTaskWithRetry(context.TODO(), ecsClient, &RecordingBuildKiteAgent{}, config, &awsinternal.TaskRunnerConfiguration{}, time.Minute, backoff)
+		require.NoError(t, err)
+
+		return ecsClient.clientTokens
+	}
+
+	t.Run("given the same job, it should send the same token", func(t *testing.T) {
+		first := submit(config, started)
+		second := submit(config, started)
+
+		require.Len(t, first, 1)
+		assert.Len(t, first[0], 64)
+		assert.Equal(t, first, second)
+	})
+
+	t.Run("given a retry after a failure, it should send a new token", func(t *testing.T) {
+		tokens := submit(config, failedToRun("RESOURCE:ENI"), started)
+
+		require.Len(t, tokens, 2)
+		assert.NotEqual(t, tokens[0], tokens[1])
+	})
+
+	t.Run("given a retry of the job, another target or another stage, it should send a different token", func(t *testing.T) {
+		retried := config
+		retried.Build.RetryCount = 1
+
+		otherTarget := config
+		otherTarget.ParameterName = "other-parameter"
+
+		otherStage := config
+		otherStage.Stage = "backfill"
+
+		original := submit(config, started)[0]
+
+		assert.NotEqual(t, original, submit(retried, started)[0])
+		assert.NotEqual(t, original, submit(otherTarget, started)[0])
+		assert.NotEqual(t, original, submit(otherStage, started)[0])
+	})
+
+	t.Run("given no Buildkite job, it should not send a token", func(t *testing.T) {
+		assert.Equal(t, []string{""}, submit(plugin.Config{}, started))
+	})
+}
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := plugin.Backoff{Base: 2 * time.Second, Max: 30 * time.Second}
+
+	for retry, ceiling := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second} {
+		for range 20 {
+			delay := backoff.Delay(retry)
+
+			assert.GreaterOrEqual(t, delay, time.Duration(0))
+			assert.Less(t, delay, ceiling, "retry %d", retry)
+		}
+	}
+
+	assert.Less(t, backoff.Delay(1000), 30*time.Second)
+}
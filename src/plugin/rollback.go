@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+)
+
+// rollbackStageName is the stage the rollback command runs as, keeping its task, annotation and meta-data apart from
+// those of the migrations
+const rollbackStageName = "rollback"
+
+// shouldRollBack is whether the failure of the migrations calls for the rollback command. Only a task that ran and
+// exited non-zero is rolled back: a task that didn't start changed nothing, and one that timed out may still be running.
+func shouldRollBack(config Config, failure error) bool {
+	var nonZeroExit *awsinternal.NonZeroExitError
+
+	return config.RollbackOnFailure && errors.As(failure, &nonZeroExit)
+}
+
+// rollBack runs the rollback command as a task of its own once the migrations have failed. The step fails with the
+// failure of the migrations whether or not the rollback succeeds, so the exit code of the step still describes it.
+func (trp TaskRunnerPlugin) rollBack(ctx context.Context, cloudwatchClient awsinternal.CloudWatchLogsClientAPI, waiter WaitForCompletion, bkAgent buildkite.AgentAPI, ecsClient awsinternal.EcsClientAPI, config Config, configuration *awsinternal.TaskRunnerConfiguration, failure error) error {
+	log := buildkite.LoggerFrom(ctx)
+
+	log.Logf("==> Migrations failed, running rollback command: %v\n", failure)
+
+	rollbackConfig, rollbackConfiguration := forRollback(config, configuration)
+
+	_, err := trp.runTaskToCompletion(ctx, cloudwatchClient, waiter, bkAgent, ecsClient, rollbackConfig, rollbackConfiguration)
+	if err != nil {
+		log.LogFailuref("rollback failed: %v\n", err)
+	} else {
+		log.Log("Rollback completed successfully\n")
+	}
+
+	return rollbackFailure(failure, err)
+}
+
+// rollbackFailure is the failure of the migrations, noting whether they were rolled back. The rollback's error is not
+// wrapped, as it is the failure of the migrations that sets the exit code.
+func rollbackFailure(failure error, rollbackErr error) error {
+	if rollbackErr != nil {
+		return errors.Join(failure, fmt.Errorf("rollback failed: %v", rollbackErr))
+	}
+
+	return fmt.Errorf("%w, rolled back", failure)
+}
+
+// forRollback returns the plugin and task configuration for running the rollback command
+func forRollback(config Config, configuration *awsinternal.TaskRunnerConfiguration) (Config, *awsinternal.TaskRunnerConfiguration) {
+	config.Stage = rollbackStageName
+	config.Rollback = true
+
+	rollbackConfiguration := *configuration
+	rollbackConfiguration.Command = config.RollbackCommandArgs
+
+	return config, &rollbackConfiguration
+}
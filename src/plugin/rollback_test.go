@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShouldRollBack(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"
+	timeout := &awsinternal.TimeoutError{TaskArn: taskArn, Timeout: time.Hour}
+
+	tests := []struct {
+		name              string
+		rollbackOnFailure bool
+		failure           error
+		expected          bool
+	}{
+		{
+			name:              "given a task that exited non-zero, it should roll back",
+			rollbackOnFailure: true,
+			failure:           &awsinternal.NonZeroExitError{Container: "migrations-runner", ExitCode: 1},
+			expected:          true,
+		},
+		{
+			name:              "given a task that exited non-zero, when the failure is wrapped, it should roll back",
+			rollbackOnFailure: true,
+			failure:           fmt.Errorf("failed to handle task results: %w", &awsinternal.NonZeroExitError{Container: "migrations-runner", ExitCode: 1}),
+			expected:          true,
+		},
+		{
+			name:              "given a task that exited non-zero, when rollback-on-failure is not set, it should not roll back",
+			rollbackOnFailure: false,
+			failure:           &awsinternal.NonZeroExitError{Container: "migrations-runner", ExitCode: 1},
+		},
+		{
+			name:              "given a task that succeeded, it should not roll back",
+			rollbackOnFailure: true,
+		},
+		{
+			name:              "given a task that timed out, it should not roll back",
+			rollbackOnFailure: true,
+			failure:           fmt.Errorf("failed to handle task results: %w", timeout),
+		},
+		{
+			name:              "given a task that timed out and was left running, it should not roll back",
+			rollbackOnFailure: true,
+			failure:           &TaskLeftRunningError{TaskArn: taskArn, Err: timeout},
+		},
+		{
+			name:              "given a task that failed to start, it should not roll back",
+			rollbackOnFailure: true,
+			failure:           &awsinternal.TaskFailedToStartError{TaskArn: taskArn, Reason: "CannotPullContainerError"},
+		},
+		{
+			name:              "given a task stuck pending, it should not roll back",
+			rollbackOnFailure: true,
+			failure:           &awsinternal.StuckPendingError{TaskArn: taskArn, Status: "PROVISIONING", PendingTimeout: time.Minute},
+		},
+		{
+			name:              "given a task that could not be placed, it should not roll back",
+			rollbackOnFailure: true,
+			failure:           &awsinternal.CapacityUnavailableError{Reason: "RESOURCE:ENI"},
+		},
+		{
+			name:              "given a job that was cancelled, it should not roll back",
+			rollbackOnFailure: true,
+			failure:           fmt.Errorf("job cancelled while waiting for task: %w", context.Canceled),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{RollbackOnFailure: tc.rollbackOnFailure}
+
+			assert.Equal(t, tc.expected, shouldRollBack(config, tc.failure))
+		})
+	}
+}
+
+func TestRollbackFailure(t *testing.T) {
+	failure := fmt.Errorf("failed to handle task results: %w", &awsinternal.NonZeroExitError{Container: "migrations-runner", ExitCode: 1})
+
+	tests := []struct {
+		name        string
+		rollbackErr error
+		expectedErr string
+	}{
+		{
+			name:        "given a rollback that succeeded, it should note it on the failure of the migrations",
+			expectedErr: failure.Error() + ", rolled back",
+		},
+		{
+			name:        "given a rollback that exited non-zero, it should add its failure",
+			rollbackErr: &awsinternal.NonZeroExitError{Container: "migrations-runner", ExitCode: 2},
+			expectedErr: failure.Error() + "\nrollback failed: " + (&awsinternal.NonZeroExitError{Container: "migrations-runner", ExitCode: 2}).Error(),
+		},
+		{
+			name:        "given a rollback that timed out, it should keep the exit code of the migrations",
+			rollbackErr: &awsinternal.TimeoutError{TaskArn: "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/abc123", Timeout: time.Hour},
+		},
+		{
+			name:        "given a rollback that was not permitted, it should keep the exit code of the migrations",
+			rollbackErr: &awsinternal.PermissionDeniedError{Operation: "ecs:RunTask", Err: fmt.Errorf("not authorized")},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := rollbackFailure(failure, tc.rollbackErr)
+
+			require.ErrorIs(t, err, failure)
+			assert.Equal(t, ExitCodeNonZeroExit, ExitCode(err))
+
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
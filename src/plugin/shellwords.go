@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"errors"
+	"strings"
+)
+
+// splitCommand splits a command into its arguments following POSIX shell quoting rules. Single quotes preserve
+// everything up to the closing quote, double quotes preserve everything except backslash escapes of `$`, "`", `"`,
+// `\` and newlines, and a backslash outside of quotes escapes the following character. No expansion is performed.
+func splitCommand(command string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		// inWord distinguishes an empty quoted argument (`''`) from the space between arguments
+		inWord bool
+	)
+
+	runes := []rune(command)
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, current.String())
+				current.Reset()
+
+				inWord = false
+			}
+		case r == '\\':
+			i++
+			if i == len(runes) {
+				return nil, errors.New("command ends with an unescaped backslash")
+			}
+
+			// a backslash-newline is a line continuation and is removed entirely
+			if runes[i] != '\n' {
+				current.WriteRune(runes[i])
+
+				inWord = true
+			}
+		case r == '\'':
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, errors.New("command has an unterminated single quote")
+			}
+
+			current.WriteString(string(runes[i+1 : end]))
+
+			i = end
+			inWord = true
+		case r == '"':
+			end, err := readDoubleQuoted(runes, i+1, &current)
+			if err != nil {
+				return nil, err
+			}
+
+			i = end
+			inWord = true
+		default:
+			current.WriteRune(r)
+
+			inWord = true
+		}
+	}
+
+	if inWord {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+// readDoubleQuoted writes the contents of a double quoted string starting at start, returning the index of the
+// closing quote
+func readDoubleQuoted(runes []rune, start int, current *strings.Builder) (int, error) {
+	for i := start; i < len(runes); i++ {
+		switch runes[i] {
+		case '"':
+			return i, nil
+		case '\\':
+			if i+1 < len(runes) && strings.ContainsRune("$`\"\\\n", runes[i+1]) {
+				i++
+				if runes[i] != '\n' {
+					current.WriteRune(runes[i])
+				}
+
+				continue
+			}
+
+			current.WriteRune(runes[i])
+		default:
+			current.WriteRune(runes[i])
+		}
+	}
+
+	return -1, errors.New("command has an unterminated double quote")
+}
+
+func indexRune(runes []rune, start int, target rune) int {
+	for i := start; i < len(runes); i++ {
+		if runes[i] == target {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,99 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{
+			name:     "given a space separated command, it should split on each space",
+			input:    "parameter-store-exec bundle exec bin/run_mongodb_migrations",
+			expected: []string{"parameter-store-exec", "bundle", "exec", "bin/run_mongodb_migrations"},
+		},
+		{
+			name:     "given repeated and surrounding whitespace, it should not produce empty arguments",
+			input:    "  rake   db:migrate\t",
+			expected: []string{"rake", "db:migrate"},
+		},
+		{
+			name:     "given a single quoted argument, it should preserve the spaces within it",
+			input:    "rake db:migrate VERSION='1 2'",
+			expected: []string{"rake", "db:migrate", "VERSION=1 2"},
+		},
+		{
+			name:     "given a double quoted argument, it should preserve spaces and process escapes",
+			input:    `echo "a \"quoted\" $HOME \n"`,
+			expected: []string{"echo", `a "quoted" $HOME \n`},
+		},
+		{
+			name:     "given a backslash outside quotes, it should escape the next character",
+			input:    `echo hello\ world \'`,
+			expected: []string{"echo", "hello world", "'"},
+		},
+		{
+			name:     "given empty quotes, it should produce an empty argument",
+			input:    `echo '' ""`,
+			expected: []string{"echo", "", ""},
+		},
+		{
+			name:     "given a line continuation, it should remove it",
+			input:    "echo hello \\\nworld",
+			expected: []string{"echo", "hello", "world"},
+		},
+		{
+			name:     "given an empty command, it should produce no arguments",
+			input:    "",
+			expected: nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := splitCommand(tc.input)
+
+			t.Logf("result: %q", result)
+			t.Logf("expected: %q", tc.expected)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+}
+
+func TestSplitCommandErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expectedErr string
+	}{
+		{
+			name:        "given an unterminated single quote, it should return an error",
+			input:       "rake db:migrate VERSION='1 2",
+			expectedErr: "command has an unterminated single quote",
+		},
+		{
+			name:        "given an unterminated double quote, it should return an error",
+			input:       `echo "hello`,
+			expectedErr: "command has an unterminated double quote",
+		},
+		{
+			name:        "given a trailing backslash, it should return an error",
+			input:       `echo hello\`,
+			expectedErr: "command ends with an unescaped backslash",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := splitCommand(tc.input)
+			require.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+)
+
+const (
+	// snapshotPollInterval is how often the snapshot is checked while it is being created
+	snapshotPollInterval = 15 * time.Second
+	// snapshotAnnotationContext keeps the snapshot's annotation separate from those reporting on the tasks
+	snapshotAnnotationContext = "migrations-runner-snapshot"
+	// snapshotTimestampFormat is the format of the time given to the snapshot name template
+	snapshotTimestampFormat = "20060102150405"
+	// maxSnapshotIDLength is the longest identifier RDS accepts for a snapshot
+	maxSnapshotIDLength = 255
+	// snapshotMetaDataKeyFormat is the key the snapshot taken for a step is recorded under, so a retry of the step
+	// uses it rather than taking a snapshot of a database that may already have been migrated
+	snapshotMetaDataKeyFormat = "migrations-runner-snapshot-id-%s"
+)
+
+var (
+	snapshotIDInvalidCharacters = regexp.MustCompile(`[^a-z0-9-]+`)
+	snapshotIDRepeatedHyphens   = regexp.MustCompile(`-{2,}`)
+)
+
+// snapshotNameData are the values given to the snapshot name template
+type snapshotNameData struct {
+	// Identifier is of the DB instance or cluster
+	Identifier string
+	// BuildNumber is empty outside of Buildkite
+	BuildNumber string
+	// Timestamp is when the snapshot is taken, in UTC, e.g. 20240102150405
+	Timestamp string
+}
+
+// StepSnapshot is the snapshot taken for the step, shared by its targets so it is taken once before the first of them
+// starts a task
+type StepSnapshot struct {
+	mu sync.Mutex
+	id string
+}
+
+// SnapshotBeforeMigrations takes the snapshot for the step before the target starts a new task. The snapshot taken by
+// a previous attempt of the step, or for another of its targets, is used instead when there is one, and none is taken
+// when attaching to a task started by a previous attempt, as the database may already have been migrated.
+func (trp TaskRunnerPlugin) SnapshotBeforeMigrations(ctx context.Context, rdsClient awsinternal.RDSAPI, ecsClient awsinternal.EcsClientAPI, bkAgent buildkite.AgentAPI, config Config, snapshot *StepSnapshot) error {
+	log := buildkite.LoggerFrom(ctx)
+
+	snapshot.mu.Lock()
+	defer snapshot.mu.Unlock()
+
+	if snapshot.id != "" {
+		return nil
+	}
+
+	// Outside of Buildkite there is no step to record the snapshot against
+	if config.Build.StepID != "" {
+		snapshotID, err := bkAgent.GetMetaData(ctx, fmt.Sprintf(snapshotMetaDataKeyFormat, config.Build.StepID))
+		if err != nil {
+			return fmt.Errorf("failed to retrieve the snapshot taken by a previous attempt: %w", err)
+		}
+
+		if snapshotID != "" {
+			log.Logf("Using snapshot %s taken by a previous attempt, not taking another\n", snapshotID)
+			snapshot.id = snapshotID
+
+			return nil
+		}
+	}
+
+	newTask, err := trp.startsNewTask(ctx, ecsClient, bkAgent, config)
+	if err != nil {
+		return err
+	}
+
+	if !newTask {
+		log.Log("Not taking a snapshot, the migrations were started by a previous attempt\n")
+		return nil
+	}
+
+	snapshotID, err := trp.SnapshotDatabase(ctx, rdsClient, bkAgent, config, snapshotPollInterval)
+	if err != nil {
+		return err
+	}
+
+	snapshot.id = snapshotID
+
+	if config.Build.StepID != "" {
+		err := bkAgent.SetMetaData(ctx, fmt.Sprintf(snapshotMetaDataKeyFormat, config.Build.StepID), snapshotID)
+		if err != nil {
+			log.LogFailuref("failed to record snapshot %s in build meta-data, a retry of this job will take another... %v\n", snapshotID, err)
+		}
+	}
+
+	return nil
+}
+
+// startsNewTask reports whether the migrations for the target start a new task, rather than attaching to one started
+// by a previous attempt. When run in stages, this is the task of the first stage.
+func (trp TaskRunnerPlugin) startsNewTask(ctx context.Context, ecsClient awsinternal.EcsClientAPI, bkAgent buildkite.AgentAPI, config Config) (bool, error) {
+	if config.ForceNewTask {
+		return true, nil
+	}
+
+	if len(config.Stages) > 0 {
+		config.Stage = config.Stages[0].Name
+	}
+
+	taskArn, err := trp.InFlightTask(ctx, ecsClient, bkAgent, config)
+	if err != nil {
+		return false, err
+	}
+
+	return taskArn == "", nil
+}
+
+// SnapshotDatabase takes a snapshot of the database and waits for it to become available, so there is something to
+// restore if the migrations go wrong. The snapshot is annotated and published as meta-data, then the snapshots taken by
+// the plugin beyond the number to retain are deleted. The migrations are not run when the snapshot fails.
+func (trp TaskRunnerPlugin) SnapshotDatabase(ctx context.Context, rdsClient awsinternal.RDSAPI, bkAgent buildkite.AgentAPI, config Config, pollInterval time.Duration) (string, error) {
+	log := buildkite.LoggerFrom(ctx)
+	target := config.Snapshot.Target()
+
+	snapshotID, err := snapshotName(config.Snapshot.Name, snapshotNameData{
+		Identifier:  target.Identifier(),
+		BuildNumber: config.Build.BuildNumber,
+		Timestamp:   time.Now().UTC().Format(snapshotTimestampFormat),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Logf("==> Taking snapshot %s of %s\n", snapshotID, target.Identifier())
+
+	err = awsinternal.CreateSnapshot(ctx, rdsClient, target, snapshotID, config.Build.BuildURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to snapshot %s, the migrations were not run: %w", target.Identifier(), err)
+	}
+
+	poller := awsinternal.SnapshotPoller{
+		API:      rdsClient,
+		Interval: pollInterval,
+		OnProgress: func(snapshot awsinternal.Snapshot) {
+			log.Logf("Snapshot %s is %s (%d%%)\n", snapshot.ID, snapshot.Status, snapshot.PercentProgress)
+		},
+	}
+
+	_, err = poller.WaitForAvailable(ctx, target, snapshotID, time.Duration(config.Snapshot.TimeOut)*time.Second)
+	if err != nil {
+		return snapshotID, fmt.Errorf("failed to snapshot %s, the migrations were not run: %w", target.Identifier(), err)
+	}
+
+	log.Logf("Snapshot %s is available\n", snapshotID)
+
+	bkerr := bkAgent.Annotate(ctx, fmt.Sprintf("Snapshot `%s` of `%s` was taken before running the migrations", snapshotID, target.Identifier()), "info", snapshotAnnotationContext)
+	if bkerr != nil {
+		log.LogFailuref("failed to annotate buildkite with the snapshot, continuing... %v\n", bkerr)
+	}
+
+	publishOutcome(ctx, bkAgent, config, config.MetaDataPrefix+":snapshot-id", snapshotID)
+
+	if config.Snapshot.Retain > 0 {
+		trp.pruneSnapshots(ctx, rdsClient, target, config.Snapshot.Retain, snapshotID)
+	}
+
+	return snapshotID, nil
+}
+
+// pruneSnapshots deletes the snapshots taken by the plugin beyond the newest to retain, always keeping the snapshot
+// just taken. Snapshots taken by anyone else, and those still being created, are left alone. Failing to prune is
+// logged rather than returned, as the snapshot the migrations need has been taken.
+func (trp TaskRunnerPlugin) pruneSnapshots(ctx context.Context, rdsClient awsinternal.RDSAPI, target awsinternal.SnapshotTarget, retain int, snapshotID string) {
+	log := buildkite.LoggerFrom(ctx)
+
+	snapshots, err := awsinternal.ListSnapshots(ctx, rdsClient, target)
+	if err != nil {
+		log.LogFailuref("failed to list snapshots of %s to prune, continuing... %v\n", target.Identifier(), err)
+
+		return
+	}
+
+	kept := 1
+
+	for _, snapshot := range snapshots {
+		if !snapshot.CreatedByPlugin || snapshot.ID == snapshotID || !snapshot.Available() {
+			continue
+		}
+
+		if kept < retain {
+			kept++
+
+			continue
+		}
+
+		err := awsinternal.DeleteSnapshot(ctx, rdsClient, target, snapshot.ID)
+		if err != nil {
+			log.LogFailuref("failed to delete snapshot %s, continuing... %v\n", snapshot.ID, err)
+
+			continue
+		}
+
+		log.Logf("Deleted snapshot %s, retaining the newest %d\n", snapshot.ID, retain)
+	}
+}
+
+// snapshotName renders the snapshot name template into an identifier RDS accepts: lower case letters, digits and
+// single hyphens, starting with a letter
+func snapshotName(name string, data snapshotNameData) (string, error) {
+	tmpl, err := template.New("snapshot").Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid name template: %w", err)
+	}
+
+	var rendered strings.Builder
+
+	err = tmpl.Execute(&rendered, data)
+	if err != nil {
+		return "", fmt.Errorf("invalid name template: %w", err)
+	}
+
+	id := snapshotIDInvalidCharacters.ReplaceAllString(strings.ToLower(rendered.String()), "-")
+	id = snapshotIDRepeatedHyphens.ReplaceAllString(id, "-")
+	id = strings.TrimLeft(id, "-")
+
+	if id != "" && (id[0] < 'a' || id[0] > 'z') {
+		id = "snapshot-" + id
+	}
+
+	if len(id) > maxSnapshotIDLength {
+		id = id[:maxSnapshotIDLength]
+	}
+
+	id = strings.TrimRight(id, "-")
+
+	if id == "" {
+		return "", fmt.Errorf("name template %q does not give a valid snapshot identifier", name)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,275 @@
+package plugin_test
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryRDS is an RDSAPI holding the snapshots of DB instances in memory. Snapshots are created as "creating", and
+// become available once they have been described availableAfter times.
+type memoryRDS struct {
+	snapshots      []types.DBSnapshot
+	describes      map[string]int
+	availableAfter int
+	failCreate     error
+	deleted        []string
+}
+
+func (m *memoryRDS) CreateDBSnapshot(ctx context.Context, params *rds.CreateDBSnapshotInput, optFns ...func(*rds.Options)) (*rds.CreateDBSnapshotOutput, error) {
+	if m.failCreate != nil {
+		return nil, m.failCreate
+	}
+
+	m.snapshots = append(m.snapshots, types.DBSnapshot{
+		DBInstanceIdentifier: params.DBInstanceIdentifier,
+		DBSnapshotIdentifier: params.DBSnapshotIdentifier,
+		Status:               aws.String("creating"),
+		PercentProgress:      aws.Int32(0),
+		SnapshotCreateTime:   aws.Time(time.Now()),
+		TagList:              params.Tags,
+	})
+
+	return &rds.CreateDBSnapshotOutput{}, nil
+}
+
+func (m *memoryRDS) DescribeDBSnapshots(ctx context.Context, params *rds.DescribeDBSnapshotsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBSnapshotsOutput, error) {
+	var found []types.DBSnapshot
+
+	for i, snapshot := range m.snapshots {
+		if params.DBSnapshotIdentifier != nil {
+			if *snapshot.DBSnapshotIdentifier != *params.DBSnapshotIdentifier {
+				continue
+			}
+
+			if m.describes == nil {
+				m.describes = map[string]int{}
+			}
+
+			m.describes[*snapshot.DBSnapshotIdentifier]++
+			if m.describes[*snapshot.DBSnapshotIdentifier] > m.availableAfter {
+				m.snapshots[i].Status = aws.String("available")
+				m.snapshots[i].PercentProgress = aws.Int32(100)
+			}
+		} else if *snapshot.DBInstanceIdentifier != *params.DBInstanceIdentifier {
+			continue
+		}
+
+		found = append(found, m.snapshots[i])
+	}
+
+	return &rds.DescribeDBSnapshotsOutput{DBSnapshots: found}, nil
+}
+
+func (m *memoryRDS) DeleteDBSnapshot(ctx context.Context, params *rds.DeleteDBSnapshotInput, optFns ...func(*rds.Options)) (*rds.DeleteDBSnapshotOutput, error) {
+	m.deleted = append(m.deleted, *params.DBSnapshotIdentifier)
+
+	return &rds.DeleteDBSnapshotOutput{}, nil
+}
+
+func (m *memoryRDS) CreateDBClusterSnapshot(ctx context.Context, params *rds.CreateDBClusterSnapshotInput, optFns ...func(*rds.Options)) (*rds.CreateDBClusterSnapshotOutput, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *memoryRDS) DescribeDBClusterSnapshots(ctx context.Context, params *rds.DescribeDBClusterSnapshotsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBClusterSnapshotsOutput, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *memoryRDS) DeleteDBClusterSnapshot(ctx context.Context, params *rds.DeleteDBClusterSnapshotInput, optFns ...func(*rds.Options)) (*rds.DeleteDBClusterSnapshotOutput, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// pluginSnapshot is an available snapshot of cool-service-db taken by the plugin the given time ago
+func pluginSnapshot(id string, age time.Duration) types.DBSnapshot {
+	return types.DBSnapshot{
+		DBInstanceIdentifier: aws.String("cool-service-db"),
+		DBSnapshotIdentifier: aws.String(id),
+		Status:               aws.String("available"),
+		SnapshotCreateTime:   aws.Time(time.Now().Add(-age)),
+		TagList:              []types.Tag{{Key: aws.String("created-by"), Value: aws.String("migrations-runner-buildkite-plugin")}},
+	}
+}
+
+func snapshotConfig() plugin.Config {
+	return plugin.Config{
+		MetaDataPrefix: "migrations-runner",
+		Snapshot: plugin.SnapshotConfig{
+			DBInstanceIdentifier: "cool-service-db",
+			Name:                 "migrations-runner-{{ .Identifier }}-build-{{ .BuildNumber }}",
+			TimeOut:              60,
+		},
+		Build: plugin.BuildEnvironment{StepID: "step-1", BuildNumber: "42"},
+	}
+}
+
+func TestSnapshotDatabase(t *testing.T) {
+	t.Run("given a DB instance, it should wait for the snapshot and record it", func(t *testing.T) {
+		trp := plugin.TaskRunnerPlugin{}
+		rdsClient := &memoryRDS{availableAfter: 2}
+		bkAgent := &RecordingBuildKiteAgent{}
+
+		snapshotID, err := trp.SnapshotDatabase(context.TODO(), rdsClient, bkAgent, snapshotConfig(), time.Millisecond)
+
+		require.NoError(t, err)
+		assert.Equal(t, "migrations-runner-cool-service-db-build-42", snapshotID)
+		assert.Equal(t, 3, rdsClient.describes[snapshotID])
+		assert.Equal(t, "migrations-runner-cool-service-db-build-42", bkAgent.metaData["migrations-runner:snapshot-id"])
+		require.Len(t, bkAgent.annotations, 1)
+		assert.Contains(t, bkAgent.annotations[0], "Snapshot `migrations-runner-cool-service-db-build-42` of `cool-service-db`")
+	})
+
+	t.Run("given the default name, it should name the snapshot after the database and time", func(t *testing.T) {
+		trp := plugin.TaskRunnerPlugin{}
+		config := snapshotConfig()
+		config.Snapshot.Name = "migrations-runner-{{ .Identifier }}-{{ .Timestamp }}"
+
+		snapshotID, err := trp.SnapshotDatabase(context.TODO(), &memoryRDS{}, &RecordingBuildKiteAgent{}, config, time.Millisecond)
+
+		require.NoError(t, err)
+		assert.Regexp(t, regexp.MustCompile(`^migrations-runner-cool-service-db-\d{14}$`), snapshotID)
+	})
+
+	t.Run("given a name that RDS would not accept, it should make it valid", func(t *testing.T) {
+		trp := plugin.TaskRunnerPlugin{}
+		config := snapshotConfig()
+		config.Snapshot.Name = "{{ .BuildNumber }}__Pre_Migration--{{ .Identifier }}-"
+
+		snapshotID, err := trp.SnapshotDatabase(context.TODO(), &memoryRDS{}, &RecordingBuildKiteAgent{}, config, time.Millisecond)
+
+		require.NoError(t, err)
+		assert.Equal(t, "snapshot-42-pre-migration-cool-service-db", snapshotID)
+	})
+
+	t.Run("given the snapshot can't be created, it should fail without recording it", func(t *testing.T) {
+		trp := plugin.TaskRunnerPlugin{}
+		bkAgent := &RecordingBuildKiteAgent{}
+
+		_, err := trp.SnapshotDatabase(context.TODO(), &memoryRDS{failCreate: fmt.Errorf("DB instance is not available")}, bkAgent, snapshotConfig(), time.Millisecond)
+
+		assert.EqualError(t, err, "failed to snapshot cool-service-db, the migrations were not run: DB instance is not available")
+		assert.Empty(t, bkAgent.metaData)
+		assert.Empty(t, bkAgent.annotations)
+	})
+
+	t.Run("given the snapshot is not available in time, it should fail", func(t *testing.T) {
+		trp := plugin.TaskRunnerPlugin{}
+		config := snapshotConfig()
+		config.Snapshot.TimeOut = 0
+
+		_, err := trp.SnapshotDatabase(context.TODO(), &memoryRDS{availableAfter: 100}, &RecordingBuildKiteAgent{}, config, time.Millisecond)
+
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("given snapshots to retain, it should delete only the oldest taken by the plugin", func(t *testing.T) {
+		trp := plugin.TaskRunnerPlugin{}
+		config := snapshotConfig()
+		config.Snapshot.Retain = 2
+
+		manual := pluginSnapshot("taken-by-hand", 4*time.Hour)
+		manual.TagList = nil
+
+		creating := pluginSnapshot("still-creating", 5*time.Hour)
+		creating.Status = aws.String("creating")
+
+		rdsClient := &memoryRDS{snapshots: []types.DBSnapshot{
+			pluginSnapshot("oldest", 3*time.Hour),
+			manual,
+			pluginSnapshot("newer", time.Hour),
+			pluginSnapshot("older", 2*time.Hour),
+			creating,
+		}}
+
+		_, err := trp.SnapshotDatabase(context.TODO(), rdsClient, &RecordingBuildKiteAgent{}, config, time.Millisecond)
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"older", "oldest"}, rdsClient.deleted)
+	})
+
+	t.Run("given no snapshots to retain, it should not delete any", func(t *testing.T) {
+		trp := plugin.TaskRunnerPlugin{}
+		rdsClient := &memoryRDS{snapshots: []types.DBSnapshot{pluginSnapshot("oldest", time.Hour)}}
+
+		_, err := trp.SnapshotDatabase(context.TODO(), rdsClient, &RecordingBuildKiteAgent{}, snapshotConfig(), time.Millisecond)
+
+		require.NoError(t, err)
+		assert.Empty(t, rdsClient.deleted)
+	})
+}
+
+func TestSnapshotBeforeMigrations(t *testing.T) {
+	snapshotKey := "migrations-runner-snapshot-id-step-1"
+
+	t.Run("given a new task, it should take the snapshot and record it for the step", func(t *testing.T) {
+		trp := plugin.TaskRunnerPlugin{}
+		rdsClient := &memoryRDS{}
+		bkAgent := &RecordingBuildKiteAgent{}
+		snapshot := &plugin.StepSnapshot{}
+
+		err := trp.SnapshotBeforeMigrations(context.TODO(), rdsClient, &MockECSClient{}, bkAgent, snapshotConfig(), snapshot)
+
+		require.NoError(t, err)
+		require.Len(t, rdsClient.snapshots, 1)
+		assert.Equal(t, "migrations-runner-cool-service-db-build-42", bkAgent.metaData[snapshotKey])
+	})
+
+	t.Run("given a snapshot taken by a previous attempt, it should use it rather than take and prune another", func(t *testing.T) {
+		trp := plugin.TaskRunnerPlugin{}
+		config := snapshotConfig()
+		config.Snapshot.Retain = 1
+
+		rdsClient := &memoryRDS{snapshots: []types.DBSnapshot{pluginSnapshot("before-migrations", time.Hour)}}
+		bkAgent := &RecordingBuildKiteAgent{metaData: map[string]string{snapshotKey: "before-migrations"}}
+
+		err := trp.SnapshotBeforeMigrations(context.TODO(), rdsClient, &MockECSClient{}, bkAgent, config, &plugin.StepSnapshot{})
+
+		require.NoError(t, err)
+		assert.Len(t, rdsClient.snapshots, 1)
+		assert.Empty(t, rdsClient.deleted)
+	})
+
+	t.Run("given a task started by a previous attempt, it should not take a snapshot", func(t *testing.T) {
+		taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/abc123"
+		trp := plugin.TaskRunnerPlugin{}
+		config := snapshotConfig()
+		config.ParameterName = "/cool-service/migrations"
+
+		rdsClient := &memoryRDS{}
+		bkAgent := &RecordingBuildKiteAgent{metaData: map[string]string{"migrations-runner-task-arn-step-1-/cool-service/migrations": taskArn}}
+		ecsClient := &MockECSClient{tasks: []ecstypes.Task{{TaskArn: aws.String(taskArn), LastStatus: aws.String("RUNNING")}}}
+
+		err := trp.SnapshotBeforeMigrations(context.TODO(), rdsClient, ecsClient, bkAgent, config, &plugin.StepSnapshot{})
+
+		require.NoError(t, err)
+		assert.Empty(t, rdsClient.snapshots)
+		assert.NotContains(t, bkAgent.metaData, snapshotKey)
+	})
+
+	t.Run("given several targets, it should take the snapshot once for the step", func(t *testing.T) {
+		trp := plugin.TaskRunnerPlugin{}
+		rdsClient := &memoryRDS{}
+		snapshot := &plugin.StepSnapshot{}
+
+		for _, parameterName := range []string{"/cool-service/migrations", "/cool-service/other-migrations"} {
+			config := snapshotConfig()
+			config.ParameterName = parameterName
+			config.Build.StepID = ""
+
+			err := trp.SnapshotBeforeMigrations(context.TODO(), rdsClient, &MockECSClient{}, &RecordingBuildKiteAgent{}, config, snapshot)
+			require.NoError(t, err)
+		}
+
+		assert.Len(t, rdsClient.snapshots, 1)
+	})
+}
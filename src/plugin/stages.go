@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+)
+
+// StageResult is the outcome of one of the stages of a migration
+type StageResult struct {
+	Name              string
+	Err               error
+	Duration          time.Duration
+	ContinueOnFailure bool
+	// Skipped is set for stages that were not run because an earlier stage failed
+	Skipped bool
+}
+
+// RunStages runs a task for each stage in turn, using the stage's command and timeout with the rest of the task
+// configuration. A failed stage stops the stages after it from running, unless it is allowed to fail.
+func (trp TaskRunnerPlugin) RunStages(ctx context.Context, cloudwatchClient awsinternal.CloudWatchLogsClientAPI, waiter WaitForCompletion, bkAgent buildkite.AgentAPI, ecsClient awsinternal.EcsClientAPI, config Config, configuration *awsinternal.TaskRunnerConfiguration) error {
+	log := buildkite.LoggerFrom(ctx)
+
+	results := make([]StageResult, 0, len(config.Stages))
+	stopped := false
+
+	for i, stage := range config.Stages {
+		if stopped {
+			results = append(results, StageResult{Name: stage.Name, Skipped: true})
+			continue
+		}
+
+		log.Logf("==> Stage %d of %d: %s\n", i+1, len(config.Stages), stage.Name)
+
+		stageConfig, stageConfiguration := forStage(config, configuration, stage)
+
+		started := time.Now()
+		_, err := trp.runTask(ctx, cloudwatchClient, waiter, bkAgent, ecsClient, stageConfig, stageConfiguration)
+
+		results = append(results, StageResult{Name: stage.Name, Err: err, Duration: time.Since(started), ContinueOnFailure: stage.ContinueOnFailure})
+
+		if err != nil {
+			log.LogFailuref("stage %s failed: %v\n", stage.Name, err)
+
+			// a cancelled job stops regardless, the remaining stages would be cancelled too
+			stopped = !stage.ContinueOnFailure || ctx.Err() != nil
+		}
+	}
+
+	return trp.ReportStageResults(ctx, bkAgent, config.ParameterName, results)
+}
+
+// dryRunStages shows the task that would be run for each stage
+func (trp TaskRunnerPlugin) dryRunStages(ctx context.Context, ecsClient awsinternal.EcsClientAPI, bkAgent buildkite.AgentAPI, config Config, configuration *awsinternal.TaskRunnerConfiguration) error {
+	for i, stage := range config.Stages {
+		buildkite.LoggerFrom(ctx).Logf("==> Stage %d of %d: %s\n", i+1, len(config.Stages), stage.Name)
+
+		_, stageConfiguration := forStage(config, configuration, stage)
+
+		err := trp.DryRun(ctx, ecsClient, bkAgent, stageConfiguration, stageAnnotationContext(config.ParameterName, stage.Name))
+		if err != nil {
+			return fmt.Errorf("stage %s: %w", stage.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// forStage returns the plugin and task configuration for running the stage
+func forStage(config Config, configuration *awsinternal.TaskRunnerConfiguration, stage Stage) (Config, *awsinternal.TaskRunnerConfiguration) {
+	config.Stage = stage.Name
+	config.TimeOut = stage.TimeOut
+
+	stageConfiguration := *configuration
+	stageConfiguration.Command = stage.CommandArgs
+
+	return config, &stageConfiguration
+}
+
+// ReportStageResults annotates the build with the outcome of each stage, and returns the failures of any stages that
+// were not allowed to fail
+func (trp TaskRunnerPlugin) ReportStageResults(ctx context.Context, bkAgent buildkite.AgentAPI, parameterName string, results []StageResult) error {
+	var (
+		message  strings.Builder
+		failures []error
+		warnings int
+	)
+
+	fmt.Fprintf(&message, "Stages for %s:\n\n", markdownCode(parameterName))
+	message.WriteString("| Stage | Result | Duration |\n")
+	message.WriteString("| --- | --- | --- |\n")
+
+	for _, result := range results {
+		var outcome string
+
+		switch {
+		case result.Skipped:
+			outcome = ":heavy_minus_sign: not run, an earlier stage failed"
+		case result.Err == nil:
+			outcome = ":white_check_mark: succeeded"
+		case result.ContinueOnFailure:
+			outcome = ":warning: " + markdownText(result.Err.Error()) + " (continued)"
+			warnings++
+		default:
+			outcome = ":x: " + markdownText(result.Err.Error())
+			failures = append(failures, fmt.Errorf("stage %s: %w", result.Name, result.Err))
+		}
+
+		fmt.Fprintf(&message, "| %s | %s | %s |\n", markdownCode(result.Name), outcome, result.Duration.Round(time.Second))
+	}
+
+	style := "success"
+
+	switch {
+	case len(failures) > 0:
+		style = "error"
+	case warnings > 0:
+		style = "warning"
+	}
+
+	err := errors.Join(failures...)
+
+	bkerr := bkAgent.Annotate(ctx, message.String(), style, stageAnnotationContext(parameterName, ""))
+	if bkerr != nil {
+		return errors.Join(err, fmt.Errorf("failed to annotate buildkite with stage results: %w", bkerr))
+	}
+
+	return err
+}
+
+// stageAnnotationContext keeps the annotations for the stages of each target, and for each stage, separate
+func stageAnnotationContext(parameterName string, stageName string) string {
+	annotationContext := "migrations-runner-stages-" + parameterName
+	if stageName != "" {
+		annotationContext += "-" + stageName
+	}
+
+	return annotationContext
+}
@@ -0,0 +1,223 @@
+package plugin_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
+	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stagesECSClient starts a task for each request to run one, recording the command of each
+type stagesECSClient struct {
+	MockECSClient
+
+	commands []string
+}
+
+func (m *stagesECSClient) RunTask(ctx context.Context, params *ecs.RunTaskInput, optFns ...func(*ecs.Options)) (*ecs.RunTaskOutput, error) {
+	m.commands = append(m.commands, strings.Join(params.Overrides.ContainerOverrides[0].Command, " "))
+	taskArn := fmt.Sprintf("arn:aws:ecs:us-west-2:123456789012:task/test-cluster/task-%d", len(m.commands))
+
+	return &ecs.RunTaskOutput{Tasks: []types.Task{{TaskArn: aws.String(taskArn)}}}, nil
+}
+
+// noLogs is a CloudWatch Logs client without any log events
+type noLogs struct{}
+
+func (noLogs) GetLogEvents(ctx context.Context, params *cloudwatchlogs.GetLogEventsInput, optFns ...func(*cloudwatchlogs.Options)) (*cloudwatchlogs.GetLogEventsOutput, error) {
+	return &cloudwatchlogs.GetLogEventsOutput{}, nil
+}
+
+// exitingWith is a waiter for tasks that stop with each of the exit codes in turn
+func exitingWith(exitCodes ...int32) plugin.WaitForCompletion {
+	waited := 0
+
+	return func(ctx context.Context, waiter awsinternal.EcsWaiterAPI, taskArn string, timeOut int) (*ecs.DescribeTasksOutput, error) {
+		exitCode := exitCodes[waited]
+		waited++
+
+		return &ecs.DescribeTasksOutput{Tasks: []types.Task{{
+			TaskArn:    aws.String(taskArn),
+			LastStatus: aws.String("STOPPED"),
+			Containers: []types.Container{{Name: aws.String(awsinternal.MigrationsRunnerContainerName), ExitCode: aws.Int32(exitCode)}},
+		}}}, nil
+	}
+}
+
+func TestRunStages(t *testing.T) {
+	stagesConfig := func(continueOnFailure ...string) plugin.Config {
+		config := plugin.Config{ParameterName: "/cool-service/migrations", TimeOut: 60}
+
+		for _, name := range []string{"schema", "backfill", "verify"} {
+			config.Stages = append(config.Stages, plugin.Stage{
+				Name:              name,
+				CommandArgs:       []string{"bin/rails", name},
+				TimeOut:           60,
+				ContinueOnFailure: slices.Contains(continueOnFailure, name),
+			})
+		}
+
+		return config
+	}
+
+	runStages := func(config plugin.Config, waiter plugin.WaitForCompletion) (*stagesECSClient, *RecordingBuildKiteAgent, error) {
+		ecsClient := &stagesECSClient{MockECSClient: MockECSClient{taskDefinition: &types.TaskDefinition{}}}
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+		ctx := buildkite.WithLogger(context.TODO(), buildkite.NewLogger(io.Discard))
+
+		err := trp.RunStages(ctx, noLogs{}, waiter, bkAgent, ecsClient, config, &awsinternal.TaskRunnerConfiguration{Cluster: "test-cluster"})
+
+		return ecsClient, bkAgent, err
+	}
+
+	stagesAnnotation := func(t *testing.T, bkAgent *RecordingBuildKiteAgent) string {
+		for _, annotation := range bkAgent.annotations {
+			if strings.HasPrefix(annotation, "Stages for ") {
+				return annotation
+			}
+		}
+
+		require.Fail(t, "the stages should be annotated")
+
+		return ""
+	}
+
+	t.Run("given every stage succeeds, it should run them in order", func(t *testing.T) {
+		ecsClient, _, err := runStages(stagesConfig(), exitingWith(0, 0, 0))
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"bin/rails schema", "bin/rails backfill", "bin/rails verify"}, ecsClient.commands)
+	})
+
+	t.Run("given a stage fails, it should not run the stages after it and report them as not run", func(t *testing.T) {
+		ecsClient, bkAgent, err := runStages(stagesConfig(), exitingWith(0, 1))
+
+		var nonZeroExit *awsinternal.NonZeroExitError
+		require.ErrorAs(t, err, &nonZeroExit)
+		assert.Contains(t, err.Error(), "stage backfill")
+		assert.Equal(t, []string{"bin/rails schema", "bin/rails backfill"}, ecsClient.commands)
+
+		annotation := stagesAnnotation(t, bkAgent)
+		assert.Contains(t, annotation, "| `schema` | :white_check_mark: succeeded |")
+		assert.Contains(t, annotation, "| `backfill` | :x: ")
+		assert.Contains(t, annotation, "| `verify` | :heavy_minus_sign: not run, an earlier stage failed |")
+	})
+
+	t.Run("given a stage allowed to fail fails, it should run every stage and still return a later failure", func(t *testing.T) {
+		ecsClient, bkAgent, err := runStages(stagesConfig("schema"), exitingWith(1, 0, 1))
+
+		var nonZeroExit *awsinternal.NonZeroExitError
+		require.ErrorAs(t, err, &nonZeroExit)
+		assert.Contains(t, err.Error(), "stage verify")
+		assert.NotContains(t, err.Error(), "stage schema")
+		assert.Equal(t, []string{"bin/rails schema", "bin/rails backfill", "bin/rails verify"}, ecsClient.commands)
+
+		annotation := stagesAnnotation(t, bkAgent)
+		assert.Contains(t, annotation, "| `schema` | :warning: ")
+		assert.Contains(t, annotation, "(continued)")
+		assert.Contains(t, annotation, "| `verify` | :x: ")
+	})
+
+	t.Run("given only stages allowed to fail fail, it should run every stage and not fail", func(t *testing.T) {
+		ecsClient, _, err := runStages(stagesConfig("schema", "backfill"), exitingWith(1, 1, 0))
+
+		require.NoError(t, err)
+		assert.Len(t, ecsClient.commands, 3)
+	})
+}
+
+func TestReportStageResults(t *testing.T) {
+	exitErr := &awsinternal.NonZeroExitError{Container: "migrations-runner", ExitCode: 1}
+
+	tests := []struct {
+		name         string
+		results      []plugin.StageResult
+		expectedRows []string
+		expectedErr  error
+	}{
+		{
+			name: "given every stage succeeded, it should not return an error",
+			results: []plugin.StageResult{
+				{Name: "schema", Duration: time.Minute},
+				{Name: "backfill", Duration: 2 * time.Minute},
+			},
+			expectedRows: []string{
+				"| `schema` | :white_check_mark: succeeded | 1m0s |\n",
+				"| `backfill` | :white_check_mark: succeeded | 2m0s |\n",
+			},
+		},
+		{
+			name: "given a stage failed, it should return the failure and show the stages after it as not run",
+			results: []plugin.StageResult{
+				{Name: "schema", Err: exitErr, Duration: time.Minute},
+				{Name: "backfill", Skipped: true},
+			},
+			expectedRows: []string{
+				"| `schema` | :x: " + exitErr.Error() + " | 1m0s |\n",
+				"| `backfill` | :heavy_minus_sign: not run, an earlier stage failed | 0s |\n",
+			},
+			expectedErr: exitErr,
+		},
+		{
+			name: "given a stage allowed to fail failed, it should not return an error",
+			results: []plugin.StageResult{
+				{Name: "backfill", Err: exitErr, Duration: time.Minute, ContinueOnFailure: true},
+				{Name: "verify", Duration: time.Minute},
+			},
+			expectedRows: []string{
+				"| `backfill` | :warning: " + exitErr.Error() + " (continued) | 1m0s |\n",
+				"| `verify` | :white_check_mark: succeeded | 1m0s |\n",
+			},
+		},
+		{
+			name: "given a failure that would break the table, it should escape it",
+			results: []plugin.StageResult{
+				{Name: "back|fill", Err: fmt.Errorf("failed: a | b\nc: %w", exitErr), Duration: time.Minute},
+			},
+			expectedRows: []string{
+				"| `back\\|fill` | :x: failed: a \\| b<br>c: " + exitErr.Error() + " | 1m0s |\n",
+			},
+			expectedErr: exitErr,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bkAgent := &RecordingBuildKiteAgent{}
+			trp := plugin.TaskRunnerPlugin{}
+
+			err := trp.ReportStageResults(context.TODO(), bkAgent, "/cool-service/migrations", tc.results)
+
+			if tc.expectedErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.True(t, errors.Is(err, tc.expectedErr))
+				assert.Equal(t, plugin.ExitCodeNonZeroExit, plugin.ExitCode(err))
+			}
+
+			require.Len(t, bkAgent.annotations, 1)
+			assert.Contains(t, bkAgent.annotations[0], "Stages for `/cool-service/migrations`:")
+
+			for _, row := range tc.expectedRows {
+				assert.Contains(t, bkAgent.annotations[0], row)
+			}
+		})
+	}
+}
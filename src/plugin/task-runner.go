@@ -4,21 +4,32 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
 	"github.com/cultureamp/migrations-runner-buildkite-plugin/buildkite"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cloudwatchtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 )
 
 type TaskRunnerPlugin struct {
 }
 
+// logPollInterval is how often the task's log stream is checked for new output while the task runs
+const logPollInterval = 5 * time.Second
+
 type WaitForCompletion func(ctx context.Context, waiter awsinternal.EcsWaiterAPI, taskArn string, timeOut int) (*ecs.DescribeTasksOutput, error)
 type ConfigFetcher interface {
 	Fetch(config *Config) error
@@ -29,11 +40,9 @@ func (trp TaskRunnerPlugin) Run(ctx context.Context, fetcher ConfigFetcher, wait
 
 	err := fetcher.Fetch(&config)
 	if err != nil {
-		return fmt.Errorf("plugin configuration error: %w", err)
+		return &ConfigInvalidError{Err: fmt.Errorf("plugin configuration error: %w", err)}
 	}
 
-	buildKiteAgent := buildkite.Agent{}
-
 	buildkite.Log("Executing task-runner plugin\n")
 
 	cfg, err := awsconfig.LoadDefaultConfig(ctx)
@@ -41,114 +50,711 @@ func (trp TaskRunnerPlugin) Run(ctx context.Context, fetcher ConfigFetcher, wait
 		return fmt.Errorf("config load failed: %w", err)
 	}
 
-	ssmClient := ssm.NewFromConfig(cfg)
+	result, err := trp.runParameters(ctx, cfg, waiter, config)
 
-	buildkite.Logf("Retrieving task configuration from: %s \n", config.ParameterName)
+	// A dry run or a step awaiting approval doesn't run the migrations, so there is no outcome for later steps to act
+	// on. Once every target has planned, the step that runs them is uploaded behind a block step.
+	switch {
+	case config.DryRun:
+	case config.RequireApproval:
+		if err == nil {
+			err = trp.UploadApprovalPipeline(ctx, buildkite.Agent{}, config)
+		}
+	default:
+		trp.PublishStepOutcome(ctx, buildkite.Agent{}, config, err)
 
-	configuration, err := awsinternal.RetrieveConfiguration(ctx, ssmClient, config.ParameterName)
+		// A cancelled job has no outcome to follow up on. A failure to upload fails the step, but doesn't hide why
+		// the task failed.
+		if ctx.Err() == nil {
+			err = errors.Join(err, trp.UploadFollowUpPipeline(ctx, buildkite.Agent{}, config, result, err))
+		}
+	}
+
+	return err
+}
+
+// runParameters runs the task for each of the task configurations named by the parameter-name option. The result of
+// the task is returned when the step runs a single task, and is empty when it runs several.
+func (trp TaskRunnerPlugin) runParameters(ctx context.Context, cfg aws.Config, waiter WaitForCompletion, config Config) (awsinternal.TaskResult, error) {
+	targets, err := retrieveTargets(ctx, ssm.NewFromConfig(cfg), config.ParameterNames)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve configuration: %w", err)
+		return awsinternal.TaskResult{}, err
 	}
 
-	// The `Command` configuration is optional. If it's not provided, we don't want to update the configuration struct
-	// This check is here because otherwise it inserts a command with the value of an empty string and causes a panic
-	// TODO: Can we decompose this?
-	if config.Command != "" {
-		configuration.Command = strings.Split(config.Command, " ")
+	if config.Snapshot.Enabled() && config.DryRun {
+		buildkite.LoggerFrom(ctx).Logf("==> Snapshot of %s would be taken before the migrations run\n", config.Snapshot.Target().Identifier())
+	}
+
+	// The snapshot is taken once for the step, before the first of its targets starts a task
+	snapshot := &StepSnapshot{}
+
+	if len(targets) == 1 {
+		return trp.runTarget(ctx, cfg, waiter, config, targets[0], snapshot)
 	}
 
+	return awsinternal.TaskResult{}, trp.runTargets(ctx, cfg, waiter, config, targets, snapshot)
+}
+
+// runTarget runs the task for a single task configuration and reports its result, which is returned unless the
+// target is run in stages
+func (trp TaskRunnerPlugin) runTarget(ctx context.Context, cfg aws.Config, waiter WaitForCompletion, config Config, target awsinternal.NamedConfiguration, snapshot *StepSnapshot) (awsinternal.TaskResult, error) {
+	buildKiteAgent := buildkite.Agent{}
+	ssmClient := ssm.NewFromConfig(cfg)
+	configuration := target.Configuration
+
+	// The remainder of the run is for this target, including the lock and meta-data kept for it
+	config.ParameterName = target.ParameterName
+
+	applyPluginOverrides(config, configuration)
+
 	ecsClient := ecs.NewFromConfig(cfg)
 
-	taskArn, err := awsinternal.SubmitTask(ctx, ecsClient, configuration)
+	err := trp.ValidateConfiguration(ctx, ecsClient, buildKiteAgent, config, configuration)
 	if err != nil {
-		return fmt.Errorf("failed to submit task: %w", err)
+		return awsinternal.TaskResult{}, err
 	}
 
-	waiterClient := ecs.NewTasksStoppedWaiter(ecsClient, func(o *ecs.TasksStoppedWaiterOptions) {
-		o.MinDelay = time.Second
-		// TODO: This is currently a magic number. If we want this to be configurable, remove the nolint directive and fix it up
-		o.MaxDelay = 10 * time.Second //nolint:mnd
-	})
+	if len(configuration.Secrets) > 0 {
+		configuration.SecretValues, err = resolveSecrets(ctx, ssmClient, secretsmanager.NewFromConfig(cfg), buildKiteAgent, configuration.Secrets)
+		if err != nil {
+			return awsinternal.TaskResult{}, fmt.Errorf("failed to resolve secrets: %w", err)
+		}
+	}
+
+	if config.DryRun {
+		return awsinternal.TaskResult{}, trp.dryRunTarget(ctx, ecsClient, buildKiteAgent, config, configuration)
+	}
+
+	if config.LockTable == "" {
+		return trp.runSnapshotAndMigrations(ctx, cfg, waiter, buildKiteAgent, ecsClient, config, configuration, snapshot)
+	}
+
+	lock := awsinternal.DynamoDBLock{API: dynamodb.NewFromConfig(cfg), TableName: config.LockTable}
+	holder := awsinternal.LockHolder{ID: config.Build.StepID, BuildURL: config.Build.BuildURL}
+
+	releaseLock, err := trp.AcquireLock(ctx, lock, buildKiteAgent, config.ParameterName, holder, time.Duration(config.LockWaitTimeout)*time.Second, lockPollInterval)
+	if err != nil {
+		return awsinternal.TaskResult{}, err
+	}
+
+	result, err := trp.runSnapshotAndMigrations(ctx, cfg, waiter, buildKiteAgent, ecsClient, config, configuration, snapshot)
+
+	// A task left running is still migrating the database, so the lock is kept for as long as it may run
+	var leftRunning *TaskLeftRunningError
+	if errors.As(err, &leftRunning) {
+		releaseLock(leftRunning.RunFor)
+	} else {
+		releaseLock(0)
+	}
+
+	return result, err
+}
+
+// runSnapshotAndMigrations takes the snapshot for the step, when one is configured, then runs the migrations. A step
+// awaiting approval leaves the snapshot to the step uploaded to run the migrations once approved.
+func (trp TaskRunnerPlugin) runSnapshotAndMigrations(ctx context.Context, cfg aws.Config, waiter WaitForCompletion, buildKiteAgent buildkite.AgentAPI, ecsClient awsinternal.EcsClientAPI, config Config, configuration *awsinternal.TaskRunnerConfiguration, snapshot *StepSnapshot) (awsinternal.TaskResult, error) {
+	if config.Snapshot.Enabled() && !config.RequireApproval {
+		err := trp.SnapshotBeforeMigrations(ctx, rds.NewFromConfig(cfg), ecsClient, buildKiteAgent, config, snapshot)
+		if err != nil {
+			return awsinternal.TaskResult{}, err
+		}
+	}
+
+	return trp.runMigrations(ctx, cloudwatchlogs.NewFromConfig(cfg), waiter, buildKiteAgent, ecsClient, config, configuration)
+}
+
+// runMigrations plans the migrations for the target, then runs them unless they are to be approved first
+func (trp TaskRunnerPlugin) runMigrations(ctx context.Context, cloudwatchClient awsinternal.CloudWatchLogsClientAPI, waiter WaitForCompletion, buildKiteAgent buildkite.AgentAPI, ecsClient awsinternal.EcsClientAPI, config Config, configuration *awsinternal.TaskRunnerConfiguration) (awsinternal.TaskResult, error) {
+	if len(config.PlanCommandArgs) > 0 {
+		err := trp.plan(ctx, cloudwatchClient, waiter, buildKiteAgent, ecsClient, config, configuration)
+		if err != nil {
+			return awsinternal.TaskResult{}, err
+		}
+	}
+
+	// The migrations are run by the step uploaded for them to be approved
+	if config.RequireApproval {
+		return awsinternal.TaskResult{}, nil
+	}
+
+	if len(config.Stages) > 0 {
+		return awsinternal.TaskResult{}, trp.RunStages(ctx, cloudwatchClient, waiter, buildKiteAgent, ecsClient, config, configuration)
+	}
+
+	return trp.runTask(ctx, cloudwatchClient, waiter, buildKiteAgent, ecsClient, config, configuration)
+}
+
+// runTask runs a single task for the configuration, or attaches to the one started by a previous attempt, reports its
+// result and rolls it back if it failed
+func (trp TaskRunnerPlugin) runTask(ctx context.Context, cloudwatchClient awsinternal.CloudWatchLogsClientAPI, waiter WaitForCompletion, buildKiteAgent buildkite.AgentAPI, ecsClient awsinternal.EcsClientAPI, config Config, configuration *awsinternal.TaskRunnerConfiguration) (awsinternal.TaskResult, error) {
+	result, err := trp.runTaskToCompletion(ctx, cloudwatchClient, waiter, buildKiteAgent, ecsClient, config, configuration)
+
+	// A cancelled job isn't rolled back, the rollback would be cancelled too
+	if ctx.Err() == nil && shouldRollBack(config, err) {
+		err = trp.rollBack(ctx, cloudwatchClient, waiter, buildKiteAgent, ecsClient, config, configuration, err)
+	}
+
+	return result, err
+}
+
+// dryRunTarget shows the tasks that would be run for the target, including its rollback
+func (trp TaskRunnerPlugin) dryRunTarget(ctx context.Context, ecsClient awsinternal.EcsClientAPI, buildKiteAgent buildkite.AgentAPI, config Config, configuration *awsinternal.TaskRunnerConfiguration) error {
+	if len(config.Stages) > 0 {
+		return trp.dryRunStages(ctx, ecsClient, buildKiteAgent, config, configuration)
+	}
+
+	err := trp.DryRun(ctx, ecsClient, buildKiteAgent, configuration, taskAnnotationContext(config))
+	if err != nil || !config.RollbackOnFailure {
+		return err
+	}
+
+	buildkite.LoggerFrom(ctx).Log("==> Rollback, run if the migrations fail\n")
+
+	rollbackConfig, rollbackConfiguration := forRollback(config, configuration)
+
+	return trp.DryRun(ctx, ecsClient, buildKiteAgent, rollbackConfiguration, taskAnnotationContext(rollbackConfig))
+}
+
+// runTaskToCompletion runs the task and reports its result. The result is returned as far as it is known, which is
+// nothing when the task could not be started, and only the task ARN when it did not stop.
+func (trp TaskRunnerPlugin) runTaskToCompletion(ctx context.Context, cloudwatchClient awsinternal.CloudWatchLogsClientAPI, waiter WaitForCompletion, buildKiteAgent buildkite.AgentAPI, ecsClient awsinternal.EcsClientAPI, config Config, configuration *awsinternal.TaskRunnerConfiguration) (awsinternal.TaskResult, error) {
+	taskArn, err := trp.startOrAttachTask(ctx, ecsClient, buildKiteAgent, config, configuration)
+	if err != nil {
+		return awsinternal.TaskResult{}, err
+	}
+
+	tail := newLogTail(config.AnnotationLogLines)
+	finishLogs, logDetails := streamLogs(ctx, ecsClient, cloudwatchClient, taskArn, configuration.TaskDefinitionArn, config.MaxLogLines, tail)
+
+	waiterClient := &awsinternal.TaskPoller{
+		API:            ecsClient,
+		Interval:       time.Duration(config.PollInterval) * time.Second,
+		PendingTimeout: time.Duration(config.PendingTimeout) * time.Second,
+		OnTransition:   logTransition(ctx),
+	}
 	result, err := waiter(ctx, waiterClient, taskArn, config.TimeOut)
 
+	finishLogs()
+
+	// The context is cancelled when the job is cancelled, but the task may still need to be cleaned up
+	if ctx.Err() != nil {
+		abandonCtx := context.WithoutCancel(ctx)
+		err := fmt.Errorf("job cancelled while waiting for task: %w", ctx.Err())
+
+		if !trp.AbandonTask(abandonCtx, ecsClient, waiterClient, waiter, taskArn, config.OnCancel, config.CancelGracePeriod(), abandonReasonCancelled) {
+			return awsinternal.TaskResult{TaskArn: taskArn}, taskLeftRunning(taskArn, config, err)
+		}
+
+		trp.RecordTaskReported(abandonCtx, buildKiteAgent, config, taskArn)
+
+		return awsinternal.TaskResult{TaskArn: taskArn}, err
+	}
+
+	output := TaskOutput{LastLines: tail.Lines()}
+
+	if logDetails != nil {
+		output.LogsURL = logDetails.ConsoleURL(awsinternal.RegionFromArn(taskArn))
+
+		// The output is uploaded whether or not the task succeeded, as a failure is when it's most needed
+		if config.UploadLogs {
+			output.ArtifactPaths = trp.uploadTaskLogs(ctx, cloudwatchClient, buildKiteAgent, config, taskArn, *logDetails)
+		}
+	}
+
+	var (
+		timeoutErr      *awsinternal.TimeoutError
+		stuckPendingErr *awsinternal.StuckPendingError
+	)
+
+	// abandoned is set when the plugin stopped waiting for the task, and stopped when it has since stopped
+	abandoned, stopped := false, false
+
+	switch {
+	case errors.As(err, &timeoutErr):
+		abandoned = true
+		stopped = trp.AbandonTask(ctx, ecsClient, waiterClient, waiter, taskArn, config.OnTimeout, config.GracePeriod, abandonReasonTimedOut)
+	// The migrations haven't started, so the task is always stopped rather than left to start unobserved
+	case errors.As(err, &stuckPendingErr):
+		abandoned = true
+		stopped = trp.AbandonTask(ctx, ecsClient, waiterClient, waiter, taskArn, TaskActionStop, 0, abandonReasonStuckPending)
+	}
+
 	err = trp.HandleResults(ctx, result, err, buildKiteAgent, config)
 	if err != nil {
-		return fmt.Errorf("failed to handle task results: %w", err)
+		err = fmt.Errorf("failed to handle task results: %w", err)
+
+		switch {
+		case abandoned && !stopped:
+			return awsinternal.TaskResult{TaskArn: taskArn}, taskLeftRunning(taskArn, config, err)
+		// A task the plugin stopped is recorded as reported, so a retry runs the migrations again rather than attaching to it
+		case abandoned:
+			trp.RecordTaskReported(ctx, buildKiteAgent, config, taskArn)
+		}
+
+		return awsinternal.TaskResult{TaskArn: taskArn}, err
 	}
 
-	// In a successful scenario for task completion, we would have a `tasks` slice with a single element
+	// HandleResults has checked there is a task, the one element of the `tasks` slice
 	task := result.Tasks[0]
 
-	taskLogDetails, err := awsinternal.FindLogStreamFromTask(ctx, ecsClient, task)
+	taskResult, err := awsinternal.DescribeTaskResult(ctx, ecsClient, task)
 	if err != nil {
-		return fmt.Errorf("failed to acquire log stream information for task: %w", err)
+		return awsinternal.TaskResult{TaskArn: taskArn}, fmt.Errorf("failed to describe task result: %w", err)
 	}
 
-	cloudwatchClient := cloudwatchlogs.NewFromConfig(cfg)
-	logs, err := awsinternal.RetrieveLogs(ctx, cloudwatchClient, taskLogDetails)
-	// Failing to retrieve the logs shouldn't be show-stopper if the task is able to complete successfully.
-	// This can come from logs not being available yet, or the service lacking permissions to publish logs at the time
-	// TODO: In the original implementation this is how it worked. Is there a possible way to "Wait" for logs?
+	err = trp.ReportTaskResult(ctx, buildKiteAgent, config, taskResult, output)
+
+	trp.RecordTaskReported(ctx, buildKiteAgent, config, taskArn)
+	trp.PublishTaskOutcome(ctx, buildKiteAgent, config, taskResult, err)
+
 	if err != nil {
-		buildkite.LogFailuref("failed to retrieve CloudWatch Logs for job, continuing... %v", err)
+		return taskResult, err
 	}
 
-	if len(logs) > 0 {
-		buildkite.Logf("CloudWatch Logs for job: \n")
+	buildkite.LoggerFrom(ctx).Log("Task completed successfully :) \n")
+
+	buildkite.LoggerFrom(ctx).Log("done. \n")
+
+	return taskResult, nil
+}
+
+// retrieveTargets retrieves the task configuration for each parameter name. A name ending in a slash is a path, which
+// is expanded to every parameter directly under it.
+func retrieveTargets(ctx context.Context, ssmClient *ssm.Client, parameterNames []string) ([]awsinternal.NamedConfiguration, error) {
+	var targets []awsinternal.NamedConfiguration
+
+	for _, parameterName := range parameterNames {
+		if strings.HasSuffix(parameterName, "/") {
+			buildkite.Logf("Retrieving task configurations under: %s \n", parameterName)
 
-		for _, l := range logs {
-			if l.Timestamp != nil {
-				// Applying ISO 8601 format, l.Timestamp is in milliseconds, not very useful in logging
-				placeholder := time.UnixMilli(*l.Timestamp).Format(time.RFC3339)
-				buildkite.Logf("-> %s %s\n", placeholder, *l.Message)
+			configurations, err := awsinternal.RetrieveConfigurationsByPath(ctx, ssmClient, parameterName)
+			if err != nil {
+				return nil, configurationRetrievalError(parameterName, err)
+			}
+
+			if len(configurations) == 0 {
+				return nil, &ConfigInvalidError{Err: fmt.Errorf("no task configurations found under %s", parameterName)}
 			}
+
+			targets = append(targets, configurations...)
+
+			continue
+		}
+
+		buildkite.Logf("Retrieving task configuration from: %s \n", parameterName)
+
+		configuration, err := awsinternal.RetrieveConfiguration(ctx, ssmClient, parameterName)
+		if err != nil {
+			return nil, configurationRetrievalError(parameterName, err)
 		}
+
+		targets = append(targets, awsinternal.NamedConfiguration{ParameterName: parameterName, Configuration: configuration})
+	}
+
+	return targets, nil
+}
+
+func configurationRetrievalError(parameterName string, err error) error {
+	if isMalformedConfiguration(err) {
+		return &ConfigInvalidError{Err: fmt.Errorf("failed to parse configuration from %s: %w", parameterName, err)}
 	}
 
-	// TODO: Assuming the task only has 1 container. What if there others? Like Datadog sidecar
-	if *task.Containers[0].ExitCode != 0 {
-		return fmt.Errorf("task stopped with a non-zero exit code: %d", *task.Containers[0].ExitCode)
-		// TODO: At about here, a structured return type of "success: true/false" and "error" is returned
+	return fmt.Errorf("failed to retrieve configuration: %w", err)
+}
+
+// startOrAttachTask returns the task started by a previous attempt of the step if there is one to attach to, and
+// otherwise starts a new task
+func (trp TaskRunnerPlugin) startOrAttachTask(ctx context.Context, ecsClient awsinternal.EcsClientAPI, bkAgent buildkite.AgentAPI, config Config, configuration *awsinternal.TaskRunnerConfiguration) (string, error) {
+	if config.ForceNewTask {
+		buildkite.LoggerFrom(ctx).Log("force-new-task is set, not attaching to a task started by a previous attempt\n")
 	} else {
-		buildkite.Log("Task completed successfully :) \n")
-		// TODO: At about here, a structured return type of "success: true/false" and "error" is returned
+		taskArn, err := trp.InFlightTask(ctx, ecsClient, bkAgent, config)
+		if err != nil || taskArn != "" {
+			return taskArn, err
+		}
 	}
 
-	buildkite.Log("done. \n")
+	taskArn, err := trp.SubmitTaskWithRetry(ctx, ecsClient, bkAgent, config, configuration, time.Duration(config.RunTaskRetryTimeout)*time.Second, runTaskBackoff)
+	if err != nil {
+		return "", fmt.Errorf("failed to submit task: %w", err)
+	}
 
-	return nil
+	trp.RecordTask(ctx, bkAgent, config, taskArn)
+
+	return taskArn, nil
+}
+
+// applyPluginOverrides applies the plugin options that take precedence over the task configuration
+func applyPluginOverrides(config Config, configuration *awsinternal.TaskRunnerConfiguration) {
+	// The `Command` configuration is optional. If it's not provided, we don't want to update the configuration struct
+	// This check is here because otherwise it inserts an empty command and causes a panic
+	if len(config.CommandArgs) > 0 {
+		configuration.Command = config.CommandArgs
+	}
+
+	configuration.Environment = mergeVariables(configuration.Environment, config.Environment)
+	configuration.Secrets = mergeVariables(configuration.Secrets, config.Secrets)
+
+	// The launch type and capacity provider strategy are alternatives, so giving either replaces both
+	if config.LaunchType != "" || len(config.CapacityProviderStrategy) > 0 {
+		configuration.LaunchType = config.LaunchType
+		configuration.CapacityProviderStrategy = config.CapacityProviderStrategy
+	}
+
+	if config.PlatformVersion != "" {
+		configuration.PlatformVersion = config.PlatformVersion
+	}
+
+	if config.AssignPublicIp != nil {
+		configuration.AssignPublicIp = *config.AssignPublicIp
+	}
+
+	if len(config.PlacementConstraints) > 0 {
+		configuration.PlacementConstraints = config.PlacementConstraints
+	}
+
+	if len(config.PlacementStrategy) > 0 {
+		configuration.PlacementStrategy = config.PlacementStrategy
+	}
+
+	applyResourceOverrides(config, configuration)
+}
+
+// applyResourceOverrides applies the plugin's resource and role options over those of the task configuration
+func applyResourceOverrides(config Config, configuration *awsinternal.TaskRunnerConfiguration) {
+	if config.Cpu != "" {
+		configuration.Cpu = config.Cpu
+	}
+
+	if config.Memory != "" {
+		configuration.Memory = config.Memory
+	}
+
+	if config.EphemeralStorage != 0 {
+		configuration.EphemeralStorage = config.EphemeralStorage
+	}
+
+	if config.TaskRoleArn != "" {
+		configuration.TaskRoleArn = config.TaskRoleArn
+	}
+
+	if config.ExecutionRoleArn != "" {
+		configuration.ExecutionRoleArn = config.ExecutionRoleArn
+	}
+
+	if config.ContainerCpu != 0 {
+		configuration.ContainerCpu = config.ContainerCpu
+	}
+
+	if config.ContainerMemory != 0 {
+		configuration.ContainerMemory = config.ContainerMemory
+	}
+}
+
+// ValidateConfiguration checks the task configuration before anything is run, and when enabled, that the resources
+// it refers to exist. Every problem found is added to an annotation and returned as a ConfigInvalidError.
+func (trp TaskRunnerPlugin) ValidateConfiguration(ctx context.Context, ecsClient awsinternal.EcsClientAPI, bkAgent buildkite.AgentAPI, config Config, configuration *awsinternal.TaskRunnerConfiguration) error {
+	err := awsinternal.ValidateConfiguration(configuration)
+
+	// ECS can't override the secrets of a container, so they are passed as environment overrides, which anyone able to
+	// describe the task, or read the RunTask request in CloudTrail, can see
+	if len(configuration.Secrets) > 0 && !config.AllowPlaintextSecrets {
+		err = errors.Join(err, errors.New("secrets are passed to the task as plaintext environment overrides, visible in ecs:DescribeTasks and CloudTrail: reference them from the secrets of the task definition instead, or set allow-plaintext-secrets to pass them this way"))
+	}
+
+	if err == nil {
+		err = awsinternal.VerifyResourceOverrides(ctx, ecsClient, configuration)
+	}
+
+	if err == nil && config.VerifyResources {
+		buildkite.LoggerFrom(ctx).Log("Verifying the cluster and task definition exist")
+
+		err = awsinternal.VerifyConfigurationResources(ctx, ecsClient, configuration)
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	var message strings.Builder
+
+	fmt.Fprintf(&message, "Task configuration from `%s` is invalid:\n\n", config.ParameterName)
+
+	for _, problem := range strings.Split(err.Error(), "\n") {
+		fmt.Fprintf(&message, "- %s\n", problem)
+	}
+
+	bkerr := bkAgent.Annotate(ctx, message.String(), "error", taskAnnotationContext(config))
+	if bkerr != nil {
+		return fmt.Errorf("failed to annotate buildkite with invalid configuration: %w, annotation error: %w", err, bkerr)
+	}
+
+	return &ConfigInvalidError{Err: fmt.Errorf("task configuration from %s is invalid:\n%w", config.ParameterName, err)}
+}
+
+// mergeVariables returns the variables from base with those in overrides added or replaced
+func mergeVariables(base map[string]string, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(overrides))
+
+	for name, value := range base {
+		merged[name] = value
+	}
+
+	for name, value := range overrides {
+		merged[name] = value
+	}
+
+	return merged
+}
+
+// resolveSecrets retrieves the values of the secrets to inject into the container, and has the agent redact each of
+// them so they are never shown in the job log. Only the names of the secrets are logged.
+func resolveSecrets(ctx context.Context, ssmClient *ssm.Client, secretsManagerClient *secretsmanager.Client, bkAgent buildkite.AgentAPI, secrets map[string]string) (map[string]string, error) {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	buildkite.LoggerFrom(ctx).Logf("Resolving secrets: %s\n", strings.Join(names, ", "))
+
+	values, err := awsinternal.ResolveSecrets(ctx, ssmClient, secretsManagerClient, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		// Redaction is a safeguard against the migration printing its own environment, the plugin never prints values
+		err := bkAgent.Redact(ctx, values[name])
+		if err != nil {
+			buildkite.LoggerFrom(ctx).LogFailuref("failed to redact secret %s from the job log, continuing... %v\n", name, err)
+		}
+	}
+
+	return values, nil
 }
 
 func (trp TaskRunnerPlugin) HandleResults(ctx context.Context, output *ecs.DescribeTasksOutput, err error, bkAgent buildkite.AgentAPI, config Config) error {
 	if err != nil {
-		// This comparison is hacky, but is the only way that I could get the wrapped errors surfaced
-		// from the AWS library to be properly handled. It would be better if this was done using errors.As
-		if strings.Contains(err.Error(), "exceeded max wait time for TasksStopped waiter") {
-			err := bkAgent.Annotate(ctx, fmt.Sprintf("Task did not complete successfully within timeout (%d seconds)", config.TimeOut), "error", "migrations-runner")
+		var timeoutErr *awsinternal.TimeoutError
+		if errors.As(err, &timeoutErr) {
+			err := bkAgent.Annotate(ctx, fmt.Sprintf("Task did not complete successfully within timeout (%d seconds)", config.TimeOut), "error", taskAnnotationContext(config))
 			if err != nil {
 				return fmt.Errorf("failed to annotate buildkite with task timeout failure: %w", err)
 			}
 
-			return errors.New("task did not complete within the time limit")
+			return fmt.Errorf("task did not complete within the time limit: %w", timeoutErr)
+		}
+
+		var stuckPendingErr *awsinternal.StuckPendingError
+		if errors.As(err, &stuckPendingErr) {
+			bkerr := bkAgent.Annotate(ctx, fmt.Sprintf("Task did not start within the pending timeout (%d seconds) and was stopped: it was still %s", config.PendingTimeout, stuckPendingErr.Status), "error", taskAnnotationContext(config))
+			if bkerr != nil {
+				return fmt.Errorf("failed to annotate buildkite with stuck task: %w, annotation error: %w", stuckPendingErr, bkerr)
+			}
+
+			return fmt.Errorf("task did not start: %w", stuckPendingErr)
 		}
 
-		bkerr := bkAgent.Annotate(ctx, fmt.Sprintf("failed to wait for task completion: %v\n", err), "error", "migrations-runner")
+		bkerr := bkAgent.Annotate(ctx, fmt.Sprintf("failed to wait for task completion: %v\n", err), "error", taskAnnotationContext(config))
 		if bkerr != nil {
 			return fmt.Errorf("failed to annotate buildkite with task wait failure: %w, annotation error: %w", err, bkerr)
 		}
+
+		return fmt.Errorf("failed to wait for task completion: %w", err)
 	} else if len(output.Failures) > 0 {
 		// There is still a scenario where the task could return failures but this isn't handled by the waiter
 		// This is due to the waiter only returning errors in scenarios where there are issues querying the task
 		// or scheduling the task. For a list of the Failures that can be returned in this case, see:
 		// https://docs.aws.amazon.com/AmazonECS/latest/developerguide/api_failures_messages.html
 		// specifically, under the `DescribeTasks` API.
-		err := bkAgent.Annotate(ctx, fmt.Sprintf("Task did not complete successfully: %v", output.Failures[0]), "error", "migrations-runner")
+		err := bkAgent.Annotate(ctx, fmt.Sprintf("Task did not complete successfully: %v", output.Failures[0]), "error", taskAnnotationContext(config))
 		if err != nil {
 			return fmt.Errorf("failed to annotate buildkite with task failure: %w", err)
 		}
 
 		return fmt.Errorf("task did not complete successfully: %v", output.Failures[0])
+	} else if len(output.Tasks) == 0 {
+		err := bkAgent.Annotate(ctx, "Task did not complete successfully: ecs:DescribeTasks did not return the task", "error", taskAnnotationContext(config))
+		if err != nil {
+			return fmt.Errorf("failed to annotate buildkite with missing task: %w", err)
+		}
+
+		return errors.New("task did not complete successfully: ecs:DescribeTasks did not return the task")
 	}
 
 	return nil
 }
+
+// ReportTaskResult logs how the task and each of its containers exited, and annotates the build with a summary of the
+// task: what it ran, how long it took, how it exited, links to it in the AWS console and the last of its output.
+func (trp TaskRunnerPlugin) ReportTaskResult(ctx context.Context, bkAgent buildkite.AgentAPI, config Config, result awsinternal.TaskResult, output TaskOutput) error {
+	log := buildkite.LoggerFrom(ctx)
+
+	log.Logf("Task stopped: %s (%s)\n", result.StoppedReason, result.StopCode)
+
+	for _, container := range result.Containers {
+		log.Logf("-> container %s%s exited with code %s: %s\n", container.Name, essentialLabel(container), exitCodeLabel(container), container.Reason)
+	}
+
+	failure := result.Err()
+
+	message, err := renderTaskSummary(config, result, output, failure)
+	if err != nil {
+		log.LogFailuref("failed to render task summary, continuing... %v\n", err)
+		return failure
+	}
+
+	style := "success"
+	if failure != nil {
+		style = "error"
+	}
+
+	err = bkAgent.Annotate(ctx, message, style, taskAnnotationContext(config))
+	if err != nil {
+		// A task that succeeded isn't failed for want of an annotation
+		if failure == nil {
+			log.LogFailuref("failed to annotate buildkite with task summary, continuing... %v\n", err)
+			return nil
+		}
+
+		return fmt.Errorf("failed to annotate buildkite with task failure: %w, annotation error: %w", failure, err)
+	}
+
+	return failure
+}
+
+func essentialLabel(container awsinternal.ContainerResult) string {
+	if container.Essential {
+		return " (essential)"
+	}
+
+	return ""
+}
+
+func exitCodeLabel(container awsinternal.ContainerResult) string {
+	if container.ExitCode == nil {
+		return "none"
+	}
+
+	return strconv.Itoa(int(*container.ExitCode))
+}
+
+// logTransition returns a function that logs each change in the status of the task, with the time it was seen
+func logTransition(ctx context.Context) func(awsinternal.TaskTransition) {
+	log := buildkite.LoggerFrom(ctx)
+
+	return func(transition awsinternal.TaskTransition) {
+		if transition.From == "" {
+			log.Logf("[%s] Task status: %s\n", transition.At.Format(time.TimeOnly), transition.To)
+			return
+		}
+
+		log.Logf("[%s] Task status: %s → %s\n", transition.At.Format(time.TimeOnly), transition.From, transition.To)
+	}
+}
+
+// The reasons the plugin gives ECS for stopping a task it is no longer waiting on
+const (
+	abandonReasonCancelled    = "Buildkite job was cancelled"
+	abandonReasonTimedOut     = "Buildkite job timed out waiting for the task"
+	abandonReasonStuckPending = "Task did not start within the pending timeout"
+)
+
+// AbandonTask applies the configured action to a task that the plugin is no longer waiting on, reporting whether the
+// task has stopped. Failures are logged rather than returned, as the reason the plugin stopped waiting is the more
+// important error to report.
+func (trp TaskRunnerPlugin) AbandonTask(ctx context.Context, ecsClient awsinternal.EcsClientAPI, waiterClient awsinternal.EcsWaiterAPI, waiter WaitForCompletion, taskArn string, action TaskAction, gracePeriod int, reason string) bool {
+	log := buildkite.LoggerFrom(ctx)
+
+	switch action {
+	case TaskActionLeaveRunning:
+		log.Logf("%s, leaving task %s running\n", reason, taskArn)
+		return false
+	case TaskActionStopAfterGracePeriod:
+		log.Logf("%s, allowing task %s %d seconds to finish before stopping it\n", reason, taskArn, gracePeriod)
+
+		_, err := waiter(ctx, waiterClient, taskArn, gracePeriod)
+		if err == nil {
+			log.Log("Task stopped within the grace period")
+			return true
+		}
+	case TaskActionStop:
+	}
+
+	log.Logf("%s, stopping task %s\n", reason, taskArn)
+
+	err := awsinternal.StopTask(ctx, ecsClient, taskArn, reason)
+	if err != nil {
+		log.LogFailuref("failed to stop task %s: %v\n", taskArn, err)
+		return false
+	}
+
+	return true
+}
+
+// streamLogs follows the CloudWatch output of the task in the background while it runs, keeping the last of it in the
+// tail. The returned function must be called once the task has stopped; it blocks until the remainder of the output
+// has been printed. The log stream is returned alongside it, nil if the stream could not be found.
+func streamLogs(ctx context.Context, ecsClient awsinternal.EcsClientAPI, cloudwatchClient awsinternal.CloudWatchLogsClientAPI, taskArn string, taskDefinitionArn string, maxLines int, tail *logTail) (func(), *awsinternal.LogDetails) {
+	log := buildkite.LoggerFrom(ctx)
+
+	task := types.Task{
+		TaskArn:           &taskArn,
+		TaskDefinitionArn: &taskDefinitionArn,
+	}
+
+	taskLogDetails, err := awsinternal.FindLogStreamFromTask(ctx, ecsClient, task)
+	// Without log details we can still wait for the task to complete, we just can't show what it's doing
+	if err != nil {
+		log.LogFailuref("failed to acquire log stream information for task, continuing... %v\n", err)
+		return func() {}, nil
+	}
+
+	log.Logf("CloudWatch Logs for job: \n")
+
+	stopped := make(chan struct{})
+	tailed := make(chan error, 1)
+
+	go func() {
+		tailed <- awsinternal.TailLogs(ctx, cloudwatchClient, taskLogDetails, logPollInterval, maxLines, stopped, func(event cloudwatchtypes.OutputLogEvent) {
+			printLogEvent(log, event)
+
+			if event.Timestamp != nil {
+				tail.add(time.UnixMilli(*event.Timestamp), aws.ToString(event.Message))
+			}
+		})
+	}()
+
+	return func() {
+		close(stopped)
+
+		// Failing to retrieve the logs shouldn't be show-stopper if the task is able to complete successfully.
+		// This can come from logs not being available yet, or the service lacking permissions to publish logs at the time
+		err := <-tailed
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.LogFailuref("failed to retrieve CloudWatch Logs for job, continuing... %v\n", err)
+		}
+	}, &taskLogDetails
+}
+
+// uploadTaskLogs retrieves the complete output of the task, which may be more than was printed, and uploads it as
+// artifacts of the job
+func (trp TaskRunnerPlugin) uploadTaskLogs(ctx context.Context, cloudwatchClient awsinternal.CloudWatchLogsClientAPI, bkAgent buildkite.AgentAPI, config Config, taskArn string, logDetails awsinternal.LogDetails) []string {
+	events, err := awsinternal.RetrieveLogs(ctx, cloudwatchClient, logDetails)
+	if err != nil {
+		buildkite.LoggerFrom(ctx).LogFailuref("failed to retrieve CloudWatch Logs for upload, continuing... %v\n", err)
+		return nil
+	}
+
+	return trp.UploadLogArtifacts(ctx, bkAgent, config, taskArn, events)
+}
+
+func printLogEvent(log *buildkite.Logger, event cloudwatchtypes.OutputLogEvent) {
+	if event.Timestamp != nil {
+		// Applying ISO 8601 format, event.Timestamp is in milliseconds, not very useful in logging
+		placeholder := time.UnixMilli(*event.Timestamp).Format(time.RFC3339)
+		log.Logf("-> %s %s\n", placeholder, aws.ToString(event.Message))
+	}
+}
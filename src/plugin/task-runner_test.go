@@ -2,23 +2,107 @@ package plugin_test
 
 import (
 	"context"
-	"errors"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	awsinternal "github.com/cultureamp/migrations-runner-buildkite-plugin/aws"
 	"github.com/cultureamp/migrations-runner-buildkite-plugin/plugin"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 type MockBuildKiteAgent struct{}
 
+// RecordingBuildKiteAgent records the annotations it is asked to make
+type RecordingBuildKiteAgent struct {
+	MockBuildKiteAgent
+
+	annotations        []string
+	annotationContexts []string
+	metaData           map[string]string
+	artifacts          []string
+	pipelines          []string
+}
+
+func (m *RecordingBuildKiteAgent) Annotate(ctx context.Context, message string, style string, annotationContext string) error {
+	m.annotations = append(m.annotations, message)
+	m.annotationContexts = append(m.annotationContexts, annotationContext)
+
+	return nil
+}
+
+func (m *RecordingBuildKiteAgent) SetMetaData(ctx context.Context, key string, value string) error {
+	if m.metaData == nil {
+		m.metaData = map[string]string{}
+	}
+
+	m.metaData[key] = value
+
+	return nil
+}
+
+func (m *RecordingBuildKiteAgent) GetMetaData(ctx context.Context, key string) (string, error) {
+	return m.metaData[key], nil
+}
+
+func (m *RecordingBuildKiteAgent) UploadArtifact(ctx context.Context, path string) error {
+	m.artifacts = append(m.artifacts, path)
+	return nil
+}
+
+func (m *RecordingBuildKiteAgent) UploadPipeline(ctx context.Context, pipeline string) error {
+	m.pipelines = append(m.pipelines, pipeline)
+	return nil
+}
+
+type MockECSClient struct {
+	awsinternal.EcsClientAPI
+
+	taskDefinition *types.TaskDefinition
+	tasks          []types.Task
+	stoppedTasks   []string
+}
+
+func (m *MockECSClient) DescribeTasks(ctx context.Context, params *ecs.DescribeTasksInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTasksOutput, error) {
+	return &ecs.DescribeTasksOutput{Tasks: m.tasks}, nil
+}
+
+func (m *MockECSClient) DescribeTaskDefinition(ctx context.Context, params *ecs.DescribeTaskDefinitionInput, optFns ...func(*ecs.Options)) (*ecs.DescribeTaskDefinitionOutput, error) {
+	return &ecs.DescribeTaskDefinitionOutput{TaskDefinition: m.taskDefinition}, nil
+}
+
+func (m *MockECSClient) StopTask(ctx context.Context, params *ecs.StopTaskInput, optFns ...func(*ecs.Options)) (*ecs.StopTaskOutput, error) {
+	m.stoppedTasks = append(m.stoppedTasks, *params.Task)
+	return &ecs.StopTaskOutput{}, nil
+}
+
 func (m MockBuildKiteAgent) Annotate(ctx context.Context, message string, style string, annotationContext string) error {
 	return nil
 }
 
+func (m MockBuildKiteAgent) Redact(ctx context.Context, value string) error {
+	return nil
+}
+
+func (m MockBuildKiteAgent) SetMetaData(ctx context.Context, key string, value string) error {
+	return nil
+}
+
+func (m MockBuildKiteAgent) GetMetaData(ctx context.Context, key string) (string, error) {
+	return "", nil
+}
+
+func (m MockBuildKiteAgent) UploadArtifact(ctx context.Context, path string) error {
+	return nil
+}
+
+func (m MockBuildKiteAgent) UploadPipeline(ctx context.Context, pipeline string) error {
+	return nil
+}
+
 func TestRunPluginResponse(t *testing.T) {
 	buildKiteAgent := MockBuildKiteAgent{}
 
@@ -92,7 +176,10 @@ func TestRunPluginResponse(t *testing.T) {
 					LastStatus: aws.String("RUNNING"),
 				},
 				},
-			}, errors.New("exceeded max wait time for TasksStopped waiter")
+			}, &awsinternal.TimeoutError{TaskArn: taskArn, Timeout: 15 * time.Second}
+		},
+		"missing": func(ctx context.Context, waiter awsinternal.EcsWaiterAPI, taskArn string, timeOut int) (*ecs.DescribeTasksOutput, error) {
+			return &ecs.DescribeTasksOutput{}, nil
 		},
 	}
 
@@ -100,6 +187,7 @@ func TestRunPluginResponse(t *testing.T) {
 		"success": "",
 		"failed":  "task did not complete successfully",
 		"running": "task did not complete within the time limit",
+		"missing": "task did not complete successfully: ecs:DescribeTasks did not return the task",
 	}
 
 	for name, mockResponse := range mockResponses {
@@ -108,6 +196,10 @@ func TestRunPluginResponse(t *testing.T) {
 			plugin := plugin.TaskRunnerPlugin{}
 
 			err = plugin.HandleResults(context.TODO(), result, err, buildKiteAgent, config)
+			if expectedString[name] != "" {
+				require.Error(t, err)
+			}
+
 			if err != nil {
 				require.ErrorContains(t, err, expectedString[name])
 				t.Logf("expected: %v, actual: %v", expectedString[name], err)
@@ -115,3 +207,286 @@ func TestRunPluginResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestAbandonTask(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"
+
+	stillRunning := func(ctx context.Context, waiter awsinternal.EcsWaiterAPI, taskArn string, timeOut int) (*ecs.DescribeTasksOutput, error) {
+		return nil, &awsinternal.TimeoutError{TaskArn: taskArn, Timeout: time.Duration(timeOut) * time.Second}
+	}
+	stopsInTime := func(ctx context.Context, waiter awsinternal.EcsWaiterAPI, taskArn string, timeOut int) (*ecs.DescribeTasksOutput, error) {
+		return &ecs.DescribeTasksOutput{}, nil
+	}
+
+	tests := []struct {
+		name     string
+		action   plugin.TaskAction
+		waiter   plugin.WaitForCompletion
+		expected []string
+		stopped  bool
+	}{
+		{
+			name:     "given the stop action, it should stop the task",
+			action:   plugin.TaskActionStop,
+			waiter:   stillRunning,
+			expected: []string{taskArn},
+			stopped:  true,
+		},
+		{
+			name:     "given the leave-running action, it should not stop the task",
+			action:   plugin.TaskActionLeaveRunning,
+			waiter:   stillRunning,
+			expected: nil,
+		},
+		{
+			name:     "given the stop-after-grace-period action, when the task does not stop in time, it should stop the task",
+			action:   plugin.TaskActionStopAfterGracePeriod,
+			waiter:   stillRunning,
+			expected: []string{taskArn},
+			stopped:  true,
+		},
+		{
+			name:     "given the stop-after-grace-period action, when the task stops in time, it should not stop the task",
+			action:   plugin.TaskActionStopAfterGracePeriod,
+			waiter:   stopsInTime,
+			expected: nil,
+			stopped:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ecsClient := &MockECSClient{}
+			plugin := plugin.TaskRunnerPlugin{}
+
+			stopped := plugin.AbandonTask(context.TODO(), ecsClient, nil, tc.waiter, taskArn, tc.action, 15, "Buildkite job was cancelled")
+			require.Equal(t, tc.expected, ecsClient.stoppedTasks)
+			require.Equal(t, tc.stopped, stopped)
+		})
+	}
+}
+
+func TestReportTaskResult(t *testing.T) {
+	buildKiteAgent := MockBuildKiteAgent{}
+
+	tests := []struct {
+		name        string
+		input       awsinternal.TaskResult
+		expectedErr string
+	}{
+		{
+			name: "given a task with a sidecar, when the migrations-runner container succeeds, it should not return an error",
+			input: awsinternal.TaskResult{
+				StoppedReason: "Essential container in task exited",
+				StopCode:      "EssentialContainerExited",
+				Containers: []awsinternal.ContainerResult{
+					{Name: "datadog-agent", Essential: false, ExitCode: aws.Int32(143), Reason: "Terminated"},
+					{Name: "migrations-runner", Essential: true, ExitCode: aws.Int32(0)},
+				},
+			},
+		},
+		{
+			name: "given a task with a sidecar, when the migrations-runner container fails, it should return an error",
+			input: awsinternal.TaskResult{
+				StoppedReason: "Essential container in task exited",
+				StopCode:      "EssentialContainerExited",
+				Containers: []awsinternal.ContainerResult{
+					{Name: "datadog-agent", Essential: false, ExitCode: aws.Int32(143), Reason: "Terminated"},
+					{Name: "migrations-runner", Essential: true, ExitCode: aws.Int32(1)},
+				},
+			},
+			expectedErr: "task stopped with a non-zero exit code: 1",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			trp := plugin.TaskRunnerPlugin{}
+
+			err := trp.ReportTaskResult(context.TODO(), buildKiteAgent, plugin.Config{ParameterName: "test-parameter"}, tc.input, plugin.TaskOutput{})
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
+
+func TestReportTaskResultAnnotation(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-west-2:123456789012:task/test-cluster/07cc583696bd44e0be450bff7314ddaf"
+	startedAt := time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+
+	result := awsinternal.TaskResult{
+		TaskArn:           taskArn,
+		Cluster:           "test-cluster",
+		TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/cool-service:12",
+		StoppedReason:     "Essential container in task exited",
+		StopCode:          "EssentialContainerExited",
+		StartedAt:         startedAt,
+		StoppedAt:         startedAt.Add(95 * time.Second),
+		Command:           []string{"bin/rails", "db:migrate"},
+		Containers: []awsinternal.ContainerResult{
+			{Name: "datadog-agent", Essential: false, ExitCode: aws.Int32(143), Reason: "Terminated"},
+			{Name: "migrations-runner", Essential: true, ExitCode: aws.Int32(0), Image: "cool-service:latest", ImageDigest: "sha256:0123456789abcdef"},
+		},
+	}
+	output := plugin.TaskOutput{
+		LogsURL:   "https://us-west-2.console.aws.amazon.com/cloudwatch/home?region=us-west-2#logsV2:log-groups/log-group/cool-service",
+		LastLines: []string{"2026-10-17T03:01:30Z == 20261017 AddWidgets: migrated", "2026-10-17T03:01:34Z done"},
+		ArtifactPaths: []string{
+			"migrations-runner-logs/test-parameter-07cc583696bd44e0be450bff7314ddaf.log",
+			"migrations-runner-logs/test-parameter-07cc583696bd44e0be450bff7314ddaf.jsonl",
+		},
+	}
+
+	t.Run("given a task that succeeded, it should annotate a summary of it", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		err := trp.ReportTaskResult(context.TODO(), bkAgent, plugin.Config{ParameterName: "test-parameter"}, result, output)
+
+		require.NoError(t, err)
+		require.Len(t, bkAgent.annotations, 1)
+
+		annotation := bkAgent.annotations[0]
+		assert.Contains(t, annotation, ":white_check_mark: Migrations for `test-parameter` completed successfully")
+		assert.Contains(t, annotation, "| Task | [`07cc583696bd44e0be450bff7314ddaf`](https://us-west-2.console.aws.amazon.com/ecs/v2/clusters/test-cluster/tasks/07cc583696bd44e0be450bff7314ddaf?region=us-west-2) |")
+		assert.Contains(t, annotation, "| Task definition | `cool-service:12` |")
+		assert.Contains(t, annotation, "| Image | `cool-service:latest`<br>`sha256:0123456789abcdef` |")
+		assert.Contains(t, annotation, "| Command | `bin/rails db:migrate` |")
+		assert.Contains(t, annotation, "| Started | 2026-10-17 03:00:00 UTC |")
+		assert.Contains(t, annotation, "| Duration | 1m35s |")
+		assert.Contains(t, annotation, "| Exit code | 0 |")
+		assert.Contains(t, annotation, "| Logs | [CloudWatch Logs]("+output.LogsURL+") |")
+		assert.Contains(t, annotation, "| Full output | [`test-parameter-07cc583696bd44e0be450bff7314ddaf.log`](artifact://migrations-runner-logs/test-parameter-07cc583696bd44e0be450bff7314ddaf.log), [`test-parameter-07cc583696bd44e0be450bff7314ddaf.jsonl`](artifact://migrations-runner-logs/test-parameter-07cc583696bd44e0be450bff7314ddaf.jsonl) |")
+		assert.Contains(t, annotation, "| datadog-agent | false | 143 | Terminated |")
+		assert.Contains(t, annotation, "<details><summary>Last 2 lines of output</summary>\n\n```\n2026-10-17T03:01:30Z == 20261017 AddWidgets: migrated\n2026-10-17T03:01:34Z done\n```\n\n</details>")
+	})
+
+	t.Run("given a rollback that succeeded, it should annotate it as a rollback", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		err := trp.ReportTaskResult(context.TODO(), bkAgent, plugin.Config{ParameterName: "test-parameter", Stage: "rollback", Rollback: true}, result, plugin.TaskOutput{})
+
+		require.NoError(t, err)
+		require.Len(t, bkAgent.annotations, 1)
+		assert.Contains(t, bkAgent.annotations[0], ":white_check_mark: Rollback of `test-parameter`, after the migrations failed, completed successfully")
+	})
+
+	t.Run("given a plan, it should annotate it with its output shown", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		err := trp.ReportTaskResult(context.TODO(), bkAgent, plugin.Config{ParameterName: "test-parameter", Stage: "plan", Plan: true}, result, output)
+
+		require.NoError(t, err)
+		require.Len(t, bkAgent.annotations, 1)
+		assert.Contains(t, bkAgent.annotations[0], ":white_check_mark: Plan for `test-parameter` completed successfully")
+		assert.Contains(t, bkAgent.annotations[0], "<details open><summary>Last 2 lines of output</summary>")
+	})
+
+	t.Run("given a stage that failed, it should annotate the failure", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		failed := result
+		failed.Containers = []awsinternal.ContainerResult{{Name: "migrations-runner", Essential: true, ExitCode: aws.Int32(1)}}
+
+		err := trp.ReportTaskResult(context.TODO(), bkAgent, plugin.Config{ParameterName: "test-parameter", Stage: "backfill"}, failed, plugin.TaskOutput{})
+
+		require.EqualError(t, err, "task stopped with a non-zero exit code: 1")
+		require.Len(t, bkAgent.annotations, 1)
+
+		annotation := bkAgent.annotations[0]
+		assert.Contains(t, annotation, ":x: Migrations for `test-parameter`, stage `backfill`, did not complete successfully: task stopped with a non-zero exit code: 1")
+		assert.Contains(t, annotation, "| Exit code | 1 |")
+		assert.NotContains(t, annotation, "| Logs |")
+		assert.NotContains(t, annotation, "<details>")
+		assert.NotContains(t, annotation, "| Container |")
+	})
+
+	t.Run("given output that looks like Markdown or HTML, it should show it as it is", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		odd := result
+		odd.StoppedReason = "<b>OutOfMemory</b> | killed\nby the kernel"
+		odd.Command = []string{"sh", "-c", "echo `date` | tee out"}
+
+		err := trp.ReportTaskResult(context.TODO(), bkAgent, plugin.Config{ParameterName: "test-parameter"}, odd, plugin.TaskOutput{LastLines: []string{"```", "</details>"}})
+
+		require.NoError(t, err)
+		require.Len(t, bkAgent.annotations, 1)
+
+		annotation := bkAgent.annotations[0]
+		assert.Contains(t, annotation, "| Stop reason | &lt;b&gt;OutOfMemory&lt;/b&gt; \\| killed<br>by the kernel (EssentialContainerExited) |")
+		assert.Contains(t, annotation, "| Command | ``sh -c echo `date` \\| tee out`` |")
+		assert.Contains(t, annotation, "\n\n````\n```\n</details>\n````\n\n</details>")
+	})
+}
+
+func TestValidateConfiguration(t *testing.T) {
+	config := plugin.Config{ParameterName: "/cool-service/cool-farm/migrations-runner-config"}
+
+	t.Run("given a valid configuration, it should not annotate or return an error", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		err := trp.ValidateConfiguration(context.TODO(), &MockECSClient{}, bkAgent, config, &awsinternal.TaskRunnerConfiguration{
+			Cluster:           "test-cluster",
+			SubnetIds:         []string{"subnet-0123456789abcdef0"},
+			TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task:1",
+		})
+
+		require.NoError(t, err)
+		assert.Empty(t, bkAgent.annotations)
+	})
+
+	t.Run("given an invalid configuration, it should annotate every problem and return a ConfigInvalidError", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		err := trp.ValidateConfiguration(context.TODO(), &MockECSClient{}, bkAgent, config, &awsinternal.TaskRunnerConfiguration{
+			TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task:1",
+		})
+
+		var configInvalid *plugin.ConfigInvalidError
+		require.ErrorAs(t, err, &configInvalid)
+		require.Len(t, bkAgent.annotations, 1)
+		assert.Contains(t, bkAgent.annotations[0], "- cluster is required\n- subnetIds must contain at least one subnet for tasks run on Fargate\n")
+	})
+
+	secretsConfiguration := func() *awsinternal.TaskRunnerConfiguration {
+		return &awsinternal.TaskRunnerConfiguration{
+			Cluster:           "test-cluster",
+			SubnetIds:         []string{"subnet-0123456789abcdef0"},
+			TaskDefinitionArn: "arn:aws:ecs:us-west-2:123456789012:task-definition/test-task:1",
+			Secrets:           map[string]string{"DATABASE_PASSWORD": "arn:aws:ssm:us-west-2:123456789012:parameter/cool-service/database-password"},
+		}
+	}
+
+	t.Run("given secrets without allowing them in plaintext, it should return a ConfigInvalidError", func(t *testing.T) {
+		bkAgent := &RecordingBuildKiteAgent{}
+		trp := plugin.TaskRunnerPlugin{}
+
+		err := trp.ValidateConfiguration(context.TODO(), &MockECSClient{}, bkAgent, config, secretsConfiguration())
+
+		var configInvalid *plugin.ConfigInvalidError
+		require.ErrorAs(t, err, &configInvalid)
+		require.Len(t, bkAgent.annotations, 1)
+		assert.Contains(t, bkAgent.annotations[0], "set allow-plaintext-secrets to pass them this way")
+	})
+
+	t.Run("given secrets allowed in plaintext, it should not return an error", func(t *testing.T) {
+		allowed := config
+		allowed.AllowPlaintextSecrets = true
+
+		trp := plugin.TaskRunnerPlugin{}
+
+		err := trp.ValidateConfiguration(context.TODO(), &MockECSClient{}, &RecordingBuildKiteAgent{}, allowed, secretsConfiguration())
+
+		require.NoError(t, err)
+	})
+}